@@ -0,0 +1,70 @@
+package reverseproxy
+
+import (
+	"sync"
+	"github.com/seanjohnno/objpool"
+)
+
+const (
+	// DefaultBufferPoolMax is the most idle buffers a handler keeps if the ServerResource doesn't specify
+	DefaultBufferPoolMax = 64
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: BoundedPool
+// ------------------------------------------------------------------------------------------------------------------------
+
+// BoundedPool wraps an ObjectPool and caps how many idle objects it holds, anything added past Max is dropped
+//
+// The wrapped pool can expire objects without telling us so Size can overcount. It's reset when the wrapped pool
+// turns out to be empty so it can't get stuck at Max
+type BoundedPool struct {
+
+	// Pool is the wrapped pool
+	Pool objpool.ObjectPool
+
+	// Max is the most objects held
+	Max int
+
+	// mutex guards size
+	mutex sync.Mutex
+	size int
+}
+
+// NewBoundedPool wraps pool so it holds at most max objects
+func NewBoundedPool(pool objpool.ObjectPool, max int) *BoundedPool {
+	return &BoundedPool{ Pool: pool, Max: max }
+}
+
+// Add returns obj to the pool, unless it's already full
+func (this *BoundedPool) Add(obj interface{}) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.size >= this.Max {
+		return
+	}
+	this.size++
+	this.Pool.Add(obj)
+}
+
+// Retrieve takes an object from the pool, the bool is false if it's empty
+func (this *BoundedPool) Retrieve() (interface{}, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	obj, ok := this.Pool.Retrieve()
+	if ok {
+		this.size--
+	} else {
+		this.size = 0
+	}
+	return obj, ok
+}
+
+// Size returns how many objects the pool is holding (at most, some may have expired)
+func (this *BoundedPool) Size() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.size
+}
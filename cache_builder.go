@@ -3,12 +3,22 @@ package reverseproxy
 import (
 	"github.com/seanjohnno/memcache"
 	"errors"
+	"sync"
 )
 
 const (
 	// LRUCache constant to indicate we want an lru implementation
 	LRUCache 	= "lru"
 
+	// LFUCache constant to indicate we want an lfu implementation
+	LFUCache	= "lfu"
+
+	// FIFOCache constant to indicate we want the oldest added items evicted first
+	FIFOCache	= "fifo"
+
+	// NoStoreWhenFullCache constant to indicate we want new items refused (rather than anything evicted) when full
+	NoStoreWhenFullCache = "nostore-when-full"
+
 	// Empty string
 	Empty		= ""
 )
@@ -24,11 +34,18 @@ type CacheBuilderImpl struct {
 
 	// CacheMap is used to map a cache name to a Cache instance
 	CacheMap map[string]memcache.Cache
+
+	// OnEvict is called with the cache name (empty if unnamed), key & item whenever a cache we create evicts an entry
+	// to make room. Nil for none, it's only used by caches created after it's set
+	OnEvict func(cacheName string, key string, item memcache.CacheItem)
+
+	// mutex guards CacheMap, handlers can be created concurrently (e.g. on a config reload)
+	mutex sync.Mutex
 }
 
-// CreateCacheBuilder returns a new CacheBuilder struct
+// CreateCacheBuilder returns a new CacheBuilder struct, evictions are logged (at debug)
 func CreateCacheBuilder() CacheBuilder {
-	return &CacheBuilderImpl { CacheMap: make(map[string]memcache.Cache) }
+	return &CacheBuilderImpl { CacheMap: make(map[string]memcache.Cache), OnEvict: logEviction }
 }
 
 // CreateCache returns a Cache instance and stores it in our CacheBuilder object
@@ -39,7 +56,9 @@ func (this *CacheBuilderImpl) CreateCache(cacheName string, cacheType string, ca
 		
 		// We have cacheName so we want to check if its already been created
 		if cacheName != "" {
-			
+			this.mutex.Lock()
+			defer this.mutex.Unlock()
+
 			// It its present we can return it
 			if c, OK := this.CacheMap[cacheName]; OK {
 				return c, nil
@@ -48,6 +67,7 @@ func (this *CacheBuilderImpl) CreateCache(cacheName string, cacheType string, ca
 			} else {
 				c, err := this.CreateCacheAlgol(cacheType, cacheLimit)
 				if err == nil {
+					this.notifyEvictions(cacheName, c)
 					this.CacheMap[cacheName] = c
 				}
 				return c, err
@@ -55,7 +75,11 @@ func (this *CacheBuilderImpl) CreateCache(cacheName string, cacheType string, ca
 
 		// No CacheName so we just create (don't need to add it to our map as it doesn't have a name so it can't be shared)
 		} else {
-			return this.CreateCacheAlgol(cacheType, cacheLimit)
+			c, err := this.CreateCacheAlgol(cacheType, cacheLimit)
+			if err == nil {
+				this.notifyEvictions(cacheName, c)
+			}
+			return c, err
 		}
 	}
 	return nil, errors.New("Zero sized cache")
@@ -65,10 +89,31 @@ func (this *CacheBuilderImpl) CreateCache(cacheName string, cacheType string, ca
 func (this *CacheBuilderImpl) CreateCacheAlgol(cacheType string, limit int) (memcache.Cache, error) {
 	switch cacheType {
 	case LRUCache:
-		return memcache.CreateLRUCache(limit), nil
+		return CreateLRUCache(limit), nil
+	case LFUCache:
+		return CreateLFUCache(limit), nil
+	case FIFOCache:
+		return CreateFIFOCache(limit), nil
+	case NoStoreWhenFullCache:
+		return CreateNoStoreWhenFullCache(limit), nil
 	case Empty:
 		return nil, errors.New("You need to specify a cache strategy")
 	default:
 		return nil, errors.New("Unknown cache strategy")
 	}
-}
\ No newline at end of file
+}
+
+// logEviction is the default OnEvict
+func logEviction(cacheName string, key string, item memcache.CacheItem) {
+	Debug("Evicted from cache", cacheName, ":", key, item.Size(), "bytes")
+}
+
+// notifyEvictions passes evictions from cache (if it can report them) on to OnEvict
+func (this *CacheBuilderImpl) notifyEvictions(cacheName string, cache memcache.Cache) {
+	if notifier, ok := cache.(EvictionNotifier); ok && this.OnEvict != nil {
+		onEvict := this.OnEvict
+		notifier.AddOnEvict(func(key string, item memcache.CacheItem) {
+			onEvict(cacheName, key, item)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package reverseproxy
+
+import (
+	"container/list"
+	"errors"
+	"github.com/seanjohnno/memcache"
+	"sync"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: FIFOCacheImpl
+// ------------------------------------------------------------------------------------------------------------------------
+
+// FIFOCacheImpl is a memcache.Cache bounded by the total Size of its items which ignores how often they're used
+//
+// If Evict is set the oldest added items are dropped to make room (fifo), otherwise Add fails once it's full
+// (nostore-when-full) so whatever was cached first stays cached
+type FIFOCacheImpl struct {
+
+	// Evict drops the oldest items when full rather than refusing new ones
+	Evict bool
+
+	// OnEvict is called (outside the lock) with each entry evicted to make room, nil for none
+	OnEvict func(key string, item memcache.CacheItem)
+
+	// mutex guards everything below, the cache is shared between requests
+	mutex sync.Mutex
+
+	// limit is the maximum total size in bytes
+	limit int
+
+	// size is the current total size in bytes
+	size int
+
+	// items maps a key to its element in order
+	items map[string]*list.Element
+
+	// order holds the entries oldest first
+	order *list.List
+}
+
+// CreateFIFOCache returns a cache which holds up to limit bytes, evicting the oldest added items first
+func CreateFIFOCache(limit int) memcache.Cache {
+	return &FIFOCacheImpl{ Evict: true, limit: limit, items: make(map[string]*list.Element), order: list.New() }
+}
+
+// CreateNoStoreWhenFullCache returns a cache which holds up to limit bytes and refuses new items once it's full
+func CreateNoStoreWhenFullCache(limit int) memcache.Cache {
+	return &FIFOCacheImpl{ Evict: false, limit: limit, items: make(map[string]*list.Element), order: list.New() }
+}
+
+// AddOnEvict implements EvictionNotifier, functions are called in the order they were added
+func (this *FIFOCacheImpl) AddOnEvict(onEvict func(key string, item memcache.CacheItem)) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.OnEvict = chainOnEvict(this.OnEvict, onEvict)
+}
+
+// Add inserts (or replaces) the item under key as the newest
+func (this *FIFOCacheImpl) Add(key string, item memcache.CacheItem) error {
+	if item.Size() > this.limit {
+		return errors.New("Item is larger than the cache limit")
+	}
+
+	this.mutex.Lock()
+
+	// The replaced item's space is ours to reuse
+	available := this.limit - this.size
+	if element, ok := this.items[key]; ok {
+		available += element.Value.(*cacheEntry).item.Size()
+	}
+	if !this.Evict && item.Size() > available {
+		this.mutex.Unlock()
+		return errors.New("Cache is full")
+	}
+
+	if element, ok := this.items[key]; ok {
+		this.remove(element)
+	}
+	evicted := make([]cacheEntry, 0)
+	for this.size + item.Size() > this.limit && this.order.Len() > 0 {
+		evicted = append(evicted, this.remove(this.order.Front()))
+	}
+
+	this.items[key] = this.order.PushBack(&cacheEntry{ key, item })
+	this.size += item.Size()
+	onEvict := this.OnEvict
+	this.mutex.Unlock()
+
+	notifyEvicted(onEvict, evicted)
+	return nil
+}
+
+// Get returns the item under key, it doesn't affect the eviction order
+func (this *FIFOCacheImpl) Get(key string) (memcache.CacheItem, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if element, ok := this.items[key]; ok {
+		return element.Value.(*cacheEntry).item, true
+	}
+	return nil, false
+}
+
+// Remove deletes the item under key (if present)
+func (this *FIFOCacheImpl) Remove(key string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if element, ok := this.items[key]; ok {
+		this.remove(element)
+	}
+}
+
+// remove takes element out of the cache and returns its entry
+func (this *FIFOCacheImpl) remove(element *list.Element) cacheEntry {
+	entry := this.order.Remove(element).(*cacheEntry)
+	delete(this.items, entry.key)
+	this.size -= entry.item.Size()
+	return *entry
+}
@@ -0,0 +1,171 @@
+package reverseproxy
+
+import (
+	"container/list"
+	"errors"
+	"github.com/seanjohnno/memcache"
+	"sync"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: LFUCacheImpl
+// ------------------------------------------------------------------------------------------------------------------------
+
+// LFUCacheImpl is a least-frequently-used memcache.Cache, bounded by the total Size of its items
+//
+// Items are kept in a list per access count so finding the one to evict is cheap. Items used equally often
+// are evicted least recently used first, so a burst of one-off requests can't push out the files everyone wants
+type LFUCacheImpl struct {
+
+	// OnEvict is called (outside the lock) with each entry evicted to make room, nil for none
+	OnEvict func(key string, item memcache.CacheItem)
+
+	// mutex guards everything below, the cache is shared between requests
+	mutex sync.Mutex
+
+	// limit is the maximum total size in bytes
+	limit int
+
+	// size is the current total size in bytes
+	size int
+
+	// items maps a key to its element in one of the frequencies lists
+	items map[string]*list.Element
+
+	// frequencies maps an access count to the items with that count, most recently used at the front
+	frequencies map[int]*list.List
+
+	// minFrequency is the lowest access count of any item, where we evict from
+	minFrequency int
+}
+
+// lfuEntry is the value held in the frequencies lists
+type lfuEntry struct {
+	key string
+	item memcache.CacheItem
+	frequency int
+}
+
+// CreateLFUCache returns an LFU cache which holds up to limit bytes
+func CreateLFUCache(limit int) memcache.Cache {
+	return &LFUCacheImpl{ limit: limit, items: make(map[string]*list.Element), frequencies: make(map[int]*list.List) }
+}
+
+// AddOnEvict implements EvictionNotifier, functions are called in the order they were added
+func (this *LFUCacheImpl) AddOnEvict(onEvict func(key string, item memcache.CacheItem)) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.OnEvict = chainOnEvict(this.OnEvict, onEvict)
+}
+
+// Add inserts (or replaces) the item under key, evicting the least frequently used items until it fits
+func (this *LFUCacheImpl) Add(key string, item memcache.CacheItem) error {
+	if item.Size() > this.limit {
+		return errors.New("Item is larger than the cache limit")
+	}
+
+	this.mutex.Lock()
+
+	// Replacing keeps the access count, it's the same file
+	frequency := 1
+	if element, ok := this.items[key]; ok {
+		frequency = element.Value.(*lfuEntry).frequency
+		this.remove(element)
+	}
+
+	evicted := make([]cacheEntry, 0)
+	for this.size + item.Size() > this.limit && len(this.items) > 0 {
+		evicted = append(evicted, this.evict())
+	}
+
+	this.insert(&lfuEntry{ key, item, frequency })
+	if frequency < this.minFrequency || len(this.items) == 1 {
+		this.minFrequency = frequency
+	}
+	onEvict := this.OnEvict
+	this.mutex.Unlock()
+
+	notifyEvicted(onEvict, evicted)
+	return nil
+}
+
+// Get returns the item under key and bumps its access count
+func (this *LFUCacheImpl) Get(key string) (memcache.CacheItem, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	element, ok := this.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lfuEntry)
+	this.remove(element)
+	if this.frequencies[this.minFrequency] == nil {
+		this.minFrequency = entry.frequency + 1
+	}
+	entry.frequency++
+	this.insert(entry)
+	return entry.item, true
+}
+
+// Remove deletes the item under key (if present)
+func (this *LFUCacheImpl) Remove(key string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if element, ok := this.items[key]; ok {
+		this.remove(element)
+		this.resetMinFrequency()
+	}
+}
+
+// insert adds entry to the front of its frequency list
+func (this *LFUCacheImpl) insert(entry *lfuEntry) {
+	bucket, ok := this.frequencies[entry.frequency]
+	if !ok {
+		bucket = list.New()
+		this.frequencies[entry.frequency] = bucket
+	}
+	this.items[entry.key] = bucket.PushFront(entry)
+	this.size += entry.item.Size()
+}
+
+// remove takes element out of its frequency list (dropping the list if it's now empty)
+func (this *LFUCacheImpl) remove(element *list.Element) {
+	entry := element.Value.(*lfuEntry)
+	bucket := this.frequencies[entry.frequency]
+	bucket.Remove(element)
+	if bucket.Len() == 0 {
+		delete(this.frequencies, entry.frequency)
+	}
+	delete(this.items, entry.key)
+	this.size -= entry.item.Size()
+}
+
+// evict removes the least recently used of the least frequently used items and returns it
+func (this *LFUCacheImpl) evict() cacheEntry {
+	bucket, ok := this.frequencies[this.minFrequency]
+	if !ok {
+		this.resetMinFrequency()
+		bucket = this.frequencies[this.minFrequency]
+	}
+	entry := bucket.Back().Value.(*lfuEntry)
+	this.remove(bucket.Back())
+	this.resetMinFrequency()
+	return cacheEntry{ entry.key, entry.item }
+}
+
+// resetMinFrequency recalculates minFrequency after its bucket may have been emptied
+func (this *LFUCacheImpl) resetMinFrequency() {
+	if _, ok := this.frequencies[this.minFrequency]; ok || len(this.items) == 0 {
+		return
+	}
+
+	this.minFrequency = 0
+	for frequency := range this.frequencies {
+		if this.minFrequency == 0 || frequency < this.minFrequency {
+			this.minFrequency = frequency
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package reverseproxy
+
+import (
+	"container/list"
+	"github.com/seanjohnno/memcache"
+	"sync"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// interface: EvictionNotifier
+// ------------------------------------------------------------------------------------------------------------------------
+
+// EvictionNotifier is implemented by caches which can report the entries they evict to make room
+type EvictionNotifier interface {
+
+	// AddOnEvict adds a function to be called with each evicted entry, after any added before it
+	AddOnEvict(onEvict func(key string, item memcache.CacheItem))
+}
+
+// cacheEntry is a key & item held in one of our caches
+type cacheEntry struct {
+	key string
+	item memcache.CacheItem
+}
+
+// chainOnEvict returns a function calling first (if set) then next
+func chainOnEvict(first func(key string, item memcache.CacheItem), next func(key string, item memcache.CacheItem)) func(key string, item memcache.CacheItem) {
+	if first == nil {
+		return next
+	}
+	return func(key string, item memcache.CacheItem) {
+		first(key, item)
+		next(key, item)
+	}
+}
+
+// notifyEvicted calls onEvict (if set) for each of evicted, callers mustn't hold their lock so onEvict can use the cache
+func notifyEvicted(onEvict func(key string, item memcache.CacheItem), evicted []cacheEntry) {
+	if onEvict == nil {
+		return
+	}
+	for _, entry := range evicted {
+		onEvict(entry.key, entry.item)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: LRUCacheImpl
+// ------------------------------------------------------------------------------------------------------------------------
+
+// LRUCacheImpl wraps the memcache LRU (which holds the items) so it can report evictions
+//
+// memcache doesn't say what it evicts, so the keys are tracked in the same least-recently-used order alongside it and
+// whatever it would have dropped to make room for an Add is what's reported
+type LRUCacheImpl struct {
+
+	// Cache is the memcache LRU holding the items
+	Cache memcache.Cache
+
+	// OnEvict is called (outside the lock) with each entry evicted to make room, nil for none
+	OnEvict func(key string, item memcache.CacheItem)
+
+	// mutex guards everything below, the cache is shared between requests
+	mutex sync.Mutex
+
+	// limit is the maximum total size in bytes
+	limit int
+
+	// size is the current total size in bytes
+	size int
+
+	// items maps a key to its element in order
+	items map[string]*list.Element
+
+	// order holds the entries least recently used first
+	order *list.List
+}
+
+// CreateLRUCache returns an LRU cache which holds up to limit bytes
+func CreateLRUCache(limit int) memcache.Cache {
+	return &LRUCacheImpl{ Cache: memcache.CreateLRUCache(limit), limit: limit, items: make(map[string]*list.Element), order: list.New() }
+}
+
+// AddOnEvict implements EvictionNotifier, functions are called in the order they were added
+func (this *LRUCacheImpl) AddOnEvict(onEvict func(key string, item memcache.CacheItem)) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.OnEvict = chainOnEvict(this.OnEvict, onEvict)
+}
+
+// Add inserts (or replaces) the item under key as the most recently used, the least recently used are evicted until it fits
+func (this *LRUCacheImpl) Add(key string, item memcache.CacheItem) error {
+	this.mutex.Lock()
+	if err := this.Cache.Add(key, item); err != nil {
+		this.mutex.Unlock()
+		return err
+	}
+
+	if element, ok := this.items[key]; ok {
+		this.remove(element)
+	}
+
+	evicted := make([]cacheEntry, 0)
+	for this.size + item.Size() > this.limit && this.order.Len() > 0 {
+		evicted = append(evicted, this.remove(this.order.Front()))
+	}
+
+	this.items[key] = this.order.PushBack(&cacheEntry{ key, item })
+	this.size += item.Size()
+	onEvict := this.OnEvict
+	this.mutex.Unlock()
+
+	notifyEvicted(onEvict, evicted)
+	return nil
+}
+
+// Get returns the item under key and marks it as the most recently used
+func (this *LRUCacheImpl) Get(key string) (memcache.CacheItem, bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	item, ok := this.Cache.Get(key)
+	if element, tracked := this.items[key]; ok && tracked {
+		this.order.MoveToBack(element)
+	}
+	return item, ok
+}
+
+// Remove deletes the item under key (if present)
+func (this *LRUCacheImpl) Remove(key string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.Cache.Remove(key)
+	if element, ok := this.items[key]; ok {
+		this.remove(element)
+	}
+}
+
+// remove stops tracking element and returns its entry
+func (this *LRUCacheImpl) remove(element *list.Element) cacheEntry {
+	entry := this.order.Remove(element).(*cacheEntry)
+	delete(this.items, entry.key)
+	this.size -= entry.item.Size()
+	return *entry
+}
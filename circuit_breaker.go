@@ -0,0 +1,165 @@
+package reverseproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed	= "closed"
+	BreakerOpen		= "open"
+	BreakerHalfOpen	= "half-open"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: CircuitBreaker
+// ------------------------------------------------------------------------------------------------------------------------
+
+// CircuitBreaker tracks failures for an upstream so we can stop sending it requests while it's failing
+//
+// It opens once the failure ratio within a window passes the threshold. While open requests are rejected, after
+// OpenDuration a single probe request is let through (half-open) and its result decides whether we close or re-open
+type CircuitBreaker struct {
+
+	// Config holds the thresholds
+	Config CircuitBreakerConfig
+
+	// Clock returns the current time, it's only swapped out for testing
+	Clock func() time.Time
+
+	// mutex guards the state below, requests are handled concurrently
+	mutex sync.Mutex
+
+	state string
+	windowStart time.Time
+	requests int
+	failures int
+	openedAt time.Time
+	probing bool
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker
+func NewCircuitBreaker(config CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{ Config: config, Clock: time.Now, state: BreakerClosed }
+}
+
+// Allow checks whether a request should be sent to the upstream
+func (this *CircuitBreaker) Allow() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	switch this.state {
+	case BreakerOpen:
+		if this.Clock().Sub(this.openedAt) < this.openDuration() {
+			return false
+		}
+
+		// Been open long enough, let a probe through
+		Info("Circuit breaker half-open, probing upstream")
+		this.state = BreakerHalfOpen
+		this.probing = true
+		return true
+
+	case BreakerHalfOpen:
+
+		// Only one probe at a time
+		if this.probing {
+			return false
+		}
+		this.probing = true
+		return true
+	}
+	return true
+}
+
+// Record adds the result of a request that Allow let through
+func (this *CircuitBreaker) Record(success bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := this.Clock()
+	switch this.state {
+	case BreakerHalfOpen:
+		this.probing = false
+		if success {
+			Info("Circuit breaker closed, upstream recovered")
+			this.state = BreakerClosed
+			this.resetWindow(now)
+		} else {
+			this.open(now)
+		}
+
+	case BreakerClosed:
+		if now.Sub(this.windowStart) >= this.window() {
+			this.resetWindow(now)
+		}
+
+		this.requests++
+		if !success {
+			this.failures++
+		}
+
+		if this.requests >= this.Config.MinRequests && float64(this.failures) / float64(this.requests) >= this.Config.FailureRatio {
+			this.open(now)
+		}
+	}
+}
+
+// State returns the current state (BreakerClosed, BreakerOpen or BreakerHalfOpen)
+func (this *CircuitBreaker) State() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.state
+}
+
+// Ready checks whether Allow would let a request through without changing anything, unlike State an open breaker is
+// ready once OpenDuration has passed
+func (this *CircuitBreaker) Ready() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	switch this.state {
+	case BreakerOpen:
+		return this.Clock().Sub(this.openedAt) >= this.openDuration()
+	case BreakerHalfOpen:
+		return !this.probing
+	}
+	return true
+}
+
+// RetryAfter returns how long until the breaker will next let a request through
+func (this *CircuitBreaker) RetryAfter() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.state != BreakerOpen {
+		return 0
+	}
+	if remaining := this.openDuration() - this.Clock().Sub(this.openedAt); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// open switches to the open state, must be called with the lock held
+func (this *CircuitBreaker) open(now time.Time) {
+	Warning("Circuit breaker open, failures:", this.failures, "requests:", this.requests)
+	this.state = BreakerOpen
+	this.openedAt = now
+}
+
+// resetWindow starts a new counting window, must be called with the lock held
+func (this *CircuitBreaker) resetWindow(now time.Time) {
+	this.windowStart = now
+	this.requests = 0
+	this.failures = 0
+}
+
+func (this *CircuitBreaker) window() time.Duration {
+	return time.Duration(this.Config.Window) * time.Millisecond
+}
+
+func (this *CircuitBreaker) openDuration() time.Duration {
+	return time.Duration(this.Config.OpenDuration) * time.Millisecond
+}
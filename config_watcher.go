@@ -0,0 +1,66 @@
+package reverseproxy
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	// DefaultConfigPollInterval is how often (in milliseconds) WatchConfigFile checks the file if no interval is given
+	DefaultConfigPollInterval = 2000
+)
+
+// WatchConfigFile polls the config file at configLocation and Reloads the Server when its modtime changes
+//
+// Configs that fail to load are logged and ignored so the running config keeps serving. Call the returned function
+// to stop watching
+func (this *Server) WatchConfigFile(configLocation string, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultConfigPollInterval * time.Millisecond
+	}
+
+	var lastModTime time.Time
+	if fi, err := os.Stat(configLocation); err == nil {
+		lastModTime = fi.ModTime()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+				fi, err := os.Stat(configLocation)
+				if err != nil {
+					Error("Unable to stat config file:", err)
+					continue
+				}
+				if fi.ModTime().Equal(lastModTime) {
+					continue
+				}
+				lastModTime = fi.ModTime()
+
+				Info("Config file changed, reloading:", configLocation)
+				if err := this.reloadFromFile(configLocation); err != nil {
+					Error("Config not reloaded:", err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// reloadFromFile loads the config file and Reloads with it
+func (this *Server) reloadFromFile(configLocation string) error {
+	blocks, err := LoadConfigFromFile(configLocation)
+	if err != nil {
+		return err
+	}
+	return this.Reload(blocks)
+}
@@ -0,0 +1,47 @@
+package reverseproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// contextKey keeps our request context values apart from anyone elses
+type contextKey int
+
+const (
+	resourceContextKey contextKey = iota
+	clientIPContextKey
+	requestIDContextKey
+)
+
+// ResourceFromContext returns the ServerResource the request was matched to, nil if it hasn't been dispatched yet
+func ResourceFromContext(ctx context.Context) *ServerResource {
+	rsc, _ := ctx.Value(resourceContextKey).(*ServerResource)
+	return rsc
+}
+
+// ClientIPFromContext returns the clients IP, it's the real client (not the proxy) if the peer is a TrustedProxy
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPContextKey).(string)
+	return ip
+}
+
+// RequestIDFromContext returns the requests X-Request-ID
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// withContextValue returns a shallow copy of req with key set to val in its context
+func withContextValue(req *http.Request, key contextKey, val interface{}) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), key, val))
+}
+
+// remoteIP returns the IP from req.RemoteAddr
+func remoteIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
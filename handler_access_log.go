@@ -0,0 +1,133 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAccessLogFormat is used when access logging is on but no AccessLogFormat is set
+	DefaultAccessLogFormat = `{client_ip} {host} "{method} {path}" {status} {bytes} {duration}`
+)
+
+var (
+	// accessLogFieldPattern matches a {field} in an access log format
+	accessLogFieldPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+	// accessLogFields renders each known {field} for a finished request
+	accessLogFields = map[string]func(entry *accessLogEntry) string {
+		"method": func(entry *accessLogEntry) string { return entry.method },
+		"path": func(entry *accessLogEntry) string { return entry.path },
+		"host": func(entry *accessLogEntry) string { return entry.host },
+		"status": func(entry *accessLogEntry) string { return strconv.Itoa(entry.status) },
+		"bytes": func(entry *accessLogEntry) string { return strconv.Itoa(entry.bytes) },
+		"duration": func(entry *accessLogEntry) string { return entry.duration.String() },
+		"client_ip": func(entry *accessLogEntry) string {
+			if ip := ClientIPFromContext(entry.req.Context()); ip != "" {
+				return ip
+			}
+			return remoteIP(entry.req)
+		},
+		"request_id": func(entry *accessLogEntry) string { return entry.req.Header.Get(HeaderRequestID) },
+	}
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: AccessLogger
+// ------------------------------------------------------------------------------------------------------------------------
+
+// AccessLogger wraps a RequestHandler and logs (at info level) a line for every request, rendered from Format
+//
+// Format is plain text with {method}, {path}, {host}, {status}, {bytes} (of the body), {duration}, {client_ip} and
+// {request_id} replaced for each request
+type AccessLogger struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// Format is the template each line is rendered from
+	Format string
+
+	// parts is Format split into literal text & fields
+	parts []accessLogPart
+}
+
+// accessLogPart is either literal text or a field of the access log format
+type accessLogPart struct {
+	text string
+	field func(entry *accessLogEntry) string
+}
+
+// accessLogEntry is what's known about a request once it's been handled
+//
+// The method, path & host are taken before it's handled, handlers can rewrite the URL (e.g. to serve an error page)
+type accessLogEntry struct {
+	req *http.Request
+	method string
+	path string
+	host string
+	status int
+	bytes int
+	duration time.Duration
+}
+
+// NewAccessLogger wraps handler so each request is logged in format (DefaultAccessLogFormat if empty)
+//
+// It panics if format references an unknown field
+func NewAccessLogger(handler RequestHandler, format string) *AccessLogger {
+	if format == "" {
+		format = DefaultAccessLogFormat
+	}
+
+	parts, err := parseAccessLogFormat(format)
+	if err != nil {
+		panic(err)
+	}
+	return &AccessLogger{ Handler: handler, Format: format, parts: parts }
+}
+
+func (this *AccessLogger) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	entry := &accessLogEntry{ req: req, method: req.Method, path: req.URL.RequestURI(), host: req.Host }
+	start := time.Now()
+	sw := NewStatusResponseWriter(w)
+	this.Handler.HandleRequest(sw, req)
+
+	entry.status, entry.bytes, entry.duration = sw.Status, sw.Bytes, time.Since(start)
+	var line strings.Builder
+	for _, part := range this.parts {
+		if part.field != nil {
+			line.WriteString(part.field(entry))
+		} else {
+			line.WriteString(part.text)
+		}
+	}
+	Info(line.String())
+}
+
+// parseAccessLogFormat splits format into its literal text & fields, returning an error for an unknown field
+func parseAccessLogFormat(format string) ([]accessLogPart, error) {
+	parts := make([]accessLogPart, 0)
+	last := 0
+	for _, match := range accessLogFieldPattern.FindAllStringSubmatchIndex(format, -1) {
+		name := format[match[2]:match[3]]
+		field, known := accessLogFields[name]
+		if !known {
+			return nil, fmt.Errorf("Unknown access log field: {%s}", name)
+		}
+
+		if match[0] > last {
+			parts = append(parts, accessLogPart{ text: format[last:match[0]] })
+		}
+		parts = append(parts, accessLogPart{ field: field })
+		last = match[1]
+	}
+
+	if last < len(format) {
+		parts = append(parts, accessLogPart{ text: format[last:] })
+	}
+	return parts, nil
+}
@@ -1,5 +1,11 @@
 package reverseproxy
 
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
 type BaseHandler struct {
 
 	// Resource is used to give the RequestHandler function some context on why it was called
@@ -12,3 +18,68 @@ type BaseHandler struct {
 	ErrorMappings []ErrorMapping
 }
 
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: StatusResponseWriter
+// ------------------------------------------------------------------------------------------------------------------------
+
+// StatusResponseWriter wraps a http.ResponseWriter so wrapping handlers can see what was written
+type StatusResponseWriter struct {
+
+	// ResponseWriter is the underlying writer everything is passed through to
+	http.ResponseWriter
+
+	// Status is the status code written, defaults to 200 as that's what's sent if WriteHeader isn't called
+	Status int
+
+	// Bytes is the number of body bytes written
+	Bytes int
+
+	// WroteHeader is set once the status has been sent (by WriteHeader or the first Write)
+	WroteHeader bool
+}
+
+// NewStatusResponseWriter returns a StatusResponseWriter wrapping w
+func NewStatusResponseWriter(w http.ResponseWriter) *StatusResponseWriter {
+	return &StatusResponseWriter{ ResponseWriter: w, Status: http.StatusOK }
+}
+
+func (this *StatusResponseWriter) WriteHeader(status int) {
+	this.Status = status
+	this.WroteHeader = true
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *StatusResponseWriter) Write(data []byte) (int, error) {
+	n, err := this.ResponseWriter.Write(data)
+	this.WroteHeader = true
+	this.Bytes += n
+	return n, err
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: CountingReadCloser
+// ------------------------------------------------------------------------------------------------------------------------
+
+// CountingReadCloser wraps a request body and counts the bytes read from it
+//
+// The transport can read a proxied body on its own goroutine so the count is kept atomically
+type CountingReadCloser struct {
+
+	// ReadCloser is the underlying body
+	io.ReadCloser
+
+	// bytes is the number of bytes read
+	bytes int64
+}
+
+func (this *CountingReadCloser) Read(p []byte) (int, error) {
+	n, err := this.ReadCloser.Read(p)
+	atomic.AddInt64(&this.bytes, int64(n))
+	return n, err
+}
+
+// Bytes returns the number of bytes read so far
+func (this *CountingReadCloser) Bytes() int64 {
+	return atomic.LoadInt64(&this.bytes)
+}
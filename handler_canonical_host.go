@@ -0,0 +1,57 @@
+package reverseproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: CanonicalHostHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+// CanonicalHostHandler wraps a RequestHandler and 301's requests for any other Host to CanonicalHost
+//
+// The scheme, path & query are kept. So is the port, unless CanonicalHost has its own
+type CanonicalHostHandler struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// CanonicalHost is the host every request should use, e.g. www.example.com
+	CanonicalHost string
+}
+
+// NewCanonicalHostHandler wraps handler so requests are redirected to host
+func NewCanonicalHostHandler(handler RequestHandler, host string) *CanonicalHostHandler {
+	return &CanonicalHostHandler{ Handler: handler, CanonicalHost: host }
+}
+
+func (this *CanonicalHostHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	requestHost, port := req.Host, ""
+	if h, p, err := net.SplitHostPort(req.Host); err == nil {
+		requestHost, port = h, p
+	}
+
+	canonical := this.CanonicalHost
+	canonicalHost := canonical
+	if h, _, err := net.SplitHostPort(canonical); err == nil {
+		canonicalHost = h
+	} else if port != "" {
+		canonical = net.JoinHostPort(canonical, port)
+	}
+
+	if strings.EqualFold(requestHost, canonicalHost) {
+		this.Handler.HandleRequest(w, req)
+		return
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	target := scheme + "://" + canonical + req.URL.RequestURI()
+
+	Debug("+CanonicalHostHandler - Redirecting", req.Host, "to", target)
+	http.Redirect(w, req, target, http.StatusMovedPermanently)
+}
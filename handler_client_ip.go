@@ -0,0 +1,108 @@
+package reverseproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderForwardedFor = "X-Forwarded-For"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: ClientIPHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+// ClientIPHandler wraps a RequestHandler and sets req.RemoteAddr to the real client address
+//
+// X-Forwarded-For is only believed if the direct peer is one of the TrustedProxies, otherwise anyone could claim to be
+// anyone. Entries are read right to left (the nearest proxy appends last) and the first untrusted one is the client
+type ClientIPHandler struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// TrustedProxies are the networks whose X-Forwarded-For we believe
+	TrustedProxies []*net.IPNet
+}
+
+// NewClientIPHandler returns a ClientIPHandler trusting proxies, each a CIDR or single IP
+//
+// It panics if any of them can't be parsed
+func NewClientIPHandler(handler RequestHandler, proxies []string) *ClientIPHandler {
+	trusted, err := ParseTrustedProxies(proxies)
+	if err != nil {
+		panic(err)
+	}
+	return &ClientIPHandler{ Handler: handler, TrustedProxies: trusted }
+}
+
+func (this *ClientIPHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	if ip := this.ClientIP(req); ip != "" {
+		port := "0"
+		if _, p, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			port = p
+		}
+		req.RemoteAddr = net.JoinHostPort(ip, port)
+		req = withContextValue(req, clientIPContextKey, ip)
+	}
+	this.Handler.HandleRequest(w, req)
+}
+
+// ClientIP returns the clients IP for the request
+func (this *ClientIPHandler) ClientIP(req *http.Request) string {
+	peer := remoteIP(req)
+	if !this.isTrusted(peer) {
+		return peer
+	}
+
+	// Every hop so far was trusted, the leftmost entry is the best we've got if they all are
+	client := peer
+	forwarded := strings.Split(strings.Join(req.Header[HeaderForwardedFor], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		client = ip
+		if !this.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+func (this *ClientIPHandler) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range this.TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses CIDRs, a single IP is treated as a network containing just that address
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,71 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: ConcurrencyLimiter
+// ------------------------------------------------------------------------------------------------------------------------
+
+// ConcurrencyLimiter wraps a RequestHandler and limits how many requests it handles at once
+//
+// Requests over the limit wait up to QueueTimeout for a slot, then get a 503. With no QueueTimeout they get the
+// 503 straight away. The 503 asks clients to retry after QueueTimeout (at least a second)
+type ConcurrencyLimiter struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// QueueTimeout is how long a request waits for a slot
+	QueueTimeout time.Duration
+
+	// slots is a semaphore, a request holds a slot by sending on it
+	slots chan struct{}
+}
+
+// NewConcurrencyLimiter wraps handler so at most maxConcurrent requests are handled at once
+func NewConcurrencyLimiter(handler RequestHandler, maxConcurrent int, queueTimeoutMs int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{ Handler: handler, QueueTimeout: time.Duration(queueTimeoutMs) * time.Millisecond,
+		slots: make(chan struct{}, maxConcurrent) }
+}
+
+func (this *ConcurrencyLimiter) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	if !this.acquire() {
+		Debug("+ConcurrencyLimiter - Too many requests:", req.URL.Path)
+		setRetryAfter(w, this.QueueTimeout)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// Deferred so the slot is released even if the handler panics
+	defer this.release()
+	this.Handler.HandleRequest(w, req)
+}
+
+// acquire takes a slot, waiting up to QueueTimeout. Returns false if we couldn't get one
+func (this *ConcurrencyLimiter) acquire() bool {
+	select {
+	case this.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if this.QueueTimeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(this.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case this.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (this *ConcurrencyLimiter) release() {
+	<-this.slots
+}
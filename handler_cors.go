@@ -0,0 +1,143 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS request / response headers
+const (
+	HeaderOrigin						= "Origin"
+	HeaderVary							= "Vary"
+	HeaderAccessControlRequestMethod	= "Access-Control-Request-Method"
+	HeaderAccessControlRequestHeaders	= "Access-Control-Request-Headers"
+	HeaderAccessControlAllowOrigin		= "Access-Control-Allow-Origin"
+	HeaderAccessControlAllowMethods		= "Access-Control-Allow-Methods"
+	HeaderAccessControlAllowHeaders		= "Access-Control-Allow-Headers"
+	HeaderAccessControlAllowCredentials	= "Access-Control-Allow-Credentials"
+	HeaderAccessControlMaxAge			= "Access-Control-Max-Age"
+	AnyOrigin							= "*"
+)
+
+var (
+	// DefaultCORSMethods are allowed if CORSConfig.AllowedMethods is empty
+	DefaultCORSMethods = []string{ "GET", "HEAD", "POST" }
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: CORSHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+// CORSHandler wraps a RequestHandler answering OPTIONS preflight requests and adding
+// Access-Control-Allow-* headers to actual responses for allowed origins
+type CORSHandler struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// Config is the CORS config from the ServerResource
+	Config CORSConfig
+}
+
+// NewCORSHandler wraps handler with the CORS config from rsc
+func NewCORSHandler(handler RequestHandler, rsc *ServerResource) *CORSHandler {
+	return &CORSHandler{ Handler: handler, Config: rsc.CORS }
+}
+
+func (this *CORSHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get(HeaderOrigin)
+
+	// Not a cross origin request
+	if origin == "" {
+		this.Handler.HandleRequest(w, req)
+		return
+	}
+
+	allowed := this.isOriginAllowed(origin)
+	addVary(w.Header(), HeaderOrigin)
+
+	// Preflight request
+	if req.Method == http.MethodOptions && req.Header.Get(HeaderAccessControlRequestMethod) != "" {
+		Debug("+CORSHandler - Preflight from origin:", origin, "Allowed:", allowed)
+		if !allowed {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		this.setAllowOrigin(w, origin)
+		methods := this.Config.AllowedMethods
+		if len(methods) == 0 {
+			methods = DefaultCORSMethods
+		}
+		w.Header().Set(HeaderAccessControlAllowMethods, strings.Join(methods, ", "))
+
+		// No configured headers so allow whatever the client asked for
+		if len(this.Config.AllowedHeaders) > 0 {
+			w.Header().Set(HeaderAccessControlAllowHeaders, strings.Join(this.Config.AllowedHeaders, ", "))
+		} else if requested := req.Header.Get(HeaderAccessControlRequestHeaders); requested != "" {
+			w.Header().Set(HeaderAccessControlAllowHeaders, requested)
+		}
+
+		if this.Config.MaxAge > 0 {
+			w.Header().Set(HeaderAccessControlMaxAge, strconv.Itoa(this.Config.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Actual request
+	if allowed {
+		this.setAllowOrigin(w, origin)
+	}
+	this.Handler.HandleRequest(w, req)
+}
+
+// isOriginAllowed checks origin against CORSConfig.AllowedOrigins
+func (this *CORSHandler) isOriginAllowed(origin string) bool {
+	for _, allowedOrigin := range this.Config.AllowedOrigins {
+		if allowedOrigin == AnyOrigin || strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// setAllowOrigin sets the Allow-Origin (+ Credentials) headers
+//
+// Credentials are only allowed for origins listed explicitly, echoing any origin back with credentials would let
+// every site make authenticated requests. checkConfig rejects '*' with AllowCredentials
+func (this *CORSHandler) setAllowOrigin(w http.ResponseWriter, origin string) {
+	if this.Config.AllowCredentials && isOriginListed(this.Config.AllowedOrigins, origin) {
+		w.Header().Set(HeaderAccessControlAllowOrigin, origin)
+		w.Header().Set(HeaderAccessControlAllowCredentials, "true")
+	} else if containsString(this.Config.AllowedOrigins, AnyOrigin) {
+		w.Header().Set(HeaderAccessControlAllowOrigin, AnyOrigin)
+	} else {
+		w.Header().Set(HeaderAccessControlAllowOrigin, origin)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Non-exported functions
+// ------------------------------------------------------------------------------------------------------------------------
+
+// isOriginListed checks if origin is one of allowedOrigins, ignoring case ('*' doesn't count)
+func isOriginListed(allowedOrigins []string, origin string) bool {
+	for _, allowedOrigin := range allowedOrigins {
+		if allowedOrigin != AnyOrigin && strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString checks if str is an item in vals
+func containsString(vals []string, str string) bool {
+	for _, val := range vals {
+		if val == str {
+			return true
+		}
+	}
+	return false
+}
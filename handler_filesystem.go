@@ -1,8 +1,12 @@
 package reverseproxy
 
 import (
+	"encoding/json"
+	"io/fs"
 	"os"
 	"net/http"
+	"path"
+	"regexp"
 	"strings"
 	"time"
 	"strconv"
@@ -12,6 +16,7 @@ import (
 const (
 	HeaderAcceptEncoding 	= "Accept-Encoding"
 	HeaderContentEncoding 	= "Content-Encoding"
+	HeaderContentLength 	= "Content-Length"
 	CompressionGzip			= "gzip"
 )
 
@@ -25,6 +30,51 @@ const (
 	HeaderCacheControl 		= "Cache-Control"
 	ValueCacheControl		= "must-revalidate, private"
 	ValueExpires 			= "-1"
+	ValueCacheControlError	= "no-store"
+
+	// ValueCacheControlImmutable & ValueCacheControlShort are used for files which are/aren't fingerprinted
+	ValueCacheControlImmutable	= "public, max-age=31536000, immutable"
+	ValueCacheControlShort		= "public, max-age=300"
+
+	// DefaultCharset is added to text content types if the ServerResource doesn't specify a Charset
+	DefaultCharset			= "utf-8"
+)
+
+var (
+	// wellKnownDefaults is the content served for missing well-known files when WellKnownDefaults is set
+	wellKnownDefaults = map[string][]byte {
+		"/robots.txt": []byte("User-agent: *\nDisallow:\n"),
+
+		// 1x1 transparent 32-bit icon
+		"/favicon.ico": []byte{
+			0, 0, 1, 0, 1, 0,
+			1, 1, 0, 0, 1, 0, 32, 0, 48, 0, 0, 0, 22, 0, 0, 0,
+			40, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 1, 0, 32, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, 0,
+			0, 0, 0, 0 },
+	}
+)
+
+// Response header + value listing the methods a resource supports
+const (
+	HeaderAllow				= "Allow"
+	ValueAllowFS			= "GET, HEAD, OPTIONS"
+)
+
+// Known 'trailingslash' values inside a content block, used to enforce canonical directory URLs
+const (
+	TrailingSlashAdd		= "add"
+	TrailingSlashRemove		= "remove"
+)
+
+// Known 'errorformat' values inside a content block, used to decide how errors are rendered
+const (
+	ErrorFormatHTML			= "html"
+	ErrorFormatJSON			= "json"
+	ErrorFormatText			= "text"
+
+	MimeJSON				= "application/json"
 )
 
 // Response header + values for type of content returned from server
@@ -51,6 +101,9 @@ type FSHandler struct {
 	//
 	// Non-nil if specified in ServerResource(config) and uses the underlying cache algorithm specified
 	FileAccessor FileRetriever
+
+	// Fingerprint matches the names of fingerprinted files (from ServerResource.Fingerprint), nil if not set
+	Fingerprint *regexp.Regexp
 }
 
 // NewFSHandler returns an FSHandler
@@ -60,17 +113,66 @@ func NewFSHandler(rsc *ServerResource, errorMappings []ErrorMapping, cacheBuilde
 	
 	Debug(errorMappings)
 
-	var fa FileRetriever
-	fa = &FileSystemLoader{}
-	
-	// If a cache is specified then we can wrap our FileRetriever with a cache FileRetriever
+	fa := wrapWithCache(&FileSystemLoader{}, rsc, cacheBuilder, os.Stat)
+	if cacheLoader, ok := fa.(*CacheFileLoader); ok && rsc.Cache.Precompress && !usesHostPlaceholder(rsc) {
+		for _, root := range fileSystemRoots(rsc) {
+			cacheLoader.Precompress(rsc, listFiles(os.DirFS(root), "."))
+		}
+	}
+	return &FSHandler{ BaseHandler { rsc, errorMappings }, fa, compileFingerprint(rsc) }
+}
+
+// NewEmbedHandler returns an FSHandler serving files from fsys (e.g. an embed.FS) rather than disk
+//
+// ServerResource.Path is the root directory within fsys ("" for the top). It's initialised with a cache
+// (from RscCacheBuilder) if specified in the ServerResource
+func NewEmbedHandler(rsc *ServerResource, fsys fs.FS, errorMappings []ErrorMapping) (*FSHandler) {
+	loader := &EmbedLoader{ FS: fsys }
+	fa := wrapWithCache(loader, rsc, RscCacheBuilder, loader.Stat)
+	if cacheLoader, ok := fa.(*CacheFileLoader); ok && rsc.Cache.Precompress {
+		cacheLoader.Precompress(rsc, listFiles(fsys, toFSPath(rsc.Path)))
+	}
+	return &FSHandler{ BaseHandler { rsc, errorMappings }, fa, compileFingerprint(rsc) }
+}
+
+// compileFingerprint returns the resources Fingerprint regex, nil if it isn't set
+func compileFingerprint(rsc *ServerResource) *regexp.Regexp {
+	if rsc.Fingerprint == "" {
+		return nil
+	}
+	return regexp.MustCompile(rsc.Fingerprint)
+}
+
+// listFiles returns the request path of every file under root in fsys
+func listFiles(fsys fs.FS, root string) []string {
+	paths := make([]string, 0)
+	fs.WalkDir(fsys, root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if root != "." {
+				filePath = strings.TrimPrefix(filePath, root + "/")
+			}
+			paths = append(paths, "/" + filePath)
+		}
+		return nil
+	})
+	return paths
+}
+
+// wrapWithCache wraps retriever with a cache FileRetriever if a cache is specified in the ServerResource
+//
+// statFile is used by the cache to check whether files have changed
+func wrapWithCache(retriever FileRetriever, rsc *ServerResource, cacheBuilder CacheBuilder, statFile func(name string) (os.FileInfo, error)) FileRetriever {
 	if rsc.Cache.Strategy != "" {
 		if cache, err := cacheBuilder.CreateCache(rsc.Cache.Name, rsc.Cache.Strategy, rsc.Cache.Limit); cache != nil && err == nil {
-			 fa = &CacheFileLoader{ WrappedRetriever: fa, UnderlyingCache: cache }
+			cacheLoader := NewCacheFileLoader(retriever, cache, time.Duration(rsc.Cache.RevalidateInterval) * time.Millisecond)
+			cacheLoader.StatFile = statFile
+			for _, pattern := range rsc.NoCachePatterns {
+				cacheLoader.NoCache = append(cacheLoader.NoCache, regexp.MustCompile(pattern))
+			}
+			return cacheLoader
 		}
 	}
-
-	return &FSHandler{ BaseHandler { rsc, errorMappings }, fa }
+	return retriever
 }
 
 // ------------------------------------------------------------------------------------------------------------------------
@@ -85,16 +187,116 @@ func (this *FSHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
 
 	Debug("+HandlerFS - Path: " + req.URL.Path)
 
+	// Let clients discover what they can do with static files
+	if req.Method == http.MethodOptions {
+		w.Header()[HeaderAllow] = []string{ ValueAllowFS }
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Static files can only be fetched
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		Debug("+HandlerFS - Method not allowed: " + req.Method)
+		w.Header()[HeaderAllow] = []string{ ValueAllowFS }
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
 	// Combine fs path + request path to create absolute path
 	// Check if we should be using compression or not + set header
 	useCompression := this.shouldUseCompression(req)
-	if fc, err := this.FileAccessor.GetFile(req, this.Resource, useCompression); err == nil {
-		this.writeFile(w, req, fc)
+
+	// Enforce canonical trailing slashes if configured
+	if this.redirectTrailingSlash(w, req, useCompression) {
+		return
+	}
+
+	// HEAD only needs the headers so don't read the file if we can avoid it
+	if req.Method == http.MethodHead && this.writeHead(w, req, useCompression) {
+		return
+	}
+
+	fc, err := this.FileAccessor.GetFile(req, this.Resource, useCompression)
+
+	// Canonical directory URLs have no trailing slash so we need to look for a default file ourselves
+	if err != nil && this.Resource.TrailingSlash == TrailingSlashRemove && !strings.HasSuffix(req.URL.Path, "/") && path.Ext(req.URL.Path) == "" {
+		fc, err = this.getFileAt(req, req.URL.Path + "/", useCompression)
+	}
+
+	if err == nil {
+		this.writeFile(w, req, fc, http.StatusOK)
+
+	// Crawlers & browsers ask for these whether or not the site has them
+	} else if this.Resource.WellKnownDefaults && this.writeWellKnownDefault(w, req) {
+		Debug("+HandlerFS - Served default for: " + req.URL.Path)
+
+		// Single page apps need deep links (not assets) to serve the app so client-side routing can take over
+	} else if this.Resource.SPAFallback != "" && path.Ext(req.URL.Path) == "" {
+		Debug("+HandlerFS - Serving SPA fallback for: " + req.URL.Path)
+		originalPath := req.URL.Path
+		req.URL.Path = this.Resource.SPAFallback
+		defer func() { req.URL.Path = originalPath }()
+		if fc, err := this.FileAccessor.GetFile(req, this.Resource, useCompression); err == nil {
+			this.writeFile(w, req, fc, http.StatusOK)
+		} else {
+			this.handleError(w, req, int(http.StatusNotFound), useCompression)
+		}
+
 	} else {
 		this.handleError(w, req, int(http.StatusNotFound), useCompression)
 	}
 }
 
+// redirectTrailingSlash sends a 301 if the request path doesn't match the resources TrailingSlash setting
+//
+// With 'add' directories (paths that resolve with a default file) are redirected to the path with a trailing
+// slash. With 'remove' any path with a trailing slash is redirected to the path without one. Returns true if
+// a redirect was sent
+func (this *FSHandler) redirectTrailingSlash(w http.ResponseWriter, req *http.Request, useCompression bool) bool {
+	requestPath := req.URL.Path
+	target := ""
+
+	switch this.Resource.TrailingSlash {
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(requestPath, "/") && path.Ext(requestPath) == "" {
+			if _, err := this.getFileAt(req, requestPath + "/", useCompression); err == nil {
+				target = localRedirectPath(requestPath) + "/"
+			}
+		}
+	case TrailingSlashRemove:
+		if requestPath != "/" && strings.HasSuffix(requestPath, "/") {
+			target = localRedirectPath(requestPath)
+		}
+	}
+
+	if target == "" {
+		return false
+	}
+
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	Debug("+HandlerFS - Trailing slash redirect to: " + target)
+	http.Redirect(w, req, target, http.StatusMovedPermanently)
+	return true
+}
+
+// localRedirectPath cleans requestPath into a Location on this host, without a trailing slash
+//
+// Leading slashes (or backslashes) are collapsed to one, otherwise //evil.com/ would redirect to another host
+func localRedirectPath(requestPath string) string {
+	return "/" + strings.TrimLeft(path.Clean("/" + requestPath), "/\\")
+}
+
+// getFileAt gets the file for filePath rather than the request path (the request is left untouched)
+func (this *FSHandler) getFileAt(req *http.Request, filePath string, useCompression bool) (*FileContent, error) {
+	originalPath := req.URL.Path
+	req.URL.Path = filePath
+	defer func() { req.URL.Path = originalPath }()
+
+	return this.FileAccessor.GetFile(req, this.Resource, useCompression)
+}
+
 // handleError will attempt to serve an error page instead of a status code
 //
 // If it has a handler for 
@@ -102,15 +304,19 @@ func (this *FSHandler) handleError(w http.ResponseWriter, req *http.Request, err
 	Debug("+HandleError")
 	req.Header.Del(HeaderIfModifiedSince)
 
-	if errorFile := this.findErrorFile(error); errorFile != "" {
+	if this.Resource.ErrorFormat == ErrorFormatJSON || this.Resource.ErrorFormat == ErrorFormatText {
+		this.writeErrorBody(w, req, error)
+	} else if errorFile := this.findErrorFile(error); errorFile != "" {
 
 		req.URL.Path = errorFile
-		if fc, err := this.FileAccessor.GetFile(req, this.Resource, useCompression); err == nil {
-			this.writeFile(w, req, fc)
+		if fc, err := this.getErrorFile(req, useCompression); err == nil {
+			this.writeFile(w, req, fc, error)
 		} else {
+			w.Header()[HeaderCacheControl] = []string{ ValueCacheControlError }
 			w.WriteHeader(error)
 		}
 	} else {
+		w.Header()[HeaderCacheControl] = []string{ ValueCacheControlError }
 		w.WriteHeader(error)
 	}
 	Debug("-HandleError")
@@ -120,44 +326,189 @@ func (this *FSHandler) handleError(w http.ResponseWriter, req *http.Request, err
 // Non-Exported functions
 // ------------------------------------------------------------------------------------------------------------------------
 
+// errorBody is the JSON rendering of an error
+type errorBody struct {
+	Error string `json:"error"`
+	Status int `json:"status"`
+}
+
+// writeErrorBody renders the error in the resources ErrorFormat (json or text) rather than as an error page
+func (this *FSHandler) writeErrorBody(w http.ResponseWriter, req *http.Request, error int) {
+	message := strings.ToLower(http.StatusText(error))
+
+	var body []byte
+	if this.Resource.ErrorFormat == ErrorFormatJSON {
+		body, _ = json.Marshal(errorBody{ Error: message, Status: error })
+		w.Header()[HeaderContentType] = []string{ MimeJSON }
+	} else {
+		body = []byte(strconv.Itoa(error) + " " + message + "\n")
+		w.Header()[HeaderContentType] = []string{ withCharset(PlainTextMimeType, this.Resource) }
+	}
+
+	w.Header().Del(HeaderContentEncoding)
+	w.Header()[HeaderCacheControl] = []string{ ValueCacheControlError }
+	w.Header()[HeaderContentLength] = []string{ strconv.Itoa(len(body)) }
+	w.WriteHeader(error)
+	if req.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// writeWellKnownDefault writes the built-in content for the request path, returning false if there isn't any
+func (this *FSHandler) writeWellKnownDefault(w http.ResponseWriter, req *http.Request) bool {
+	data, present := wellKnownDefaults[req.URL.Path]
+	if !present {
+		return false
+	}
+
+	w.Header()[HeaderContentType] = []string{ withCharset(mimeTypeForName(req.URL.Path, this.Resource), this.Resource) }
+	w.Header()[HeaderCacheControl] = []string{ ValueCacheControl }
+	w.Header()[HeaderContentLength] = []string{ strconv.Itoa(len(data)) }
+	if req.Method != http.MethodHead {
+		w.Write(data)
+	}
+	return true
+}
+
 // writeFile writes file contents to http.ResponseWriter
 //
 // It works by attempting to combine ServerResource.Path (from config) with the request path
 // + defaulting extensions or files if they're missing (also from config). If everythings OK
-// it should return 'OK' (200) or 'Not Modified' (304), otherwise its an error code
-func (this *FSHandler) writeFile(w http.ResponseWriter, req *http.Request, content *FileContent) {
-	
-	fileInfo := content.FileInfo
+// it should return 'OK' (200) or 'Not Modified' (304), otherwise its an error code. status is
+// the code sent with the body, error pages pass the original error so it isn't masked
+func (this *FSHandler) writeFile(w http.ResponseWriter, req *http.Request, content *FileContent, status int) {
 
-	// Set content-type based on extension
-	setContentTypeHeader(w, fileInfo)
-	
-	// If client already has file then return not modified, no need to write body
-	if !isModifiedSince(req, content.AbsolutePath, content.FileInfo) {
-		Debug("+writeFile - File not modified")
-		w.WriteHeader(http.StatusNotModified)
+	// Client already has the file
+	if !this.writeHeaders(w, req, content, status) {
+		return
+	}
+
+	// Content is buffered so we know the exact (possibly compressed) length, HEAD needs it too
+	w.Header()[HeaderContentLength] = []string{ strconv.Itoa(len(content.Data)) }
+
+	// Only need to write the header for non-200 (it's sent implicitly on the first Write)
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+
+	// HEAD gets the same headers as GET but no body
+	if req.Method == http.MethodHead {
 		return
+	}
+
+	// Write response body
+	Debug("Found file: " + content.AbsolutePath)
+	Debug("File size: " + strconv.Itoa(len(content.Data)))
+	if _, writeErr := w.Write(content.Data); writeErr != nil {
+		this.handleError(w, req, int(http.StatusInternalServerError), content.Compression)
+		return
+	}
+}
+
+// writeHeaders sets the Content-Type, caching & encoding headers for content
+//
+// It returns false if the client already has the file, in which case a 304 has been sent
+func (this *FSHandler) writeHeaders(w http.ResponseWriter, req *http.Request, content *FileContent, status int) bool {
+	fileInfo := content.FileInfo
+
+	// Compressible content depends on the clients Accept-Encoding, caches need to know that (even for a 304)
+	if this.Resource.Compression && !content.IgnoreCompression {
+		addVary(w.Header(), HeaderAcceptEncoding)
+	}
+	for _, header := range this.Resource.Cache.VaryHeaders {
+		addVary(w.Header(), http.CanonicalHeaderKey(header))
+	}
+
+	// ...and so does the file when the extension is negotiated, even a client without Accept gets the default order
+	if negotiatesExtensions(req, this.Resource) {
+		addVary(w.Header(), HeaderAccept)
+	}
+
+	// Error pages are never cached, the page can change and so can whatever caused the error
+	if status != http.StatusOK {
+		w.Header()[HeaderCacheControl] = []string{ ValueCacheControlError }
 
 	// Set cache headers so clients with subsequently send If-Modified-Since header
 	} else {
-		w.Header()[HeaderExpires] = []string{ ValueExpires }
-		w.Header()[HeaderCacheControl] = []string{ ValueCacheControl }
+		cacheControl := this.cacheControl(fileInfo)
+		w.Header()[HeaderExpires] = []string{ expiresFor(cacheControl, time.Now()) }
+		w.Header()[HeaderCacheControl] = []string{ cacheControl }
 		w.Header()[HeaderLastModified] = []string{ fileInfo.ModTime().In(GMTLoc).Format(time.RFC1123) }
+
+		// If client already has file then return not modified with just the validators, there's no body to describe
+		if !isModifiedSince(req, content.AbsolutePath, content.FileInfo) {
+			Debug("+writeFile - File not modified")
+			w.Header().Del(HeaderContentType)
+			w.Header().Del(HeaderContentEncoding)
+			w.Header().Del(HeaderContentLength)
+			w.WriteHeader(http.StatusNotModified)
+			return false
+		}
+	}
+
+	// Use the content type the loader worked out, falling back to the extension
+	mimeType := content.MimeType
+	if mimeType == "" {
+		mimeType = getContentTypeHeader(fileInfo, this.Resource)
 	}
+	w.Header()[HeaderContentType] = []string{ withCharset(mimeType, this.Resource) }
 
 	// Check if we should be using compression or not + set header
 	if content.Compression {
 		Debug("+writeFile - Using compression")
 		w.Header()[HeaderContentEncoding] = []string{CompressionGzip}
 	}
+	return true
+}
 
-	// Write response body
-	Debug("Found file: " + content.AbsolutePath)
-	Debug("File size: " + strconv.Itoa(len(content.Data)))
-	if _, writeErr := w.Write(content.Data); writeErr != nil {
-		this.handleError(w, req, int(http.StatusInternalServerError), content.Compression)
-		return
+// writeHead answers a HEAD request from the files FileInfo, without reading (or compressing) it
+//
+// Content-Length is only sent if the file wouldn't be compressed, we can't know the compressed length. Returns
+// false if the FileAccessor can't locate files, the file isn't found or its type has to be sniffed (the normal path
+// handles those)
+func (this *FSHandler) writeHead(w http.ResponseWriter, req *http.Request, useCompression bool) bool {
+	locator, ok := this.FileAccessor.(FileLocator)
+	if !ok {
+		return false
+	}
+
+	resource, ok := hostResource(req, negotiateExtensions(req, this.Resource))
+	if !ok {
+		return false
 	}
+
+	fi, absolutePath := locator.LocateFile(req.URL.Path, resource)
+	if fi == nil || fi.IsDir() {
+		return false
+	}
+
+	// Unknown extensions are sniffed from the content, leave that to the normal path
+	mimeType, known := lookupMimeType(fi.Name(), this.Resource)
+	if !known {
+		return false
+	}
+	ignoreCompression := !isCompressible(mimeType, this.Resource)
+	content := &FileContent{ FileInfo: fi, AbsolutePath: absolutePath, Compression: useCompression && !ignoreCompression,
+		IgnoreCompression: ignoreCompression, MimeType: mimeType }
+
+	if this.writeHeaders(w, req, content, http.StatusOK) && !content.Compression {
+		w.Header()[HeaderContentLength] = []string{ strconv.FormatInt(fi.Size(), 10) }
+	}
+	return true
+}
+
+// getErrorFile gets the error page at the request path, from the resources ErrorRoot if it has one
+//
+// ErrorRoot pages skip the cache, they'd share keys with the content files at the same paths
+func (this *FSHandler) getErrorFile(req *http.Request, useCompression bool) (*FileContent, error) {
+	if this.Resource.ErrorRoot == "" {
+		return this.FileAccessor.GetFile(req, this.Resource, useCompression)
+	}
+
+	errorResource := *this.Resource
+	errorResource.Path = this.Resource.ErrorRoot
+	errorResource.Roots = nil
+	return (&FileSystemLoader{}).GetFile(req, &errorResource, useCompression)
 }
 
 // findErrorFile attempts to return the path of an error file matching the error code
@@ -177,6 +528,46 @@ func (this *FSHandler) findErrorFile(error int) (string) {
 	return ""
 }
 
+// addVary adds name to the Vary header unless it's already listed
+func addVary(header http.Header, name string) {
+	for _, value := range header[HeaderVary] {
+		for _, listed := range strings.Split(value, ",") {
+			if listed = strings.TrimSpace(listed); listed == "*" || strings.EqualFold(listed, name) {
+				return
+			}
+		}
+	}
+	header.Add(HeaderVary, name)
+}
+
+// cacheControl returns the Cache-Control for a file
+//
+// Fingerprinted files never change so can be cached forever, if the resource fingerprints its files everything else
+// is only cached briefly (unless the resource sets CacheControl)
+func (this *FSHandler) cacheControl(fileInfo os.FileInfo) string {
+	if this.Fingerprint != nil && this.Fingerprint.MatchString(fileInfo.Name()) {
+		return ValueCacheControlImmutable
+	} else if this.Resource.CacheControl != "" {
+		return this.Resource.CacheControl
+	} else if this.Fingerprint != nil {
+		return ValueCacheControlShort
+	}
+	return ValueCacheControl
+}
+
+// expiresFor returns the Expires header matching cacheControl, max-age seconds from now or already expired (-1) if
+// there isn't one
+func expiresFor(cacheControl string, now time.Time) string {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		if kv := strings.SplitN(strings.TrimSpace(directive), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "max-age") {
+			if seconds, err := strconv.Atoi(kv[1]); err == nil {
+				return now.Add(time.Duration(seconds) * time.Second).In(GMTLoc).Format(time.RFC1123)
+			}
+		}
+	}
+	return ValueExpires
+}
+
 // shouldUseCompression detects whether we should consider compressing the response or not
 //
 // It detects whether the client has specified they can handle gzip and whether compression has been specified
@@ -195,22 +586,8 @@ func (this *FSHandler) shouldUseCompression(req *http.Request) bool {
 func isModifiedSince(req *http.Request, url string, fi os.FileInfo) bool {
 	modifiedSince, msPresent := req.Header[HeaderIfModifiedSince]
 	if msPresent && len(modifiedSince) > 0 {
-		ms := modifiedSince[0]
-
-		var parsedTime time.Time
-		var err error
-		// http://www.w3.org/Protocols/rfc2616/rfc2616-sec3.html (3.3 Date/Time Formats)
-		switch ms[3] {
-			// RFC 822, updated by RFC 1123 - Sun, 06 Nov 1994 08:49:37 GMT
-			case ',':
-				parsedTime, err = time.Parse(time.RFC1123, ms)
-			// ANSI C's asctime() format - Sunday, 06-Nov-94 08:49:37 GMT
-			case ' ':
-				parsedTime, err = time.Parse(time.ANSIC, ms)
-			// RFC 850, obsoleted by RFC 1036 - Sun Nov  6 08:49:37 1994
-			default:
-				parsedTime, err = time.Parse(time.RFC850, ms)
-		}
+		// Handles all three HTTP date formats (RFC 1123, RFC 850 & asctime), anything else is an error
+		parsedTime, err := http.ParseTime(modifiedSince[0])
 
 		// Can only continue with this if we have a valid date
 		if err == nil {
@@ -234,13 +611,15 @@ func containsInArray(vals []string, str string) bool {
 	return false
 }
 
-// setContentTypeHeader sets the 'content-type' header of the http response based on the file extension
-func setContentTypeHeader(w http.ResponseWriter, fileInfo os.FileInfo) {
-	for key, val := range mimeMap {
-		if strings.HasSuffix(fileInfo.Name(), key) {
-			w.Header()[HeaderContentType] = []string{val}
-			return
-		}
+// withCharset adds the resources Charset (utf-8 if not set) to text based types which don't already have one
+func withCharset(mimeType string, rsc *ServerResource) string {
+	if !strings.HasPrefix(mimeType, MimeTextBased) || strings.Contains(mimeType, "charset=") {
+		return mimeType
+	}
+
+	charset := rsc.Charset
+	if charset == "" {
+		charset = DefaultCharset
 	}
-	w.Header()[HeaderContentType] = []string{PlainTextMimeType}
+	return mimeType + "; charset=" + charset
 }
\ No newline at end of file
@@ -0,0 +1,82 @@
+package reverseproxy
+
+import (
+	"net/http"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: HeaderRewriter
+// ------------------------------------------------------------------------------------------------------------------------
+
+// HeaderRewriter wraps a RequestHandler adding/removing request headers before it's called and response headers
+// just before the response is written
+type HeaderRewriter struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// Resource holds the Add*/Remove* header rules
+	Resource *ServerResource
+}
+
+// NewHeaderRewriter wraps handler with the header rules from rsc
+func NewHeaderRewriter(handler RequestHandler, rsc *ServerResource) *HeaderRewriter {
+	return &HeaderRewriter{ Handler: handler, Resource: rsc }
+}
+
+func (this *HeaderRewriter) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	applyHeaderRules(req.Header, this.Resource.AddRequestHeaders, this.Resource.RemoveRequestHeaders)
+
+	hw := &headerResponseWriter{ ResponseWriter: w, Resource: this.Resource }
+	this.Handler.HandleRequest(hw, req)
+
+	// Handler didn't write anything, the server will send a 200 once we return so headers still need applying
+	hw.applyRules()
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: headerResponseWriter
+// ------------------------------------------------------------------------------------------------------------------------
+
+// headerResponseWriter applies the response header rules the first time the status or body is written
+type headerResponseWriter struct {
+	http.ResponseWriter
+	Resource *ServerResource
+	applied bool
+}
+
+func (this *headerResponseWriter) WriteHeader(status int) {
+	this.applyRules()
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *headerResponseWriter) Write(data []byte) (int, error) {
+	this.applyRules()
+	return this.ResponseWriter.Write(data)
+}
+
+func (this *headerResponseWriter) applyRules() {
+	if !this.applied {
+		applyHeaderRules(this.Header(), this.Resource.AddHeaders, this.Resource.RemoveHeaders)
+		this.applied = true
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Non-exported functions
+// ------------------------------------------------------------------------------------------------------------------------
+
+// applyHeaderRules removes then sets headers so a header can be replaced by listing it in both
+func applyHeaderRules(header http.Header, add map[string]string, remove []string) {
+	for _, name := range remove {
+		header.Del(name)
+	}
+	for name, value := range add {
+		header.Set(name, value)
+	}
+}
+
+// hasHeaderRules checks whether any header rules are configured for the resource
+func hasHeaderRules(rsc *ServerResource) bool {
+	return len(rsc.AddHeaders) > 0 || len(rsc.RemoveHeaders) > 0 || len(rsc.AddRequestHeaders) > 0 || len(rsc.RemoveRequestHeaders) > 0
+}
@@ -0,0 +1,91 @@
+package reverseproxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// HealthCheckTimeout is how long we wait to connect to an upstream before marking it as down
+	HealthCheckTimeout = 2 * time.Second
+
+	HealthStatusOK			= "ok"
+	HealthStatusUnavailable	= "unavailable"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: HealthHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+// HealthHandler serves a liveness/readiness endpoint for load balancers
+//
+// If the ServerResource has no HealthChecks it always returns 200 (liveness). Otherwise each upstream
+// is checked and it returns 503 if any are unreachable (readiness)
+type HealthHandler struct {
+
+	// BaseHandler contains ServerResource & ErrorMappings map
+	BaseHandler
+}
+
+// HealthResponse is the JSON body returned by HealthHandler
+type HealthResponse struct {
+	Status string `json:"status"`
+
+	// Unreachable lists the HealthChecks entries we couldn't connect to
+	Unreachable []string `json:"unreachable,omitempty"`
+}
+
+// NewHealthHandler returns a *HealthHandler
+func NewHealthHandler(rsc *ServerResource, errorMappings []ErrorMapping) (*HealthHandler) {
+	return &HealthHandler{ BaseHandler { rsc, errorMappings } }
+}
+
+func (this *HealthHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	health := HealthResponse{ Status: HealthStatusOK }
+	status := http.StatusOK
+
+	for _, upstream := range this.Resource.HealthChecks {
+		if !isReachable(upstream) {
+			Warning("+HealthHandler - Upstream unreachable:", upstream)
+			health.Unreachable = append(health.Unreachable, upstream)
+			health.Status = HealthStatusUnavailable
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	body, _ := json.Marshal(health)
+	w.Header()[HeaderContentType] = []string{ "application/json" }
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Non-exported functions
+// ------------------------------------------------------------------------------------------------------------------------
+
+// isReachable checks whether we can open a connection to upstream
+//
+// upstream can be a url (http://localhost:4000) or a host:port pair
+func isReachable(upstream string) bool {
+	address := upstream
+	if u, err := url.Parse(upstream); err == nil && u.Host != "" {
+		address = u.Host
+		if u.Port() == "" {
+			if u.Scheme == "https" {
+				address = net.JoinHostPort(u.Hostname(), "443")
+			} else {
+				address = net.JoinHostPort(u.Hostname(), "80")
+			}
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", address, HealthCheckTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
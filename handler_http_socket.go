@@ -1,8 +1,21 @@
 package reverseproxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net/http"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 	"github.com/seanjohnno/objpool"
 )
 
@@ -12,7 +25,34 @@ var (
 
 const (
 	BufferExpiryTime = 3000 // 3 seconds
-	BufferMax = 1024
+
+	// BufferMax is the default size of the buffers used to stream response bodies
+	BufferMax = 32 * 1024
+
+	// MaxRetryBodySize is the largest request body buffered so it can be resent, bigger ones are sent once
+	MaxRetryBodySize = 1024 * 1024
+
+	// MaxRewriteSize is the largest (decompressed) response body RewriteRules are applied to, bigger ones get a 502
+	MaxRewriteSize = 10 * 1024 * 1024
+)
+
+const (
+	// UpstreamHostBackend is the UpstreamHost value used to send the backends own host
+	UpstreamHostBackend = "upstream"
+
+	HeaderForwardedHost = "X-Forwarded-Host"
+	HeaderLocation = "Location"
+	HeaderConnection = "Connection"
+	HeaderExpect = "Expect"
+	HeaderETag = "ETag"
+
+	ValueContinue = "100-continue"
+)
+
+var (
+	// hopByHopHeaders only apply to a single connection so they're never forwarded
+	hopByHopHeaders = []string{ "Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer",
+		"Transfer-Encoding", "Upgrade" }
 )
 
 type HttpHandler struct {
@@ -21,13 +61,148 @@ type HttpHandler struct {
 	FSHandler
 
 	BufferPool objpool.ObjectPool
+
+	// BufferSize is the size of the buffers response bodies are streamed through
+	BufferSize int
+
+	// RewriteRules are applied to text response bodies before they're written to the client
+	RewriteRules []RewriteRule
+
+	// Client performs the upstream requests, it's shared unless the ServerResource has Transport timeouts
+	Client *http.Client
+
+	// Breakers stop requests reaching a failing upstream (keyed by backend URL), empty if the ServerResource has no
+	// CircuitBreaker config
+	Breakers map[string]*CircuitBreaker
+
+	// Upstreams picks the backend for each request, nil if the ServerResource has no Upstreams (Path is used)
+	Upstreams UpstreamSelector
+}
+
+// RewriteRule is the compiled form of a ResponseRewrite
+type RewriteRule struct {
+
+	// Pattern matches the content to replace
+	Pattern *regexp.Regexp
+
+	// To is the replacement, it can reference capture groups ($1) if Literal isn't set
+	To []byte
+
+	// Literal indicates To should be inserted as is
+	Literal bool
 }
 
 // NewHttpHandler returns an *NewHttpHandler
 func NewHttpHandler(rsc *ServerResource, errorMappings []ErrorMapping) (*HttpHandler) {
 	
 	// FileAccessor handles null cache
-	return &HttpHandler{ FSHandler: *NewFSHandler( rsc, errorMappings, nil ), BufferPool: objpool.NewTimedExiryPool(BufferExpiryTime) }
+	handler := &HttpHandler{ FSHandler: *NewFSHandler( rsc, errorMappings, nil ), BufferPool: NewBoundedPool(objpool.NewTimedExiryPool(BufferExpiryTime), bufferPoolMax(rsc)),
+		BufferSize: bufferSize(rsc),
+		RewriteRules: CreateRewriteRules(*rsc), Client: CreateClient(rsc.Transport), Upstreams: CreateUpstreamSelector(rsc) }
+
+	// Redirects are only passed on to the client when we're rewriting them, otherwise they're followed as before
+	if rsc.RewriteLocation {
+		handler.Client = withPassRedirects(handler.Client)
+	}
+
+	// Each backend gets its own breaker so one failing doesn't stop requests to the others
+	handler.Breakers = make(map[string]*CircuitBreaker)
+	if rsc.CircuitBreaker.FailureRatio > 0 {
+		handler.Breakers[rsc.Path] = NewCircuitBreaker(rsc.CircuitBreaker)
+		for _, upstream := range rsc.Upstreams {
+			handler.Breakers[upstream.URL] = NewCircuitBreaker(rsc.CircuitBreaker)
+		}
+	}
+
+	// Sticky sessions avoid backends whose breaker is open
+	if sticky, ok := handler.Upstreams.(*StickySelector); ok {
+		sticky.Healthy = handler.isHealthy
+	}
+	return handler
+}
+
+// CreateClient returns a http.Client using the timeouts & TLS settings in config, or the shared client if none are set
+//
+// It panics if the CA or client certificate files can't be loaded
+func CreateClient(config TransportConfig) *http.Client {
+	hasTLS := config.CAFile != "" || config.CertFile != "" || config.InsecureSkipVerify
+	if config.DialTimeout <= 0 && config.ResponseHeaderTimeout <= 0 && config.Timeout <= 0 && !hasTLS {
+		return client
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.DialTimeout > 0 {
+		dialer := &net.Dialer{ Timeout: time.Duration(config.DialTimeout) * time.Millisecond, KeepAlive: 30 * time.Second }
+		transport.DialContext = dialer.DialContext
+	}
+	transport.ResponseHeaderTimeout = time.Duration(config.ResponseHeaderTimeout) * time.Millisecond
+	if hasTLS {
+		transport.TLSClientConfig = createBackendTLSConfig(config)
+	}
+
+	return &http.Client{ Transport: transport, Timeout: time.Duration(config.Timeout) * time.Millisecond }
+}
+
+// withPassRedirects returns a copy of c which passes redirects on rather than following them
+func withPassRedirects(c *http.Client) *http.Client {
+	passing := *c
+	passing.CheckRedirect = passRedirect
+	return &passing
+}
+
+// passRedirect stops the client following redirects, they're sent on to whoever made the request
+func passRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// createBackendTLSConfig builds the tls.Config used to connect to https backends
+func createBackendTLSConfig(config TransportConfig) *tls.Config {
+	tlsConfig := &tls.Config{ InsecureSkipVerify: config.InsecureSkipVerify }
+
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			panic(err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			panic("No certificates found in CAFile: " + config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			panic(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{ cert }
+	}
+	return tlsConfig
+}
+
+// CreateRewriteRules compiles the ResponseRewrite entries of a ServerResource
+func CreateRewriteRules(resource ServerResource) []RewriteRule {
+	if resource.ResponseRewrite != nil {
+		rules := make([]RewriteRule, 0)
+
+		for _, rewrite := range resource.ResponseRewrite {
+			pattern := rewrite.From
+			if !rewrite.Regex {
+				pattern = regexp.QuoteMeta(pattern)
+			}
+
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				panic(err)
+			}
+			rules = append(rules, RewriteRule { Pattern: re, To: []byte(rewrite.To), Literal: !rewrite.Regex })
+		}
+
+		return rules
+	}
+	return nil
 }
 
 func (this *HttpHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
@@ -40,51 +215,428 @@ func (this *HttpHandler) HandleRequest(w http.ResponseWriter, req *http.Request)
 
 func (this * HttpHandler) HandleSocket(w http.ResponseWriter, req *http.Request) int {
 
-	Debug("+handleSocket - Method:", req.Method, "URL:", this.Resource.Path)
+	backend := this.Resource.Path
+	if this.Upstreams != nil {
+		backend = this.Upstreams.Select(req)
+	}
+	Debug("+handleSocket - Method:", req.Method, "URL:", backend)
 
-	// Create the request
-	if newReq, err := http.NewRequest(req.Method, this.Resource.Path, nil); err == nil {
-		
-		newReq.Header = req.Header
-		newReq.URL.Path = req.URL.Path
-		newReq.URL.Fragment = req.URL.Fragment
+	// Upstream is failing so don't bother it
+	breaker := this.Breakers[backend]
+	if breaker != nil && !breaker.Allow() {
+		Debug("+handleSocket - Circuit breaker open:", backend)
+		setRetryAfter(w, breaker.RetryAfter())
+		return http.StatusServiceUnavailable
+	}
 
-		// Set the body to read from the incoming request - TODO: May need to kick off another goroutine to do this manually for slow connections, have some sort of pause if it can't read anything?
-		newReq.Body = req.Body
+	// Perform the request
+	resp, err := this.performRequestWithRetries(req, backend)
+	if breaker != nil {
+		breaker.Record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+	}
 
-		// Perform the request
-		if resp, err := client.Do(newReq); err == nil {
-			defer resp.Body.Close()
+	// Expired/untrusted backend certificates are a bad gateway rather than an internal error
+	if err != nil && isTLSError(err) {
+		Error("+handleSocket - TLS handshake with backend", backend, "failed, check its certificate:", err)
+		if this.Resource.TLSFallbackPath == "" {
+			return http.StatusBadGateway
+		}
 
-			if !(resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNotModified) {
-				return resp.StatusCode
-			} else {
-				w.WriteHeader(resp.StatusCode)
-
-				// Copy response header into our response writer
-				for k, v := range resp.Header {
-					w.Header()[k] = v
-				}
-
-				// Write response body into ResponseWriter
-				if resp.Body == nil || this.writeBody(w, resp) == io.EOF {
-					return http.StatusOK
-				} else {
-					return http.StatusInternalServerError
-				}
-			}
+		// The transport has already used (and closed) any body, there's nothing left to send the fallback
+		if req.Body != nil && req.Body != http.NoBody {
+			Warning("+handleSocket - Can't fall back with a request body:", req.Method, req.URL.Path)
+			return http.StatusBadGateway
+		}
+
+		Warning("+handleSocket - Falling back to backend:", this.Resource.TLSFallbackPath)
+		if resp, err = this.performRequest(req, this.Resource.TLSFallbackPath); err != nil && isTLSError(err) {
+			Error("+handleSocket - TLS handshake with fallback backend", this.Resource.TLSFallbackPath, "failed:", err)
+			return http.StatusBadGateway
+		}
+		backend = this.Resource.TLSFallbackPath
+	}
+
+	if err != nil {
+		Debug("+handleSocket - Error performing request:", err)
+		return http.StatusInternalServerError
+	}
+	defer resp.Body.Close()
 
+	// Anything other than a 2xx (e.g. 204 for OPTIONS) or 3xx (redirects & 304) goes through the error handling
+	if !(isSuccessStatus(resp.StatusCode) || isRedirectStatus(resp.StatusCode)) {
+		return resp.StatusCode
+
+	// The client's copy is still good, pass on the validators without trying to decompress/rewrite the (empty) body
+	} else if resp.StatusCode == http.StatusNotModified {
+		this.writeNotModified(w, resp)
+		return http.StatusNotModified
+
+	// Some backends return an empty 200 on internal errors so we can optionally treat it as a failure
+	} else if this.Resource.TreatEmptyResponseAsError && req.Method != http.MethodHead && resp.StatusCode == http.StatusOK && this.isEmptyBody(resp) {
+		Debug("+handleSocket - Empty response from backend treated as error")
+		return http.StatusBadGateway
+
+	} else {
+
+		// Backend sent gzip but the client can't read it so decompress on the way through
+		if err := this.decompressIfUnsupported(req, resp); err != nil {
+			Debug("+handleSocket - Error decompressing response:", err)
+			return http.StatusBadGateway
+		}
+
+		// Rewrite text bodies if configured (everything else is streamed)
+		if err := this.rewriteBody(req, resp); err != nil {
+			Debug("+handleSocket - Error rewriting response:", err)
+			return http.StatusBadGateway
+		}
+
+		// Backend sent plain text but the client can take gzip
+		if this.Resource.CompressUpstream {
+			this.compressIfSupported(req, resp)
+		}
+
+		// Redirects to the backend need to point at us
+		if this.Resource.RewriteLocation {
+			this.rewriteLocation(req, resp, backend)
+		}
+
+		// Copy response header into our response writer (before WriteHeader or they won't be sent)
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+
+		// Write response body into ResponseWriter (HEAD gets the headers only)
+		if resp.Body == nil || req.Method == http.MethodHead || this.writeBody(w, resp) == io.EOF {
+			return http.StatusOK
 		} else {
-			Debug("+handleSocket - Error performing request:", err)
 			return http.StatusInternalServerError
 		}
-	
-	} else {
-		Debug("+handleSocket - Error creating request")
-		return http.StatusInternalServerError
 	}
 }
 
+// writeNotModified copies a 304 from the backend to the client
+//
+// ETag, Last-Modified, Cache-Control etc go through as is, the headers describing a body are dropped as there isn't one
+func (this * HttpHandler) writeNotModified(w http.ResponseWriter, resp *http.Response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Del(HeaderContentType)
+	w.Header().Del(HeaderContentEncoding)
+	w.Header().Del(HeaderContentLength)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// rewriteLocation swaps the backends scheme & host in an absolute Location for the ones the client used
+//
+// Locations pointing anywhere else, and relative ones (which already resolve against us), are left alone
+func (this * HttpHandler) rewriteLocation(req *http.Request, resp *http.Response, backend string) {
+	location, err := url.Parse(resp.Header.Get(HeaderLocation))
+	if err != nil || location.Host == "" {
+		return
+	}
+
+	// The backend may build redirects from the Host we sent it rather than its own
+	backendURL, err := url.Parse(backend)
+	if err != nil {
+		return
+	}
+	internal := strings.EqualFold(location.Host, backendURL.Host)
+	if this.Resource.UpstreamHost != "" && this.Resource.UpstreamHost != UpstreamHostBackend {
+		internal = internal || strings.EqualFold(location.Host, this.Resource.UpstreamHost)
+	}
+	if !internal {
+		return
+	}
+
+	// Scheme relative Locations (//host/path) stay that way
+	if location.Scheme != "" {
+		location.Scheme = "http"
+		if req.TLS != nil {
+			location.Scheme = "https"
+		}
+	}
+	location.Host = req.Host
+	Debug("+rewriteLocation - Rewrote", resp.Header.Get(HeaderLocation), "to", location.String())
+	resp.Header.Set(HeaderLocation, location.String())
+}
+
+// isHealthy checks whether requests can be sent to backend (its circuit breaker is closed or ready to probe)
+func (this *HttpHandler) isHealthy(backend string) bool {
+	breaker := this.Breakers[backend]
+	return breaker == nil || breaker.Ready()
+}
+
+// performRequestWithRetries calls performRequest, retrying idempotent requests on connection failures
+//
+// Only failures to get a response are retried (not 5xx responses), waiting RetryBackoff (doubled each attempt)
+// in between, or until the request's context is done. The request body is buffered so it can be resent, but only if
+// retries are switched on and it's no bigger than MaxRetryBodySize. Requests expecting 100-continue aren't retried,
+// buffering would make the client send the body before the backend agreed to it
+func (this * HttpHandler) performRequestWithRetries(req *http.Request, backend string) (*http.Response, error) {
+	maxRetries := this.Resource.Transport.MaxRetries
+	if maxRetries <= 0 || !isIdempotent(req.Method) || expectsContinue(req) {
+		return this.performRequest(req, backend)
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = ioutil.ReadAll(io.LimitReader(req.Body, MaxRetryBodySize + 1)); err != nil {
+			return nil, err
+		}
+
+		// Too big to hold on to, put back what's been read & send it the once
+		if len(body) > MaxRetryBodySize {
+			Debug("+performRequestWithRetries - Body over", MaxRetryBodySize, "bytes, not retrying")
+			req.Body = &multiReadCloser{ Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body }
+			return this.performRequest(req, backend)
+		}
+	}
+
+	backoff := time.Duration(this.Resource.Transport.RetryBackoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := this.performRequest(req, backend)
+		if err == nil || attempt >= maxRetries || isTLSError(err) {
+			return resp, err
+		}
+
+		Debug("+performRequestWithRetries - Attempt", attempt + 1, "failed, retrying:", err)
+		timer := time.NewTimer(backoff << uint(attempt))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// multiReadCloser reads from Reader but closes Closer, used to put back part of a body that's already been read
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// filterRequestHeaders returns a copy of header with hop-by-hop headers and any not allowed by rsc removed
+func filterRequestHeaders(header http.Header, rsc *ServerResource) http.Header {
+	filtered := header.Clone()
+	if filtered == nil {
+		filtered = http.Header{}
+	}
+
+	// Headers listed in Connection are hop-by-hop too
+	for _, value := range header[HeaderConnection] {
+		for _, name := range strings.Split(value, ",") {
+			filtered.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		filtered.Del(name)
+	}
+
+	if len(rsc.ForwardHeaders) > 0 {
+		for name := range filtered {
+			if name != http.CanonicalHeaderKey(HeaderRequestID) && !containsHeaderName(rsc.ForwardHeaders, name) {
+				filtered.Del(name)
+			}
+		}
+	}
+	for _, name := range rsc.BlockHeaders {
+		filtered.Del(name)
+	}
+	return filtered
+}
+
+// containsHeaderName checks whether name is in names, ignoring case
+func containsHeaderName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// performRequest creates a copy of req pointed at backend and sends it
+func (this * HttpHandler) performRequest(req *http.Request, backend string) (*http.Response, error) {
+
+	// Create the request
+	newReq, err := http.NewRequest(req.Method, backend, nil)
+	if err != nil {
+		Debug("+performRequest - Error creating request")
+		return nil, err
+	}
+
+	newReq.Header = filterRequestHeaders(req.Header, this.Resource)
+	newReq.URL.Path = req.URL.Path
+	newReq.URL.Fragment = req.URL.Fragment
+
+	// NewRequest sets the backends host, swap it for the configured one
+	switch this.Resource.UpstreamHost {
+	case "":
+		newReq.Host = req.Host
+	case UpstreamHostBackend:
+	default:
+		newReq.Host = this.Resource.UpstreamHost
+	}
+
+	if this.Resource.ForwardedHost {
+		newReq.Header.Set(HeaderForwardedHost, req.Host)
+	}
+
+	// Set the body to read from the incoming request - TODO: May need to kick off another goroutine to do this manually for slow connections, have some sort of pause if it can't read anything?
+	newReq.Body = req.Body
+	newReq.ContentLength = req.ContentLength
+
+	// With Expect: 100-continue forwarded the transport holds the body back until the backend answers 100 (or its
+	// ExpectContinueTimeout passes). Our server only sends the client 100 Continue once the body is first read, so the
+	// client gets the backend's go-ahead, or just its final response if the upload is refused
+	if expectsContinue(req) {
+		newReq.Header.Set(HeaderExpect, ValueContinue)
+	}
+
+	return this.Client.Do(newReq)
+}
+
+// decompressIfUnsupported swaps resp.Body for a gzip reader if the backend compressed it and the client didn't ask for gzip
+//
+// Content-Encoding and Content-Length are removed as they no longer describe the body we send. Either way the
+// response now depends on Accept-Encoding so it's added to Vary
+func (this * HttpHandler) decompressIfUnsupported(req *http.Request, resp *http.Response) error {
+	// The transport may already have decompressed it for us (if the client sent no Accept-Encoding)
+	if resp.Uncompressed {
+		addVary(resp.Header, HeaderAcceptEncoding)
+		return nil
+	} else if !containsInArray(resp.Header[HeaderContentEncoding], CompressionGzip) {
+		return nil
+	}
+	addVary(resp.Header, HeaderAcceptEncoding)
+	if containsInArray(req.Header[HeaderAcceptEncoding], CompressionGzip) {
+		return nil
+	}
+
+	// No body for HEAD but the headers should match what GET would send
+	if req.Method != http.MethodHead {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		resp.Body = &gzipReadCloser{ gzipReader, resp.Body }
+	}
+
+	resp.ContentLength = -1
+	resp.Header.Del(HeaderContentEncoding)
+	resp.Header.Del(HeaderContentLength)
+	return nil
+}
+
+// compressIfSupported swaps resp.Body for a gzip'd stream of it if it's uncompressed, of a compressible type and the
+// client accepts gzip
+//
+// The compressed length isn't known up front so Content-Length is removed and the response is chunked
+func (this * HttpHandler) compressIfSupported(req *http.Request, resp *http.Response) {
+	if !isSuccessStatus(resp.StatusCode) || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusPartialContent {
+		return
+	}
+	if !isCompressible(resp.Header.Get(HeaderContentType), this.Resource) || resp.Header.Get(HeaderContentEncoding) != "" {
+		return
+	}
+
+	// Whether or not we compress it now depends on Accept-Encoding
+	addVary(resp.Header, HeaderAcceptEncoding)
+	if !containsInArray(req.Header[HeaderAcceptEncoding], CompressionGzip) {
+		return
+	}
+
+	// No body for HEAD but the headers should match what GET would send
+	if req.Method != http.MethodHead && resp.Body != nil {
+		resp.Body = compressingReader(resp.Body, compressionLevel(this.Resource))
+	}
+	resp.ContentLength = -1
+	resp.Header.Set(HeaderContentEncoding, CompressionGzip)
+	resp.Header.Del(HeaderContentLength)
+
+	// The bytes aren't the backend's any more so a strong ETag would be a lie, the content's still the same though
+	if etag := resp.Header.Get(HeaderETag); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set(HeaderETag, "W/" + etag)
+	}
+}
+
+// rewriteBody applies RewriteRules to text/* responses, replacing resp.Body with the rewritten content
+//
+// The whole body has to be read into memory to do this so it's only done for text content, and bodies over
+// MaxRewriteSize are an error rather than sent on without the rules applied. Compressed content is decompressed
+// first and sent on uncompressed
+func (this * HttpHandler) rewriteBody(req *http.Request, resp *http.Response) error {
+	contentType := resp.Header.Get(HeaderContentType)
+	if len(this.RewriteRules) == 0 || resp.Body == nil || !strings.HasPrefix(contentType, MimeTextBased) {
+		return nil
+	}
+
+	// We can't know the rewritten length without the body so HEAD just drops the headers that would change
+	if req.Method == http.MethodHead {
+		resp.Header.Del(HeaderContentEncoding)
+		resp.Header.Del(HeaderContentLength)
+		return nil
+	}
+
+	var reader io.Reader = resp.Body
+	if containsInArray(resp.Header[HeaderContentEncoding], CompressionGzip) {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+		resp.Header.Del(HeaderContentEncoding)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, MaxRewriteSize + 1))
+	if err != nil {
+		return err
+	}
+	if len(body) > MaxRewriteSize {
+		return fmt.Errorf("Response body is over the %d byte rewrite limit", MaxRewriteSize)
+	}
+
+	for _, rule := range this.RewriteRules {
+		if rule.Literal {
+			body = rule.Pattern.ReplaceAllLiteral(body, rule.To)
+		} else {
+			body = rule.Pattern.ReplaceAll(body, rule.To)
+		}
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set(HeaderContentLength, strconv.Itoa(len(body)))
+	return nil
+}
+
+// isEmptyBody checks whether the response has no content
+//
+// If the length is unknown it reads a byte to find out, wrapping resp.Body so that byte isn't lost
+func (this * HttpHandler) isEmptyBody(resp *http.Response) bool {
+	if resp.Body == nil || resp.ContentLength == 0 {
+		return true
+	} else if resp.ContentLength > 0 {
+		return false
+	}
+
+	b := make([]byte, 1)
+	if n, _ := io.ReadFull(resp.Body, b); n == 0 {
+		return true
+	}
+	resp.Body = &WrapperReader{ UnderlyingReader: resp.Body, B: b[0], ByteRead: false }
+	return false
+}
+
 func (this * HttpHandler) writeBody(w http.ResponseWriter, resp *http.Response) error {
 	reader := resp.Body
 
@@ -127,14 +679,67 @@ func (this *HttpHandler) writeToResponse(w http.ResponseWriter, buf []byte, resp
 	}
 }
 
+// bufferPoolMax returns the most idle buffers to keep for the resource
+func bufferPoolMax(rsc *ServerResource) int {
+	if rsc.BufferPoolMax > 0 {
+		return rsc.BufferPoolMax
+	}
+	return DefaultBufferPoolMax
+}
+
+// bufferSize returns the size of the response buffers for the resource
+func bufferSize(rsc *ServerResource) int {
+	if rsc.BufferSize > 0 {
+		return rsc.BufferSize
+	}
+	return BufferMax
+}
+
 func (this *HttpHandler) getByteBuffer() ([]byte) {
 	if buf, present := this.BufferPool.Retrieve(); present {
 		return buf.([]byte)
 	} else {
-		return make([]byte, BufferMax)
+		return make([]byte, this.BufferSize)
 	}
 }
 
+// compressingReader returns a reader of body gzip'd at level, compressed as it's read. Closing it closes body
+func compressingReader(body io.ReadCloser, level int) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		gzipWriter, err := gzip.NewWriterLevel(pipeWriter, level)
+		if err == nil {
+			if _, err = io.Copy(gzipWriter, body); err == nil {
+				err = gzipWriter.Close()
+			}
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+	return &pipeReadCloser{ pipeReader, body }
+}
+
+// pipeReadCloser closes the pipe (stopping the writer) and the body it's reading from
+type pipeReadCloser struct {
+	*io.PipeReader
+	Body io.ReadCloser
+}
+
+func (this *pipeReadCloser) Close() error {
+	this.PipeReader.Close()
+	return this.Body.Close()
+}
+
+// gzipReadCloser reads decompressed data and closes both the gzip.Reader and the underlying body
+type gzipReadCloser struct {
+	*gzip.Reader
+	Body io.ReadCloser
+}
+
+func (this *gzipReadCloser) Close() error {
+	this.Reader.Close()
+	return this.Body.Close()
+}
+
 type WrapperReader struct {
 	UnderlyingReader io.ReadCloser
 	B byte
@@ -158,3 +763,40 @@ func (this *WrapperReader) Close() error {
 	return this.UnderlyingReader.Close() 
 }
 
+// expectsContinue checks whether the client is waiting for 100 Continue before sending its body
+func expectsContinue(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get(HeaderExpect), ValueContinue)
+}
+
+// isTLSError checks whether err was caused by a failed TLS handshake or an invalid certificate
+//
+// Only the typed errors count, matching on the message would catch unrelated failures
+func isTLSError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var recordHeaderErr tls.RecordHeaderError
+
+	return errors.As(err, &verificationErr) || errors.As(err, &unknownAuthorityErr) || errors.As(err, &certificateInvalidErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &recordHeaderErr)
+}
+
+// isRedirectStatus checks whether status is a 3xx
+func isRedirectStatus(status int) bool {
+	return status >= http.StatusMultipleChoices && status < http.StatusBadRequest
+}
+
+// isSuccessStatus checks whether status is a 2xx
+func isSuccessStatus(status int) bool {
+	return status >= http.StatusOK && status < http.StatusMultipleChoices
+}
+
+// isIdempotent checks whether a request with method can safely be sent more than once
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
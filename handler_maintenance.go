@@ -0,0 +1,89 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderRetryAfter = "Retry-After"
+
+	// DefaultMaintenanceRetryAfter is the Retry-After (seconds) sent if the ServerResource doesn't specify one
+	DefaultMaintenanceRetryAfter = 300
+)
+
+// setRetryAfter sets Retry-After to wait in whole seconds, rounded up so clients never retry too early
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header()[HeaderRetryAfter] = []string{ strconv.Itoa(seconds) }
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: MaintenanceHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+// MaintenanceHandler wraps a RequestHandler and returns 503 (with the MaintenancePage if there is one) while the
+// ServerResource has MaintenanceMode set. The wrapped handler is never called in that case
+type MaintenanceHandler struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// Resource holds the maintenance config, it's checked on every request
+	Resource *ServerResource
+}
+
+// NewMaintenanceHandler wraps handler with the maintenance config from rsc
+func NewMaintenanceHandler(handler RequestHandler, rsc *ServerResource) *MaintenanceHandler {
+	return &MaintenanceHandler{ Handler: handler, Resource: rsc }
+}
+
+func (this *MaintenanceHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	if !this.Resource.MaintenanceMode {
+		this.Handler.HandleRequest(w, req)
+		return
+	}
+
+	Debug("+MaintenanceHandler - Path:", req.URL.Path)
+
+	retryAfter := this.Resource.MaintenanceRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultMaintenanceRetryAfter
+	}
+	w.Header()[HeaderRetryAfter] = []string{ strconv.Itoa(retryAfter) }
+
+	// No page (or we can't read it) so just send the status
+	page := this.Resource.MaintenancePage
+	if page == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	fileInfo, err := os.Stat(page)
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadFile(page)
+	}
+	if err != nil {
+		Error("Failed to read maintenance page:", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header()[HeaderContentType] = []string{ withCharset(detectContentType(fileInfo, this.Resource, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}), this.Resource) }
+	w.Header()[HeaderContentLength] = []string{ strconv.Itoa(len(data)) }
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if req.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
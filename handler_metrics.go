@@ -0,0 +1,226 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// MetricsContentType is the content type of the Prometheus text exposition format
+	MetricsContentType = "text/plain; version=0.0.4"
+)
+
+var (
+	// LatencyBuckets are the upper bounds (in seconds) of the request latency histogram
+	LatencyBuckets = []float64{ 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10 }
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: MetricsCollector
+// ------------------------------------------------------------------------------------------------------------------------
+
+// MetricsCollector counts requests per resource and status class and records their latency and body bytes
+//
+// It's shared between every MetricsRecorder and the MetricsHandler(s) that expose it
+type MetricsCollector struct {
+
+	// mutex guards the maps below, requests are recorded concurrently
+	mutex sync.Mutex
+
+	// requests maps a resource to a status class ("2xx", "4xx" etc) to a count
+	requests map[string]map[string]uint64
+
+	// latency maps a resource to its latency histogram
+	latency map[string]*latencyHistogram
+
+	// bytesIn & bytesOut map a resource to the request/response body bytes transferred
+	bytesIn map[string]uint64
+	bytesOut map[string]uint64
+}
+
+// latencyHistogram holds a count per LatencyBuckets entry (non-cumulative) + totals
+type latencyHistogram struct {
+	Buckets []uint64
+	Sum float64
+	Count uint64
+}
+
+// NewMetricsCollector returns an empty MetricsCollector
+func NewMetricsCollector() *MetricsCollector {
+	return &MetricsCollector{ requests: make(map[string]map[string]uint64), latency: make(map[string]*latencyHistogram),
+		bytesIn: make(map[string]uint64), bytesOut: make(map[string]uint64) }
+}
+
+// RecordBytes adds the body bytes a request to resource read (in) and wrote (out)
+func (this *MetricsCollector) RecordBytes(resource string, in int64, out int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.bytesIn[resource] += uint64(in)
+	this.bytesOut[resource] += uint64(out)
+}
+
+// Bytes returns the body bytes read (in) and written (out) for resource so far
+func (this *MetricsCollector) Bytes(resource string) (uint64, uint64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.bytesIn[resource], this.bytesOut[resource]
+}
+
+// Record adds a completed request against resource
+func (this *MetricsCollector) Record(resource string, status int, duration time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	statusClasses, ok := this.requests[resource]
+	if !ok {
+		statusClasses = make(map[string]uint64)
+		this.requests[resource] = statusClasses
+	}
+	statusClasses[strconv.Itoa(status / 100) + "xx"]++
+
+	histogram, ok := this.latency[resource]
+	if !ok {
+		histogram = &latencyHistogram{ Buckets: make([]uint64, len(LatencyBuckets)) }
+		this.latency[resource] = histogram
+	}
+	seconds := duration.Seconds()
+	for i, upperBound := range LatencyBuckets {
+		if seconds <= upperBound {
+			histogram.Buckets[i]++
+			break
+		}
+	}
+	histogram.Sum += seconds
+	histogram.Count++
+}
+
+// WritePrometheus writes all metrics to w in the Prometheus text format
+func (this *MetricsCollector) WritePrometheus(w io.Writer) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP reverseproxy_requests_total Total requests by resource and status class.")
+	fmt.Fprintln(w, "# TYPE reverseproxy_requests_total counter")
+	for _, resource := range sortedKeys(this.requests) {
+		statusClasses := this.requests[resource]
+		classes := make([]string, 0, len(statusClasses))
+		for class := range statusClasses {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+
+		for _, class := range classes {
+			fmt.Fprintf(w, "reverseproxy_requests_total{resource=%q,status=%q} %d\n", resource, class, statusClasses[class])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP reverseproxy_request_duration_seconds Request latency by resource.")
+	fmt.Fprintln(w, "# TYPE reverseproxy_request_duration_seconds histogram")
+	for _, resource := range sortedKeys(this.requests) {
+		histogram := this.latency[resource]
+
+		// Prometheus buckets are cumulative
+		var cumulative uint64
+		for i, upperBound := range LatencyBuckets {
+			cumulative += histogram.Buckets[i]
+			fmt.Fprintf(w, "reverseproxy_request_duration_seconds_bucket{resource=%q,le=\"%g\"} %d\n", resource, upperBound, cumulative)
+		}
+		fmt.Fprintf(w, "reverseproxy_request_duration_seconds_bucket{resource=%q,le=\"+Inf\"} %d\n", resource, histogram.Count)
+		fmt.Fprintf(w, "reverseproxy_request_duration_seconds_sum{resource=%q} %g\n", resource, histogram.Sum)
+		fmt.Fprintf(w, "reverseproxy_request_duration_seconds_count{resource=%q} %d\n", resource, histogram.Count)
+	}
+
+	fmt.Fprintln(w, "# HELP reverseproxy_request_bytes_total Request body bytes received by resource.")
+	fmt.Fprintln(w, "# TYPE reverseproxy_request_bytes_total counter")
+	for _, resource := range sortedKeys(this.requests) {
+		fmt.Fprintf(w, "reverseproxy_request_bytes_total{resource=%q} %d\n", resource, this.bytesIn[resource])
+	}
+
+	fmt.Fprintln(w, "# HELP reverseproxy_response_bytes_total Response body bytes sent by resource.")
+	fmt.Fprintln(w, "# TYPE reverseproxy_response_bytes_total counter")
+	for _, resource := range sortedKeys(this.requests) {
+		fmt.Fprintf(w, "reverseproxy_response_bytes_total{resource=%q} %d\n", resource, this.bytesOut[resource])
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: MetricsRecorder
+// ------------------------------------------------------------------------------------------------------------------------
+
+// MetricsRecorder wraps a RequestHandler and records each request it handles against a MetricsCollector
+//
+// Request & response body bytes are counted as well as the status & latency
+type MetricsRecorder struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// Resource is the label requests are recorded under
+	Resource string
+
+	// Collector is where requests are recorded
+	Collector *MetricsCollector
+}
+
+func (this *MetricsRecorder) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	sw := NewStatusResponseWriter(w)
+
+	var body *CountingReadCloser
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &CountingReadCloser{ ReadCloser: req.Body }
+		req.Body = body
+	}
+
+	this.Handler.HandleRequest(sw, req)
+	this.Collector.Record(this.Resource, sw.Status, time.Since(start))
+
+	var in int64
+	if body != nil {
+		in = body.Bytes()
+	}
+	this.Collector.RecordBytes(this.Resource, in, int64(sw.Bytes))
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: MetricsHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+// MetricsHandler serves the contents of a MetricsCollector in Prometheus text format
+type MetricsHandler struct {
+
+	// BaseHandler contains ServerResource & ErrorMappings map
+	BaseHandler
+
+	// Collector is the MetricsCollector we're exposing
+	Collector *MetricsCollector
+}
+
+// NewMetricsHandler returns a *MetricsHandler
+func NewMetricsHandler(rsc *ServerResource, errorMappings []ErrorMapping, collector *MetricsCollector) (*MetricsHandler) {
+	return &MetricsHandler{ BaseHandler { rsc, errorMappings }, collector }
+}
+
+func (this *MetricsHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	w.Header()[HeaderContentType] = []string{ MetricsContentType }
+	this.Collector.WritePrometheus(w)
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Non-exported functions
+// ------------------------------------------------------------------------------------------------------------------------
+
+// sortedKeys returns the keys of m in order so output is deterministic
+func sortedKeys(m map[string]map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,40 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: RecoveryHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+// RecoveryHandler wraps a RequestHandler and turns a panic into a 500 (logging the stack) rather than losing the
+// connection
+//
+// If the response has already started there's nothing we can send, the client just gets what was written.
+// http.ErrAbortHandler is passed on as it's a deliberate abort
+type RecoveryHandler struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+}
+
+func (this *RecoveryHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	sw := NewStatusResponseWriter(w)
+	defer func() {
+		if r := recover(); r != nil {
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+
+			Error("Panic handling", req.Method, req.URL.Path, "RequestID:", req.Header.Get(HeaderRequestID), ":", r, "\n", string(debug.Stack()))
+			if !sw.WroteHeader {
+				w.Header()[HeaderCacheControl] = []string{ ValueCacheControlError }
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+	}()
+
+	this.Handler.HandleRequest(sw, req)
+}
@@ -0,0 +1,36 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"sync"
+)
+
+// HandlerFactory creates the RequestHandler for a ServerResource of a registered Type
+type HandlerFactory func(rsc *ServerResource, errorMappings []ErrorMapping) RequestHandler
+
+var (
+	// handlerFactories holds the custom handler types added with RegisterHandler
+	handlerFactories = make(map[string]HandlerFactory)
+	handlerFactoriesMutex sync.RWMutex
+)
+
+// RegisterHandler adds a handler type which can be used as a ServerResource Type
+//
+// Registering a type again replaces its factory. It panics if typeName is one of the built in types
+func RegisterHandler(typeName string, factory HandlerFactory) {
+	if containsString(builtInTypes, typeName) {
+		panic(fmt.Sprintf("Can't replace built in handler Type: %s", typeName))
+	}
+
+	handlerFactoriesMutex.Lock()
+	defer handlerFactoriesMutex.Unlock()
+	handlerFactories[typeName] = factory
+}
+
+// lookupHandler returns the factory registered for typeName
+func lookupHandler(typeName string) (HandlerFactory, bool) {
+	handlerFactoriesMutex.RLock()
+	defer handlerFactoriesMutex.RUnlock()
+	factory, present := handlerFactories[typeName]
+	return factory, present
+}
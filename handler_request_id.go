@@ -0,0 +1,55 @@
+package reverseproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+const (
+	// HeaderRequestID is used to trace a request across services
+	HeaderRequestID = "X-Request-ID"
+
+	// RequestIDBytes is the number of random bytes in a generated ID (hex encoded)
+	RequestIDBytes = 16
+)
+
+var (
+	// validRequestID matches the client IDs we'll keep, they end up in logs & upstream headers
+	validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: RequestIDHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+// RequestIDHandler wraps a RequestHandler and makes sure every request has an X-Request-ID
+//
+// An ID from the client is kept if it's up to 128 letters, digits, '.', '_' or '-', otherwise we generate one. It's
+// set on the request (so it's proxied upstream and can be logged) and on the response
+type RequestIDHandler struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+}
+
+func (this *RequestIDHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(HeaderRequestID)
+	if !validRequestID.MatchString(id) {
+		id = NewRequestID()
+		req.Header.Set(HeaderRequestID, id)
+	}
+
+	w.Header().Set(HeaderRequestID, id)
+	this.Handler.HandleRequest(w, withContextValue(req, requestIDContextKey, id))
+}
+
+// NewRequestID returns a random hex ID
+func NewRequestID() string {
+	b := make([]byte, RequestIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		Error("Failed to generate request ID:", err)
+	}
+	return hex.EncodeToString(b)
+}
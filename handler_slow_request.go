@@ -0,0 +1,43 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: SlowRequestLogger
+// ------------------------------------------------------------------------------------------------------------------------
+
+// SlowRequestLogger wraps a RequestHandler and logs a warning for any request that takes longer than Threshold
+//
+// The warning includes the Match of the resource that handled it (when routed by the server)
+type SlowRequestLogger struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// Threshold is the duration after which a request is considered slow
+	Threshold time.Duration
+}
+
+// NewSlowRequestLogger wraps handler so requests taking longer than thresholdMs are logged
+func NewSlowRequestLogger(handler RequestHandler, thresholdMs int) *SlowRequestLogger {
+	return &SlowRequestLogger{ Handler: handler, Threshold: time.Duration(thresholdMs) * time.Millisecond }
+}
+
+func (this *SlowRequestLogger) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	// Handlers can rewrite the path (e.g. to serve an error page), report the one that was requested
+	requestPath := req.URL.Path
+	start := time.Now()
+	this.Handler.HandleRequest(w, req)
+
+	if duration := time.Since(start); duration > this.Threshold {
+		resource := ""
+		if rsc := ResourceFromContext(req.Context()); rsc != nil {
+			resource = rsc.Match
+		}
+		Warning("Slow request - Host:", req.Host, "Path:", requestPath, "Duration:", duration, "Resource:", resource,
+			"RequestID:", req.Header.Get(HeaderRequestID))
+	}
+}
@@ -0,0 +1,132 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: TimeoutHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+// TimeoutHandler wraps a RequestHandler and gives each request until Timeout to finish, after that the client gets a
+// 503 and the handler's request context is cancelled so it can give up
+//
+// The response is buffered until the handler returns (so the 503 can replace it), which makes it a poor fit for large
+// downloads or anything streamed
+type TimeoutHandler struct {
+
+	// Handler is the wrapped handler
+	Handler RequestHandler
+
+	// Timeout is how long a request has to complete
+	Timeout time.Duration
+}
+
+// NewTimeoutHandler wraps handler so requests taking longer than timeoutMs get a 503
+func NewTimeoutHandler(handler RequestHandler, timeoutMs int) *TimeoutHandler {
+	return &TimeoutHandler{ Handler: handler, Timeout: time.Duration(timeoutMs) * time.Millisecond }
+}
+
+func (this *TimeoutHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	// The handler's context is only cancelled once its writer is marked timed out, so it can't get anything out after
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	timer := time.NewTimer(this.Timeout)
+	defer timer.Stop()
+
+	// The handler can outlive us and changes its request (URL, headers) as it goes, so it gets its own copy
+	handlerReq := req.Clone(ctx)
+	tw := &timeoutWriter{ header: make(http.Header), status: http.StatusOK }
+	done := make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked <- r
+			}
+		}()
+		this.Handler.HandleRequest(tw, handlerReq)
+		close(done)
+	}()
+
+	select {
+
+	// Pass the panic on to whatever's wrapping us (e.g. RecoveryHandler)
+	case r := <-panicked:
+		panic(r)
+
+	case <-done:
+		tw.mutex.Lock()
+		defer tw.mutex.Unlock()
+		for name, values := range tw.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(tw.status)
+		w.Write(tw.body.Bytes())
+
+	// The client's gone, there's nobody to send anything to
+	case <-req.Context().Done():
+		tw.mutex.Lock()
+		tw.timedOut = true
+		tw.mutex.Unlock()
+
+	case <-timer.C:
+		tw.mutex.Lock()
+		defer tw.mutex.Unlock()
+		tw.timedOut = true
+		cancel()
+
+		Warning("Request timed out - Host:", req.Host, "Path:", req.URL.Path, "Timeout:", this.Timeout,
+			"RequestID:", req.Header.Get(HeaderRequestID))
+		w.Header()[HeaderCacheControl] = []string{ ValueCacheControlError }
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: timeoutWriter
+// ------------------------------------------------------------------------------------------------------------------------
+
+// timeoutWriter holds the handler's response until it finishes, writes after the timeout fail with
+// http.ErrHandlerTimeout
+type timeoutWriter struct {
+
+	// mutex guards everything below, the handler writes from its own goroutine
+	mutex sync.Mutex
+
+	header http.Header
+	body bytes.Buffer
+	status int
+	wroteHeader bool
+	timedOut bool
+}
+
+func (this *timeoutWriter) Header() http.Header {
+	return this.header
+}
+
+func (this *timeoutWriter) Write(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	this.wroteHeader = true
+	return this.body.Write(p)
+}
+
+func (this *timeoutWriter) WriteHeader(status int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.timedOut || this.wroteHeader {
+		return
+	}
+	this.wroteHeader = true
+	this.status = status
+}
@@ -0,0 +1,105 @@
+package reverseproxy
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Host prefixes. A Host starting with one of these is a pattern rather than a plain hostname
+const (
+	HostWildcardPrefix = "*."
+	HostRegexPrefix = "~"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: HostMatcher
+// ------------------------------------------------------------------------------------------------------------------------
+
+// HostMatcher resolves a request host to the []PathMapping of its ServerBlock
+//
+// Exact hosts are a map lookup. Patterns are only tried (in the order they were added) when there's no exact match so
+// the common case never runs a regex
+type HostMatcher struct {
+
+	// Exact maps a lowercase hostname to its mappings
+	Exact map[string][]PathMapping
+
+	// Patterns are the wildcard/regex hosts
+	Patterns []HostPattern
+
+	// Default is used if nothing matches
+	Default []PathMapping
+}
+
+// NewHostMatcher returns an empty HostMatcher
+func NewHostMatcher() *HostMatcher {
+	return &HostMatcher{ Exact: make(map[string][]PathMapping) }
+}
+
+// Add routes host (a hostname or pattern, see CompileHostPattern) to mappings
+func (this *HostMatcher) Add(host string, mappings []PathMapping) error {
+	pattern, err := CompileHostPattern(host)
+	if err != nil {
+		return err
+	}
+
+	if pattern != nil {
+		this.Patterns = append(this.Patterns, HostPattern{ Pattern: pattern, Mappings: mappings })
+	} else {
+		this.Exact[strings.ToLower(host)] = mappings
+	}
+	return nil
+}
+
+// Match returns the mappings for an exact host match, then the first matching pattern, then Default
+func (this *HostMatcher) Match(host string) []PathMapping {
+	host = strings.ToLower(host)
+	if mappings, OK := this.Exact[host]; OK {
+		return mappings
+	}
+	for _, hostPattern := range this.Patterns {
+		if hostPattern.Pattern.MatchString(host) {
+			return hostPattern.Mappings
+		}
+	}
+	return this.Default
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: HostPattern
+// ------------------------------------------------------------------------------------------------------------------------
+
+// StringMatcher is satisfied by *regexp.Regexp, it lets a host pattern be matched without one
+type StringMatcher interface {
+	MatchString(s string) bool
+}
+
+// HostPattern matches request hosts against a wildcard or regex Host
+type HostPattern struct {
+
+	// Pattern is the compiled Host, it's given a lowercase host
+	Pattern StringMatcher
+
+	// Mappings are used for requests whose host matches
+	Mappings []PathMapping
+}
+
+// CompileHostPattern compiles a wildcard (*.example.com matches any subdomain) or regex (prefixed with ~) Host
+//
+// It returns nil if host is a plain hostname. Patterns ignore case
+func CompileHostPattern(host string) (StringMatcher, error) {
+	switch {
+	case strings.HasPrefix(host, HostRegexPrefix):
+		return regexp.Compile("(?i)" + strings.TrimPrefix(host, HostRegexPrefix))
+	case strings.HasPrefix(host, HostWildcardPrefix):
+		return wildcardHost(strings.ToLower(host[1:])), nil
+	}
+	return nil, nil
+}
+
+// wildcardHost matches any subdomain of the domain it holds (with a leading '.'), a suffix check is all that's needed
+type wildcardHost string
+
+func (this wildcardHost) MatchString(host string) bool {
+	return len(host) > len(this) && strings.HasSuffix(host, string(this))
+}
@@ -1,15 +1,29 @@
 package reverseproxy
 
 import (
+	"fmt"
 	"os"
 	"github.com/seanjohnno/memcache"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
+	// CompressionSuffix identifies the compressed variant of a file in the cache
 	CompressionSuffix = "gzip"
 )
 
+// Cache store policies. Known 'store' values inside a cache block, used to decide which variant we keep when compression is on
+const (
+	CacheStoreBoth			= ""
+	CacheStoreCompressed	= "compressed"
+	CacheStoreIdentity		= "identity"
+)
+
 type CacheFileLoader struct {
 
 	// FileRetriever is the next in the chain to pass request onto if we can't find in cache 
@@ -17,84 +31,315 @@ type CacheFileLoader struct {
 
 	// UnderlyingCache is the cache impl we're using to store/retrieve the file content
 	UnderlyingCache memcache.Cache
+
+	// RevalidateInterval is how long we trust a cached files modtime before checking the file again
+	//
+	// Zero checks the file on every cache hit
+	RevalidateInterval time.Duration
+
+	// Clock returns the current time, it's only swapped out for testing
+	Clock func() time.Time
+
+	// StatFile is used to check whether a cached file has changed, it's only swapped out for testing
+	StatFile func(name string) (os.FileInfo, error)
+
+	// NoCache holds the request paths which always go straight to WrappedRetriever
+	NoCache []*regexp.Regexp
+
+	// validated maps a cache key to when we last checked the file hadn't changed
+	validated map[string]time.Time
+
+	// validatedMutex guards validated, requests are handled concurrently
+	validatedMutex sync.Mutex
+}
+
+// NewCacheFileLoader returns a CacheFileLoader which caches files from wrapped in cache
+//
+// Evicted files are forgotten by the revalidation check too, if the cache can tell us about them
+func NewCacheFileLoader(wrapped FileRetriever, cache memcache.Cache, revalidateInterval time.Duration) *CacheFileLoader {
+	loader := &CacheFileLoader{ WrappedRetriever: wrapped, UnderlyingCache: cache, RevalidateInterval: revalidateInterval,
+		Clock: time.Now, StatFile: os.Stat, validated: make(map[string]time.Time) }
+
+	if notifier, ok := cache.(EvictionNotifier); ok && revalidateInterval > 0 {
+		notifier.AddOnEvict(func(key string, item memcache.CacheItem) {
+			loader.setValidated(key, false)
+		})
+	}
+	return loader
 }
 
+// GetFile returns the file content for the request, either from the cache or from WrappedRetriever
+//
+// If the resource has a cache store policy we only ever cache one variant and convert it on the way out
 func (this *CacheFileLoader) GetFile(req *http.Request, resource *ServerResource, compression bool) (*FileContent, error) {
-	filePath := req.URL.Path
-	if fc := this.GetFileInCache(filePath, compression); fc == nil {
-		if fc, err := this.WrappedRetriever.GetFile(req, resource, compression); err == nil {
+	for _, pattern := range this.NoCache {
+		if pattern.MatchString(req.URL.Path) {
+			Debug("Not caching: " + req.URL.Path)
+			return this.WrappedRetriever.GetFile(req, resource, compression)
+		}
+	}
+
+	switch resource.Cache.Store {
 
-			if fc.Compression {
-				filePath = filePath + CompressionSuffix
+	// Only hold gzip'd content, decompress for clients that can't accept it
+	case CacheStoreCompressed:
+		if resource.Compression {
+			fc, err := this.loadFile(req, resource, true)
+			if err == nil && !compression {
+				return fc.Decompressed()
 			}
-			this.UnderlyingCache.Add(filePath, fc)
-			
-			return fc, nil
-		} else {
 			return fc, err
 		}
-	} else {
+
+	// Only hold identity content, compress for clients that can accept it
+	case CacheStoreIdentity:
+		fc, err := this.loadFile(req, resource, false)
+		if err == nil && compression {
+			return fc.Compressed(compressionLevel(resource))
+		}
+		return fc, err
+	}
+	return this.loadFile(req, resource, compression)
+}
+
+// LocateFile passes through to WrappedRetriever (if it's a FileLocator), there's nothing to gain from the cache
+func (this *CacheFileLoader) LocateFile(requestPath string, res *ServerResource) (os.FileInfo, string) {
+	if locator, ok := this.WrappedRetriever.(FileLocator); ok {
+		return locator.LocateFile(requestPath, res)
+	}
+	return nil, requestPath
+}
+
+// loadFile checks the cache for the requested variant and falls back to WrappedRetriever (caching the result)
+func (this *CacheFileLoader) loadFile(req *http.Request, resource *ServerResource, compression bool) (*FileContent, error) {
+	filePath := req.URL.Path
+
+	// Negotiated paths can resolve to different files, cache each ordering separately
+	if extensions := orderedExtensions(req, resource); extensions != nil {
+		filePath += "#" + strings.Join(extensions, ",")
+	}
+
+	// ...and so can different hosts, the host goes first as paths start with '/'
+	if host, ok := sanitizeHost(req.Host); ok && usesHostPlaceholder(resource) {
+		filePath = host + filePath
+	}
+	filePath += varyKey(req, &resource.Cache)
+
+	// Named caches can be shared by resources serving different directories, only the same directories share entries
+	if resource.Cache.Name != "" {
+		filePath = strings.Join(fileSystemRoots(resource), ",") + ":" + filePath
+	}
+	if fc := this.GetFileInCache(filePath, compression); fc != nil {
 		return fc, nil
 	}
+
+	fc, err := this.WrappedRetriever.GetFile(req, resource, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store under the variant we actually got back (images etc. aren't compressed even if requested)
+	key := CacheKey(filePath, fc.Compression)
+	if err := this.UnderlyingCache.Add(key, fc); err == nil {
+		this.setValidated(key, true)
+	}
+	return fc, nil
 }
 
-// GetFile retrieves cached file (FileCacheItem) if its been added and isn't stale (by comparing stored timestamp)
+// GetFileInCache retrieves cached file (FileContent) if its been added and isn't stale (by comparing stored timestamp)
 func (this *CacheFileLoader) GetFileInCache(filePath string, compression bool) (*FileContent) {
 
 	// Check is cache is already present
 	if fileCacheItem, present := this.CheckFileInCache(filePath, compression); present {
-		
+		key := CacheKey(filePath, fileCacheItem.Compression)
+
+		// Checked recently enough that we can trust the cached modTime
+		if this.isRecentlyValidated(key) {
+			Debug("File found in cache (not revalidated): " + fileCacheItem.AbsolutePath)
+			return fileCacheItem
+
 		// Grab the files FileInfo
-		if curFileInfo, err := os.Stat(fileCacheItem.AbsolutePath); err == nil {
+		} else if curFileInfo, err := this.stat(fileCacheItem.AbsolutePath); err == nil {
 
 			// If file modTime is the same then we can return data
 			if fileCacheItem.FileInfo.ModTime().Equal( curFileInfo.ModTime() ) {
 				Debug("File found in cache: " + fileCacheItem.AbsolutePath)
+				this.setValidated(key, true)
 				return fileCacheItem
 			
 			// File modTime has changed so file has changed, remove from cache
 			} else {
-				this.UnderlyingCache.Remove(filePath)
+				this.UnderlyingCache.Remove(key)
+				this.setValidated(key, false)
 			}
 
 		// Problem getting fileInfo...
 		} else {
-			this.UnderlyingCache.Remove(filePath)
+			this.UnderlyingCache.Remove(key)
+			this.setValidated(key, false)
 		}
 	}
 	Debug("File not found in cache: " + filePath)
 	return nil
 }
 
+// CheckFileInCache returns the cached variant matching the accepted encoding
+//
+// If the client accepts compression we return the compressed variant. Otherwise (or if it's not present) we return
+// the identity variant, but only if the client can't accept compression or the content can't be compressed anyway
 func (this *CacheFileLoader) CheckFileInCache(filePath string, compression bool) (*FileContent, bool) {
-
-	// Check if we're looking for compressed content
 	if compression {
+		if content, ok := this.cachedContent(CacheKey(filePath, true)); ok {
+			return content, true
+		}
+	}
 
-		// Use compression suffix (to discern from non-compressed content)
-		if content, ok := this.UnderlyingCache.Get(filePath + CompressionSuffix); ok {
-			return content.(*FileContent), ok
-		
-		// Compressed doesn't exist so lets check for normal...
-		} else if content, ok := this.UnderlyingCache.Get(filePath); ok {
-			
-			// ...and make sure the IgnoreCompression flag is set (for non-text content)
-			ret := content.(*FileContent)
-			if ret.IgnoreCompression {
-				return ret, true
-			} else {
-				return nil, false
-			}
+	if content, ok := this.cachedContent(CacheKey(filePath, false)); ok {
+		if !compression || content.IgnoreCompression {
+			return content, true
+		}
+	}
+	return nil, false
+}
 
-		} else {
-			return nil, false
+// cachedContent returns the FileContent cached under key
+//
+// A shared (named) cache could hold something else under our key, that's treated as a miss and removed so it's
+// replaced with the file
+func (this *CacheFileLoader) cachedContent(key string) (*FileContent, bool) {
+	item, ok := this.UnderlyingCache.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	content, ok := item.(*FileContent)
+	if !ok {
+		Warning("Removing unexpected item cached under", key, fmt.Sprintf("%T", item))
+		this.UnderlyingCache.Remove(key)
+		this.setValidated(key, false)
+		return nil, false
+	}
+	return content, true
+}
+
+// Precompress loads each of paths (request paths) into the cache, as it'd be for a client accepting gzip (or the
+// uncompressed copy if the resource doesn't have Compression on)
+//
+// Only files with a known compressible type are loaded and it stops before a file which (going by its size on disk)
+// would take it past Limit bytes. Returns the number of files loaded
+func (this *CacheFileLoader) Precompress(resource *ServerResource, paths []string) int {
+	loaded, size := 0, 0
+	for _, filePath := range paths {
+		if mimeType, known := lookupMimeType(filePath, resource); !known || !isCompressible(mimeType, resource) {
+			continue
+		}
+
+		// Once it's loaded it's in the cache, so check it'll fit first
+		if fi, _ := this.LocateFile(filePath, resource); fi != nil && resource.Cache.Limit > 0 && size + int(fi.Size()) > resource.Cache.Limit {
+			break
+		}
+
+		req := &http.Request{ Method: http.MethodGet, URL: &url.URL{ Path: filePath }, Header: make(http.Header) }
+		fc, err := this.GetFile(req, resource, resource.Compression)
+		if err != nil {
+			Warning("Failed to precompress", filePath, ":", err)
+			continue
 		}
 
-	// Check for non-compressed in cache
-	} else  if content, ok := this.UnderlyingCache.Get(filePath); ok {
-		ret := content.(*FileContent)
-		return ret, ok
+		size += fc.Size()
+		loaded++
 	}
+	Info("Precompressed", loaded, "files for", resource.Match)
+	return loaded
+}
 
-	return nil, false
-}
\ No newline at end of file
+// CacheKey returns the key a variant of filePath is stored under
+//
+// Compressed content is prefixed with the encoding, request paths always start with '/' so it can't clash with a path
+func CacheKey(filePath string, compressed bool) string {
+	if compressed {
+		return CompressionSuffix + ":" + filePath
+	}
+	return filePath
+}
+
+// varyKey returns the part of the cache key taken from the requests VaryHeaders, empty if there are none
+//
+// Each header contributes the first of its VaryValues the request lists (or nothing), never the raw value
+func varyKey(req *http.Request, cache *CacheStrategy) string {
+	key := ""
+	for _, header := range cache.VaryHeaders {
+		key += "|" + http.CanonicalHeaderKey(header) + "=" + matchVaryValue(req.Header.Get(header), varyValues(cache, header))
+	}
+	return key
+}
+
+// varyValues returns the VaryValues configured for header (which is matched case-insensitively)
+func varyValues(cache *CacheStrategy, header string) []string {
+	for name, values := range cache.VaryValues {
+		if strings.EqualFold(name, header) {
+			return values
+		}
+	}
+	return nil
+}
+
+// matchVaryValue returns the first entry of the comma separated headerValue found in values, empty if there isn't one
+func matchVaryValue(headerValue string, values []string) string {
+	for _, part := range strings.Split(headerValue, ",") {
+		part = strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		for _, value := range values {
+			if strings.EqualFold(part, value) {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// isRecentlyValidated checks whether the file cached under key was checked within RevalidateInterval
+func (this *CacheFileLoader) isRecentlyValidated(key string) bool {
+	if this.RevalidateInterval <= 0 {
+		return false
+	}
+
+	this.validatedMutex.Lock()
+	defer this.validatedMutex.Unlock()
+	last, ok := this.validated[key]
+	return ok && this.now().Sub(last) < this.RevalidateInterval
+}
+
+// setValidated records that the file cached under key has just been checked (or forgets it if valid is false)
+func (this *CacheFileLoader) setValidated(key string, valid bool) {
+	if this.RevalidateInterval <= 0 {
+		return
+	}
+
+	this.validatedMutex.Lock()
+	defer this.validatedMutex.Unlock()
+	if this.validated == nil {
+		this.validated = make(map[string]time.Time)
+	}
+
+	if valid {
+		this.validated[key] = this.now()
+	} else {
+		delete(this.validated, key)
+	}
+}
+
+// now returns the current time from Clock (if set)
+func (this *CacheFileLoader) now() time.Time {
+	if this.Clock != nil {
+		return this.Clock()
+	}
+	return time.Now()
+}
+
+// stat calls StatFile (if set)
+func (this *CacheFileLoader) stat(name string) (os.FileInfo, error) {
+	if this.StatFile != nil {
+		return this.StatFile(name)
+	}
+	return os.Stat(name)
+}
@@ -0,0 +1,118 @@
+package reverseproxy
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: EmbedLoader
+// ------------------------------------------------------------------------------------------------------------------------
+
+// EmbedLoader is a FileRetriever which reads files from an fs.FS (e.g. assets embedded via go:embed)
+//
+// It resolves default files/extensions, MIME types and compression the same way as FileSystemLoader
+type EmbedLoader struct {
+
+	// FS is the filesystem files are read from
+	FS fs.FS
+}
+
+func (this *EmbedLoader) GetFile(req *http.Request, resource *ServerResource, compression bool) (*FileContent, error) {
+	resource, ok := hostResource(req, negotiateExtensions(req, resource))
+	if !ok {
+		return nil, errors.New("Invalid host: " + req.Host)
+	}
+	if fi, filePath := this.LocateFile(req.URL.Path, resource); fi != nil {
+
+		// Get mimetype and figure out whether we should ignore compression flag
+		mimeType := detectContentType(fi, resource, func() (io.ReadCloser, error) { return this.FS.Open(filePath) })
+		ignoreCompression := !isCompressible(mimeType, resource)
+
+		if ignoreCompression {
+			compression = false
+		}
+
+		// Serve a precompressed sibling if one was embedded
+		if compression {
+			if data, err := fs.ReadFile(this.FS, filePath + PrecompressedSuffix); err == nil {
+				return &FileContent{ fi, filePath, data, true, ignoreCompression, mimeType }, nil
+			}
+		}
+
+		data, err := fs.ReadFile(this.FS, filePath)
+		if err == nil && compression {
+			data, err = compressData(data, compressionLevel(resource))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &FileContent{ fi, filePath, data, compression, ignoreCompression, mimeType }, nil
+
+	} else {
+		return nil, errors.New("Unable to locate file")
+	}
+}
+
+// LocateFile finds the file for requestPath (under ServerResource.Path) and returns it with its fs.FS path
+func (this *EmbedLoader) LocateFile(requestPath string, res *ServerResource) (fs.FileInfo, string) {
+	filePath := toFSPath(path.Join(res.Path, requestPath))
+
+	// If we finish in a slash then we're a directory and we need a default file
+	if strings.HasSuffix(requestPath, "/") {
+		for _, defaultFile := range res.FSDefaults.DefaultFiles {
+			if fi, fullPath := this.statFile(path.Join(filePath, defaultFile)); fi != nil {
+				return fi, fullPath
+			}
+		}
+
+	// No extension so lets try and append the ones specified as default
+	} else if !strings.Contains(requestPath, ".") {
+		for _, extension := range res.FSDefaults.DefaultExtensions {
+			if fi, fullPath := this.statFile(filePath + extension); fi != nil {
+				return fi, fullPath
+			}
+		}
+
+		// Files don't have to have an extension (their type is sniffed)
+		if fi, fullPath := this.statFile(filePath); fi != nil {
+			return fi, fullPath
+		}
+
+	// Check file
+	} else if fi, fullPath := this.statFile(filePath); fi != nil {
+		return fi, fullPath
+	}
+
+	return nil, requestPath
+}
+
+// Stat returns the FileInfo for a path in FS, it's used by the cache to check for changes
+func (this *EmbedLoader) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(this.FS, name)
+}
+
+// statFile returns the FileInfo + path if name exists and isn't a directory
+func (this *EmbedLoader) statFile(name string) (fs.FileInfo, string) {
+	if fi, err := fs.Stat(this.FS, name); err == nil && !fi.IsDir() {
+		return fi, name
+	}
+	return nil, ""
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Non-exported functions
+// ------------------------------------------------------------------------------------------------------------------------
+
+// toFSPath converts a cleaned path to the unrooted form fs.FS expects ("." for the root)
+func toFSPath(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
@@ -5,20 +5,40 @@ import (
 	"os"
 	"bytes"
 	"compress/gzip"
+	"io"
 	"io/ioutil"
 	"strings"
 	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 )
 
 const (
 	MimeTextBased		= "text"
 	PlainTextMimeType	= "text/plain"
+
+	// SniffLength is how much of a file is used to detect its content type when the extension isn't known
+	SniffLength			= 512
+
+	HeaderAccept		= "Accept"
+
+	// PrecompressedSuffix is the extension of gzip'd siblings we'll serve instead of compressing at runtime
+	PrecompressedSuffix	= ".gz"
+
+	// HostPlaceholder in a ServerResource Path is replaced with the requests Host
+	HostPlaceholder		= "{host}"
 )
 
 var (
+	// DefaultCompressibleTypes are used when a ServerResource doesn't set CompressibleTypes
+	DefaultCompressibleTypes = []string{ "text/*", "application/json", "application/javascript", "image/svg+xml" }
+
 	// mimeMap maps file extensions to content types - TODO - needs to be expanded / perhaps read from a config file(?)
 	mimeMap = map[string]string {
 		".html": "text/html",
+		".json": "application/json",
 		".css": "text/css",	
 		".js": "text/javascript",
 		".ico": "image/x-icon",
@@ -38,6 +58,11 @@ type FileRetriever interface {
 }
 
 
+// FileLocator is implemented by FileRetrievers which can find the file for a request without reading it
+type FileLocator interface {
+	LocateFile(requestPath string, res *ServerResource) (os.FileInfo, string)
+}
+
 type FileContent struct {
 
 	// FileInfo is the FileInfo object at the time of cache
@@ -66,22 +91,63 @@ func (this *FileContent) Size() int {
 	return len(this.Data)
 }
 
+// Compressed returns a copy of the FileContent with its Data gzip'd
+//
+// Used when a cache only holds the identity variant and the client has asked for compressed content
+func (this *FileContent) Compressed(level int) (*FileContent, error) {
+	if this.Compression || this.IgnoreCompression {
+		return this, nil
+	}
+
+	data, err := compressData(this.Data, level)
+	if err != nil {
+		return nil, err
+	}
+	return &FileContent{ this.FileInfo, this.AbsolutePath, data, true, this.IgnoreCompression, this.MimeType }, nil
+}
+
+// Decompressed returns a copy of the FileContent with its Data un-gzip'd
+//
+// Used when a cache only holds the compressed variant and the client can't accept compressed content
+func (this *FileContent) Decompressed() (*FileContent, error) {
+	if !this.Compression {
+		return this, nil
+	}
+
+	data, err := decompressData(this.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &FileContent{ this.FileInfo, this.AbsolutePath, data, false, this.IgnoreCompression, this.MimeType }, nil
+}
+
 type FileSystemLoader struct {
 
 }
 
 func (this *FileSystemLoader) GetFile(req *http.Request, resource *ServerResource, compression bool) (*FileContent, error) {
+	resource, ok := hostResource(req, negotiateExtensions(req, resource))
+	if !ok {
+		return nil, errors.New("Invalid host: " + req.Host)
+	}
 	if fi, absolutePath := this.LocateFile(req.URL.Path, resource); fi != nil {
 		
 		// Get mimetype and figure out whether we should ignore compression flag
-		mimeType := getContentTypeHeader(fi)
-		ignoreCompression := !strings.HasPrefix(mimeType, MimeTextBased)
+		mimeType := detectContentType(fi, resource, func() (io.ReadCloser, error) { return os.Open(absolutePath) })
+		ignoreCompression := !isCompressible(mimeType, resource)
 		
 		if ignoreCompression {
 			compression = false
 		}
 
-		if data, err := this.ReadFile(absolutePath, compression); err == nil {	
+		// Serve a precompressed sibling if the build pipeline produced one (FileInfo stays the original for Last-Modified)
+		if compression {
+			if data, found := this.ReadPrecompressedFile(absolutePath, fi); found {
+				return &FileContent{ fi, absolutePath, data, true, ignoreCompression, mimeType }, nil
+			}
+		}
+
+		if data, err := this.ReadFile(absolutePath, compression, compressionLevel(resource)); err == nil {	
 			return &FileContent{ fi, absolutePath, data, compression, ignoreCompression, mimeType }, nil
 		} else {
 			return nil, err
@@ -91,8 +157,25 @@ func (this *FileSystemLoader) GetFile(req *http.Request, resource *ServerResourc
 	}
 }
 
+// LocateFile finds the file for requestPath under the resources Path, or under each of its Roots in turn
 func (this *FileSystemLoader) LocateFile(requestPath string, res *ServerResource) (os.FileInfo, string) {
-	filePath :=  res.Path + requestPath
+	for _, root := range fileSystemRoots(res) {
+		if fi, fullPath := this.locateIn(root, requestPath, res); fi != nil {
+			return fi, fullPath
+		}
+	}
+	return nil, requestPath
+}
+
+// locateIn finds the file for requestPath under a single root
+func (this *FileSystemLoader) locateIn(root string, requestPath string, res *ServerResource) (os.FileInfo, string) {
+	filePath := root + requestPath
+
+	// Never look outside the root, whatever the request path contains
+	if !isUnderRoot(root, filePath) {
+		Debug("+locateIn - Path escapes the root:", requestPath)
+		return nil, filePath
+	}
 
 	// If we finish in a slash then we're a directory and we need a default file
 	if strings.HasSuffix(requestPath, "/") {
@@ -109,6 +192,11 @@ func (this *FileSystemLoader) LocateFile(requestPath string, res *ServerResource
 			return fileInfo, fullPath
 		}
 
+		// Files don't have to have an extension (their type is sniffed)
+		if f, err := os.Stat(filePath); err == nil && !f.IsDir() {
+			return f, filePath
+		}
+
 	// Check file
 	} else if f, err := os.Stat(filePath); err == nil {
 		return f, filePath
@@ -117,21 +205,14 @@ func (this *FileSystemLoader) LocateFile(requestPath string, res *ServerResource
 	return nil, requestPath
 }
 
-func (this *FileSystemLoader) ReadFile(absolutePath string, compression bool) ([]byte, error) {
+func (this *FileSystemLoader) ReadFile(absolutePath string, compression bool, level int) ([]byte, error) {
 	if fileContent, err := ioutil.ReadFile(absolutePath); err == nil {
 		
 		// If compression flag is set then compress and assign to fileContent
 		if compression {
-			buf := bytes.NewBuffer( make([]byte, 0) )
-	
-			compressionWriter := gzip.NewWriter(buf)
-			_, err := compressionWriter.Write(fileContent)
-			compressionWriter.Close()
-			if err != nil {
+			if fileContent, err = compressData(fileContent, level); err != nil {
 				return nil, err
-			} 
-			
-			fileContent = buf.Bytes()
+			}
 		}
 
 		// Add cache object
@@ -141,6 +222,19 @@ func (this *FileSystemLoader) ReadFile(absolutePath string, compression bool) ([
 	}
 }
 
+// ReadPrecompressedFile reads the '.gz' sibling of absolutePath if it exists
+//
+// It's ignored if it's older than the original file as it's probably stale
+func (this *FileSystemLoader) ReadPrecompressedFile(absolutePath string, original os.FileInfo) ([]byte, bool) {
+	gzPath := absolutePath + PrecompressedSuffix
+	if gzInfo, err := os.Stat(gzPath); err == nil && !gzInfo.ModTime().Before(original.ModTime()) {
+		if data, err := ioutil.ReadFile(gzPath); err == nil {
+			Debug("+ReadPrecompressedFile. Found file: " + gzPath)
+			return data, true
+		}
+	}
+	return nil, false
+}
 
 // findFileByAppending loops through slice appending to the path until it finds a file that exists
 //
@@ -159,12 +253,279 @@ func (this *FileSystemLoader) FindFileByAppending(filePath string, appendSlice [
 	return "", nil
 }
 
-// setContentTypeHeader sets the 'content-type' header of the http response based on the file extension
-func getContentTypeHeader(fileInfo os.FileInfo) string {
-	for key, val := range mimeMap {
-		if strings.HasSuffix(fileInfo.Name(), key) {
-			return val
+// compressData gzip's the data passed in at the given level (see compress/flate)
+func compressData(data []byte, level int) ([]byte, error) {
+	buf := bytes.NewBuffer( make([]byte, 0) )
+
+	compressionWriter, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = compressionWriter.Write(data)
+	compressionWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressionLevel returns the gzip level for the resource, zero (not set) uses the default
+func compressionLevel(rsc *ServerResource) int {
+	if rsc.CompressionLevel == 0 {
+		return gzip.DefaultCompression
+	}
+	return rsc.CompressionLevel
+}
+
+// decompressData reverses compressData
+func decompressData(data []byte) ([]byte, error) {
+	compressionReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer compressionReader.Close()
+	return ioutil.ReadAll(compressionReader)
+}
+
+// getContentTypeHeader returns the content type for the file based on its extension
+//
+// The resources MimeTypes are checked before the built in mimeMap
+func getContentTypeHeader(fileInfo os.FileInfo, rsc *ServerResource) string {
+	return mimeTypeForName(fileInfo.Name(), rsc)
+}
+
+// isUnderRoot checks filePath is root or somewhere beneath it once both are cleaned
+func isUnderRoot(root string, filePath string) bool {
+	cleanRoot, cleanPath := filepath.Clean(root), filepath.Clean(filePath)
+	return cleanPath == cleanRoot || strings.HasPrefix(cleanPath, strings.TrimSuffix(cleanRoot, string(filepath.Separator)) + string(filepath.Separator))
+}
+
+// fileSystemRoots returns the directories a file_system resource serves from, Roots if set otherwise Path
+func fileSystemRoots(rsc *ServerResource) []string {
+	if len(rsc.Roots) > 0 {
+		return rsc.Roots
+	}
+	return []string{ rsc.Path }
+}
+
+// usesHostPlaceholder checks whether any of the resources roots contain HostPlaceholder
+func usesHostPlaceholder(rsc *ServerResource) bool {
+	for _, root := range fileSystemRoots(rsc) {
+		if strings.Contains(root, HostPlaceholder) {
+			return true
 		}
 	}
+	return false
+}
+
+// hostResource returns the resource with HostPlaceholder in its Path (and Roots) replaced by the requests (sanitized)
+// Host
+//
+// rsc is returned as is if there's no placeholder. The bool is false if the Host isn't safe to use in a path
+func hostResource(req *http.Request, rsc *ServerResource) (*ServerResource, bool) {
+	if !usesHostPlaceholder(rsc) {
+		return rsc, true
+	}
+
+	host, ok := sanitizeHost(req.Host)
+	if !ok {
+		Warning("Rejected Host for", rsc.Path, ":", req.Host)
+		return nil, false
+	}
+
+	resolved := *rsc
+	resolved.Path = strings.Replace(rsc.Path, HostPlaceholder, host, -1)
+	if len(rsc.Roots) > 0 {
+		resolved.Roots = make([]string, len(rsc.Roots))
+		for i, root := range rsc.Roots {
+			resolved.Roots[i] = strings.Replace(root, HostPlaceholder, host, -1)
+		}
+	}
+	return &resolved, true
+}
+
+// sanitizeHost returns host lowercased without its port, the bool is false if it's anything other than a plain
+// hostname or IPv4 address (so it can't be used to escape a directory)
+func sanitizeHost(host string) (string, bool) {
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		if _, err := strconv.Atoi(host[i + 1:]); err == nil {
+			host = host[:i]
+		}
+	}
+	host = strings.ToLower(host)
+
+	if host == "" || len(host) > 253 || host[0] == '.' || strings.Contains(host, "..") {
+		return "", false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-') {
+			return "", false
+		}
+	}
+	return host, true
+}
+
+// negotiateExtensions returns the resource with its DefaultExtensions ordered by the requests Accept header
+//
+// It's only done for extensionless paths when NegotiateExtensions is set, otherwise rsc is returned as is. Extensions
+// keep their config order when the client likes them equally
+func negotiateExtensions(req *http.Request, rsc *ServerResource) *ServerResource {
+	extensions := orderedExtensions(req, rsc)
+	if extensions == nil {
+		return rsc
+	}
+
+	negotiated := *rsc
+	negotiated.FSDefaults.DefaultExtensions = extensions
+	return &negotiated
+}
+
+// negotiatesExtensions checks whether the file served for req depends on its Accept header
+func negotiatesExtensions(req *http.Request, rsc *ServerResource) bool {
+	return rsc.FSDefaults.NegotiateExtensions && len(rsc.FSDefaults.DefaultExtensions) >= 2 && path.Ext(req.URL.Path) == ""
+}
+
+// orderedExtensions returns DefaultExtensions ordered by preference, nil if there's no negotiation to do
+func orderedExtensions(req *http.Request, rsc *ServerResource) []string {
+	accept := req.Header.Get(HeaderAccept)
+	if accept == "" || !negotiatesExtensions(req, rsc) {
+		return nil
+	}
+
+	ranges := parseAccept(accept)
+	extensions := append([]string(nil), rsc.FSDefaults.DefaultExtensions...)
+	quality := make(map[string]float64)
+	for _, extension := range extensions {
+		quality[extension] = acceptQuality(ranges, mimeTypeForName(extension, rsc))
+	}
+	sort.SliceStable(extensions, func(i, j int) bool { return quality[extensions[i]] > quality[extensions[j]] })
+	return extensions
+}
+
+// mediaRange is a single entry from an Accept header
+type mediaRange struct {
+	Type string
+	Quality float64
+}
+
+// parseAccept splits an Accept header into its media ranges, q defaults to 1
+func parseAccept(accept string) []mediaRange {
+	ranges := make([]mediaRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mr := mediaRange{ Type: strings.ToLower(strings.TrimSpace(params[0])), Quality: 1 }
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					mr.Quality = q
+				}
+			}
+		}
+		if mr.Type != "" {
+			ranges = append(ranges, mr)
+		}
+	}
+	return ranges
+}
+
+// acceptQuality returns the q of the most specific range matching mimeType (0 if none match)
+func acceptQuality(ranges []mediaRange, mimeType string) float64 {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	slash := strings.Index(mimeType, "/")
+	best, bestSpecificity := 0.0, -1
+
+	for _, mr := range ranges {
+		specificity := -1
+		switch {
+		case mr.Type == mimeType:
+			specificity = 2
+		case slash != -1 && mr.Type == mimeType[:slash] + "/*":
+			specificity = 1
+		case mr.Type == "*/*":
+			specificity = 0
+		}
+		if specificity > bestSpecificity {
+			best, bestSpecificity = mr.Quality, specificity
+		}
+	}
+	return best
+}
+
+// isCompressible checks whether content of mimeType is worth compressing, using the resources CompressibleTypes (or
+// DefaultCompressibleTypes)
+func isCompressible(mimeType string, rsc *ServerResource) bool {
+	compressibleTypes := rsc.CompressibleTypes
+	if len(compressibleTypes) == 0 {
+		compressibleTypes = DefaultCompressibleTypes
+	}
+
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	for _, compressible := range compressibleTypes {
+		compressible = strings.ToLower(compressible)
+		if compressible == mimeType || strings.HasSuffix(compressible, "/*") && strings.HasPrefix(mimeType, compressible[:len(compressible) - 1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// mimeTypeForName returns the content type for a file name (or just an extension) using the resources MimeTypes and
+// the built in mimeMap, falling back to the resources DefaultMimeType
+func mimeTypeForName(name string, rsc *ServerResource) string {
+	if mimeType, known := lookupMimeType(name, rsc); known {
+		return mimeType
+	}
+	return defaultMimeType(rsc)
+}
+
+// defaultMimeType returns the content type used for unknown extensions, the resources DefaultMimeType or text/plain
+func defaultMimeType(rsc *ServerResource) string {
+	if rsc.DefaultMimeType != "" {
+		return rsc.DefaultMimeType
+	}
 	return PlainTextMimeType
-}
\ No newline at end of file
+}
+
+// lookupMimeType returns the content type for a file name from the resources MimeTypes or the built in mimeMap, the
+// bool is false if neither knows the extension
+func lookupMimeType(name string, rsc *ServerResource) (string, bool) {
+	for key, val := range rsc.MimeTypes {
+		if strings.HasSuffix(name, key) {
+			return val, true
+		}
+	}
+	for key, val := range mimeMap {
+		if strings.HasSuffix(name, key) {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// detectContentType returns the content type for a file based on its extension, sniffing the start of the content
+// (from open) if the extension isn't known
+//
+// Any parameters http.DetectContentType adds are dropped so the resources Charset is used. If the resource has a
+// DefaultMimeType it's used instead of sniffing
+func detectContentType(fileInfo os.FileInfo, rsc *ServerResource, open func() (io.ReadCloser, error)) string {
+	if mimeType, known := lookupMimeType(fileInfo.Name(), rsc); known {
+		return mimeType
+	}
+	if rsc.DefaultMimeType != "" {
+		return rsc.DefaultMimeType
+	}
+
+	reader, err := open()
+	if err != nil {
+		return PlainTextMimeType
+	}
+	defer reader.Close()
+
+	buf := make([]byte, SniffLength)
+	n, _ := io.ReadFull(reader, buf)
+	mimeType := http.DetectContentType(buf[:n])
+	if i := strings.Index(mimeType, ";"); i != -1 {
+		mimeType = mimeType[:i]
+	}
+	return mimeType
+}
@@ -0,0 +1,60 @@
+package reverseproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// type: Middleware
+// ------------------------------------------------------------------------------------------------------------------------
+
+// Middleware wraps a RequestHandler, doing its work before and/or after calling it
+type Middleware func(handler RequestHandler) RequestHandler
+
+// RequestHandlerFunc lets a plain function be used as a RequestHandler
+type RequestHandlerFunc func(w http.ResponseWriter, req *http.Request)
+
+func (this RequestHandlerFunc) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	this(w, req)
+}
+
+var (
+	// middlewares holds the Middleware added with RegisterMiddleware
+	middlewares = make(map[string]Middleware)
+	middlewaresMutex sync.RWMutex
+)
+
+// Chain wraps handler in middleware, the first runs first (it's outermost)
+func Chain(handler RequestHandler, middleware ...Middleware) RequestHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// RegisterMiddleware adds a Middleware which ServerBlocks & ServerResources can reference by name
+//
+// Registering a name again replaces it
+func RegisterMiddleware(name string, middleware Middleware) {
+	middlewaresMutex.Lock()
+	defer middlewaresMutex.Unlock()
+	middlewares[name] = middleware
+}
+
+// lookupMiddleware returns the Middleware registered for each name, in order
+func lookupMiddleware(names []string) ([]Middleware, error) {
+	middlewaresMutex.RLock()
+	defer middlewaresMutex.RUnlock()
+
+	chain := make([]Middleware, 0, len(names))
+	for _, name := range names {
+		middleware, present := middlewares[name]
+		if !present {
+			return nil, fmt.Errorf("Unknown Middleware: %s", name)
+		}
+		chain = append(chain, middleware)
+	}
+	return chain, nil
+}
@@ -1,6 +1,8 @@
 package reverseproxy
 
 import (
+	"bufio"
+	"errors"
 	"testing"
 	"fmt"
 	"net/http"
@@ -8,6 +10,28 @@ import (
 	"github.com/seanjohnno/memcache"
 	"strconv"
 	"time"
+	"io"
+	"io/ioutil"
+	"bytes"
+	"strings"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"log"
+	"testing/fstest"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -60,6 +84,27 @@ func TestCacheBuilder(t *testing.T) {
 	}
 }
 
+func TestCacheBuilderConcurrent(t *testing.T) {
+	cb := CreateCacheBuilder()
+
+	caches := make([]memcache.Cache, 16)
+	var wg sync.WaitGroup
+	for i := range caches {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			caches[i], _ = cb.CreateCache("Shared", LRUCache, 50)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, cache := range caches {
+		if cache == nil || cache != caches[0] {
+			t.Error(i, "- every goroutine should get the same named cache")
+		}
+	}
+}
+
 // ------------------------------------------------------------------------------------------------------------------------
 // Testing handler_filesystem.go
 // ------------------------------------------------------------------------------------------------------------------------
@@ -105,7 +150,7 @@ func TestFileSystemHandler(t *testing.T) {
 		}
 
 		// Test css mime
-		if contentType, ok := r.Headers["Content-Type"]; !ok || len(contentType) == 0 || contentType[0] != "text/css" {
+		if contentType, ok := r.Headers["Content-Type"]; !ok || len(contentType) == 0 || contentType[0] != "text/css; charset=utf-8" {
 			t.Error("Should have content type of text/html")
 		}
 	
@@ -120,7 +165,7 @@ func TestFileSystemHandler(t *testing.T) {
 		}
 
 		// Test mime type
-		if contentType, ok := r.Headers["Content-Type"]; !ok || len(contentType) == 0 || contentType[0] != "text/html" {
+		if contentType, ok := r.Headers["Content-Type"]; !ok || len(contentType) == 0 || contentType[0] != "text/html; charset=utf-8" {
 			t.Error("Should have content type of text/html")
 		}
 
@@ -166,8 +211,8 @@ func TestFileSystemHandler(t *testing.T) {
 			t.Error("We shouldn't be encoding image types")
 		}
 
-		// Error mapping test
-		if r = HttpGet("/doesntexist.html", fsHandler, t); r == nil || r.RespCode != 200 || r.Data == nil || len(r.Data) == 0 {
+		// Error mapping test (error file is served with the original status code)
+		if r = HttpGet("/doesntexist.html", fsHandler, t); r == nil || r.RespCode != 404 || r.Data == nil || len(r.Data) == 0 {
 			t.Error("/doesntexist.html should have returned error file, returned", strconv.Itoa(r.RespCode))
 		} else if string(r.Data) != "404" {
 			t.Error("/doesntexist.html should be returning the error file /404.txt")
@@ -176,7 +221,7 @@ func TestFileSystemHandler(t *testing.T) {
 		// Test a regex and match order
 		sr.Error = []ErrorRedirect { ErrorRedirect{ Match:"40[0-9]", Path:"/40x.txt" }, ErrorRedirect{ Match:"404", Path:"/404.txt" } }
 		fsHandler.ErrorMappings = CreateErrorMapping(*sr)
-		if r = HttpGet("/doesntexist.html", fsHandler, t); r == nil || r.RespCode != 200 || r.Data == nil || len(r.Data) == 0 {
+		if r = HttpGet("/doesntexist.html", fsHandler, t); r == nil || r.RespCode != 404 || r.Data == nil || len(r.Data) == 0 {
 			t.Error("/doesntexist.html should have returned error file, returned", strconv.Itoa(r.RespCode))
 		} else if string(r.Data) != "40x" {
 			t.Error("/doesntexist.html should be returning the error file /40x.txt")
@@ -184,143 +229,4719 @@ func TestFileSystemHandler(t *testing.T) {
 	}
 }
 
-// ------------------------------------------------------------------------------------------------------------------------
-// Test HttpHandler
-// ------------------------------------------------------------------------------------------------------------------------
+func TestSPAFallback(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
 
-func TestHTTPHandler(t *testing.T) {
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles", SPAFallback: "/index.html" }
+	fsHandler := NewFSHandler(sr, nil, nil)
+	index, _ := ioutil.ReadFile(workingDir + "/testfiles/index.html")
 
-	BaseUrl = "http://localhost:7890"
+	var r *DummyResponseWriter
+	if r = HttpGet("/users/42", fsHandler, t); r == nil || r.RespCode != 200 || string(r.Data) != string(index) {
+		t.Error("Deep link should serve the SPA fallback file")
+	}
 
-	// Start http handler, it'll return the path that its passed
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(r.URL.Path))
-	})
-	go func() {
-		http.ListenAndServe(":7890", nil)
-	}()
+	if r = HttpGet("/static/missing.js", fsHandler, t); r == nil || r.RespCode != 404 {
+		t.Error("Missing asset should still return 404")
+	}
 
-	// Wait for http server to come alive
-	for i := 0; ; i++ {
-		if i == 5 {
-			t.Error("Unable to start http server, can't complete http tests")
-			return
-		
-		} else if resp, err := http.Get("http://localhost:7890"); err == nil && resp.StatusCode == 200 {
-			break
-		}
-		time.Sleep(time.Second)
+	if r = HttpGet("/test.css", fsHandler, t); r == nil || r.RespCode != 200 || r.Headers.Get("Content-Type") != "text/css; charset=utf-8" {
+		t.Error("Existing files should be served as normal")
 	}
 
-	// Create http handler
-	sr := &ServerResource {
-			Match: "/", Type: "http_socket", Path: "http://localhost:7890",
-			Error: []ErrorRedirect { ErrorRedirect{ Match:"40[0-9]", Path:"/40x.txt" }, ErrorRedirect{ Match:"404", Path:"/404.txt" } },
+	// The request still has its own path afterwards, for anything logging it
+	rq, _ := http.NewRequest("GET", BaseUrl + "/users/42", nil)
+	fsHandler.HandleRequest(CreateDummyResponseWriter(), rq)
+	if rq.URL.Path != "/users/42" {
+		t.Error("Request path should have been restored, got", rq.URL.Path)
 	}
-	httpHandler := NewHttpHandler(sr, CreateErrorMapping(*sr))
+}
+
+func TestErrorPageFields(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+
+	// Convenience fields
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles", NotFoundPage: "/404.txt", ServerErrorPage: "/40x.txt" }
+	fsHandler := NewFSHandler(sr, CreateErrorMapping(*sr), nil)
 
-	// Check that our http request is passed to our handler
 	var r *DummyResponseWriter
-	if r = HttpGet("/heyhey", httpHandler, t); r == nil || r.RespCode != 200 || r.Data == nil || len(r.Data) == 0 || string(r.Data) != "/heyhey" {
-		t.Error("Data should be /heyhey")
+	if r = HttpGet("/doesntexist.html", fsHandler, t); r == nil || string(r.Data) != "404" {
+		t.Error("NotFoundPage should have been served for a missing file")
+	}
+	if fsHandler.findErrorFile(503) != "/40x.txt" || fsHandler.findErrorFile(401) != "" {
+		t.Error("ServerErrorPage should only be used for 5xx errors")
+	}
+
+	// Explicit Error entries take precedence
+	sr.Error = []ErrorRedirect { ErrorRedirect{ Match: "40[0-9]", Path: "/40x.txt" } }
+	fsHandler.ErrorMappings = CreateErrorMapping(*sr)
+	if r = HttpGet("/doesntexist.html", fsHandler, t); r == nil || string(r.Data) != "40x" {
+		t.Error("Explicit Error entry should override NotFoundPage")
 	}
 }
 
-// ------------------------------------------------------------------------------------------------------------------------
-// Test Utility/Dummy classes
-// ------------------------------------------------------------------------------------------------------------------------
+func TestErrorPageStatus(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/404.html", []byte("<h1>Not Found</h1>"), 0644)
 
-// DummyResponseWriter
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, Error: []ErrorRedirect { ErrorRedirect{ Match: "404", Path: "/404.html" } } }
+	fsHandler := NewFSHandler(sr, CreateErrorMapping(*sr), nil)
 
-type DummyResponseWriter struct {
-	Headers http.Header
-	Data []byte
-	RespCode int
+	if r := HttpGet("/missing.html", fsHandler, t); r == nil || r.RespCode != 404 {
+		t.Error("Error page should be served with the original 404 status")
+	} else if string(r.Data) != "<h1>Not Found</h1>" || r.Headers.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Error("Error page body should be the custom page")
+	}
 }
 
-func CreateDummyResponseWriter() *DummyResponseWriter {
-	return &DummyResponseWriter { Headers: make(map[string][]string), Data: nil, RespCode: 200 }
+func TestErrorRoot(t *testing.T) {
+	BaseUrl = "http://localhost"
+	content, errors := t.TempDir(), t.TempDir()
+	ioutil.WriteFile(content + "/404.html", []byte("<h1>Content 404</h1>"), 0644)
+	ioutil.WriteFile(errors + "/404.html", []byte("<h1>Shared 404</h1>"), 0644)
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: content, ErrorRoot: errors,
+		Error: []ErrorRedirect { ErrorRedirect{ Match: "404", Path: "/404.html" } },
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1024 * 1024 } }
+	fsHandler := NewFSHandler(sr, CreateErrorMapping(*sr), &MapCacheBuilder{})
+
+	// Content is still served from Path (and cached), the error page from ErrorRoot
+	if r := HttpGet("/404.html", fsHandler, t); r == nil || r.RespCode != 200 || string(r.Data) != "<h1>Content 404</h1>" {
+		t.Error("Content should still come from Path")
+	}
+	if r := HttpGet("/missing.html", fsHandler, t); r == nil || r.RespCode != 404 {
+		t.Error("Error page should be served with the original 404 status")
+	} else if string(r.Data) != "<h1>Shared 404</h1>" {
+		t.Error("Error page should come from the ErrorRoot, got", string(r.Data))
+	}
+
+	if problems := checkConfig([]ServerBlock{ ServerBlock{ Hosts: []Host{ Host{ Host: "localhost", Port: 80 } },
+		Content: []ServerResource{ ServerResource{ Match: "/", Type: "file_system", ErrorRoot: errors + "/missing" } } } });
+		len(problems) != 1 || !strings.Contains(problems[0], "ErrorRoot") {
+		t.Error("A missing ErrorRoot should be a config problem, got", problems)
+	}
 }
 
-func (this *DummyResponseWriter) Header() http.Header {
-	return this.Headers
+func TestTrailingSlashRedirect(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles",
+		FSDefaults: FileSystemDefaults{ DefaultFiles: []string{ "hello.html" }, DefaultExtensions: []string{ ".html" } },
+	}
+	fsHandler := NewFSHandler(sr, nil, nil)
+
+	// Disabled - both forms are served
+	var r *DummyResponseWriter
+	if r = HttpGet("/subdir", fsHandler, t); r == nil || r.RespCode != 404 {
+		t.Error("/subdir shouldn't resolve or redirect when disabled")
+	}
+	if r = HttpGet("/subdir/", fsHandler, t); r == nil || r.RespCode != 200 {
+		t.Error("/subdir/ should be served when disabled")
+	}
+
+	// Add - directory without slash is redirected (query preserved), files are left alone
+	sr.TrailingSlash = TrailingSlashAdd
+	if r = HttpGet("/subdir?page=2", fsHandler, t); r == nil || r.RespCode != 301 || r.Headers.Get("Location") != "/subdir/?page=2" {
+		t.Error("/subdir should redirect to /subdir/")
+	}
+	if r = HttpGet("/index", fsHandler, t); r == nil || r.RespCode != 200 {
+		t.Error("/index isn't a directory so shouldn't be redirected")
+	}
+
+	// Remove - slash is redirected away and the directory is served without it
+	sr.TrailingSlash = TrailingSlashRemove
+	if r = HttpGet("/subdir/", fsHandler, t); r == nil || r.RespCode != 301 || r.Headers.Get("Location") != "/subdir" {
+		t.Error("/subdir/ should redirect to /subdir")
+	}
+	if r = HttpGet("/subdir", fsHandler, t); r == nil || r.RespCode != 200 || !strings.Contains(string(r.Data), "Hello") {
+		t.Error("/subdir should serve the directories default file")
+	}
+
+	// The redirect always stays on this host
+	for _, p := range []string{ "//evil.com/", "///evil.com//", "/\\evil.com/" } {
+		if r = HttpGet(p, fsHandler, t); r == nil || r.RespCode != 301 || r.Headers.Get("Location") != "/evil.com" {
+			t.Error(p, "should redirect to /evil.com, got", r.Headers.Get("Location"))
+		}
+	}
 }
 
-func (this *DummyResponseWriter) Write(newData []byte) (int, error) {
-	this.Data = append(this.Data, newData...)
-	return len(newData), nil
+func TestFileSystemHandlerMethods(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+	fsHandler := NewFSHandler(&ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles" }, nil, nil)
+
+	request := func(method string) *DummyResponseWriter {
+		rq, _ := http.NewRequest(method, BaseUrl + "/index.html", nil)
+		rw := CreateDummyResponseWriter()
+		fsHandler.HandleRequest(rw, rq)
+		return rw
+	}
+
+	get := request("GET")
+	if get.RespCode != 200 || len(get.Data) == 0 {
+		t.Error("GET should return the file")
+	}
+
+	if head := request("HEAD"); head.RespCode != 200 || len(head.Data) != 0 {
+		t.Error("HEAD should return 200 with no body")
+	} else if head.Headers.Get("Content-Type") != get.Headers.Get("Content-Type") || head.Headers.Get("Last-Modified") != get.Headers.Get("Last-Modified") {
+		t.Error("HEAD should return the same headers as GET")
+	}
+
+	if post := request("POST"); post.RespCode != http.StatusMethodNotAllowed || len(post.Data) != 0 {
+		t.Error("POST should return 405")
+	} else if post.Headers.Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Error("405 should list the allowed methods")
+	}
 }
 
-func (this *DummyResponseWriter) WriteHeader(respCode int) {
-	this.RespCode = respCode
+func TestHeadRequests(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+	gzipHeaders := map[string][]string{ "Accept-Encoding": []string{ "gzip" } }
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	fsResource := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles", Compression: true }
+	httpResource := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }
+	handlers := map[string]RequestHandler { "/test.css": NewFSHandler(fsResource, nil, nil), "/hello": NewHttpHandler(httpResource, nil) }
+
+	for path, handler := range handlers {
+		for _, headers := range []map[string][]string{ nil, gzipHeaders } {
+			get := HttpGetWithHeaders(path, handler, headers, t)
+
+			rq, _ := http.NewRequest("HEAD", BaseUrl + path, nil)
+			for k, v := range headers {
+				rq.Header[k] = v
+			}
+			head := CreateDummyResponseWriter()
+			handler.HandleRequest(head, rq)
+
+			if head.RespCode != 200 || len(head.Data) != 0 {
+				t.Error(path, "- HEAD should return 200 with an empty body")
+			}
+			// Files aren't read (or compressed) for HEAD so there's no length for gzip'd static content
+			if cl := head.Headers.Get("Content-Length"); path == "/test.css" && headers != nil {
+				if cl != "" {
+					t.Error(path, "- Compressed HEAD shouldn't have a Content-Length, was", cl)
+				}
+			} else if cl == "" || cl != strconv.Itoa(len(get.Data)) {
+				t.Error(path, "- HEAD Content-Length should match the GET body length, was", cl)
+			}
+			if head.Headers.Get("Content-Encoding") != get.Headers.Get("Content-Encoding") || head.Headers.Get("Content-Type") != get.Headers.Get("Content-Type") {
+				t.Error(path, "- HEAD should return the same headers as GET")
+			}
+		}
+	}
 }
 
-// DummyCacheBuilder
+func TestOptionsRequests(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
 
-type DummyCacheBuilder struct {
-	Cache *DummyCache
+	options := func(handler RequestHandler, headers map[string]string) *DummyResponseWriter {
+		rq, _ := http.NewRequest("OPTIONS", BaseUrl + "/index.html", nil)
+		for k, v := range headers {
+			rq.Header.Set(k, v)
+		}
+		rw := CreateDummyResponseWriter()
+		handler.HandleRequest(rw, rq)
+		return rw
+	}
+
+	// Static resource
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles", CORS: CORSConfig{ AllowedOrigins: []string{ "*" } } }
+	fsHandler := NewFSHandler(sr, nil, nil)
+	if r := options(fsHandler, nil); r.RespCode != http.StatusNoContent || len(r.Data) != 0 {
+		t.Error("OPTIONS should return 204 with no body")
+	} else if r.Headers.Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Error("OPTIONS should list the allowed methods, listed", r.Headers.Get("Allow"))
+	}
+
+	// With CORS a plain OPTIONS still gets the Allow header (+ Allow-Origin), preflights are answered by the CORS handler
+	corsHandler := NewCORSHandler(fsHandler, sr)
+	if r := options(corsHandler, map[string]string{ "Origin": "https://app.example.com" }); r.RespCode != http.StatusNoContent || r.Headers.Get("Allow") != "GET, HEAD, OPTIONS" || r.Headers.Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("OPTIONS with an origin should return Allow and Access-Control-Allow-Origin")
+	}
+	if r := options(corsHandler, map[string]string{ "Origin": "https://app.example.com", "Access-Control-Request-Method": "GET" }); r.RespCode != http.StatusNoContent || r.Headers.Get("Access-Control-Allow-Methods") == "" {
+		t.Error("Preflight should be answered by the CORS handler")
+	}
+
+	// Proxied resource passes through to the backend
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Allow", "GET, POST, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer backend.Close()
+	httpHandler := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }, nil)
+	if r := options(httpHandler, nil); r.RespCode != http.StatusNoContent || r.Headers.Get("Allow") != "GET, POST, OPTIONS" {
+		t.Error("OPTIONS should be passed through to the backend, returned", r.RespCode, r.Headers.Get("Allow"))
+	}
 }
 
-func (this *DummyCacheBuilder) CreateCache(cacheName string, cacheType string, cacheLimit int) (memcache.Cache, error) {
-	this.Cache = &DummyCache{}
-	return this.Cache, nil
+func TestErrorPageCacheHeaders(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/404.html", []byte("<h1>Not Found</h1>"), 0644)
+	ioutil.WriteFile(dir + "/page.html", []byte("page"), 0644)
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, NotFoundPage: "/404.html" }
+	fsHandler := NewFSHandler(sr, CreateErrorMapping(*sr), nil)
+	ifModified := map[string][]string{ "If-Modified-Since": { time.Now().Add(time.Hour).In(GMTLoc).Format(time.RFC1123) } }
+
+	if r := HttpGetWithHeaders("/missing.html", fsHandler, ifModified, t); r.RespCode != 404 || string(r.Data) != "<h1>Not Found</h1>" {
+		t.Error("Error page should be served in full with a 404")
+	} else if r.Headers.Get("Cache-Control") != ValueCacheControlError || r.Headers.Get("Last-Modified") != "" || r.Headers.Get("Expires") != "" {
+		t.Error("Error page should only be sent with Cache-Control: no-store, got:", r.Headers)
+	}
+
+	// No error page configured
+	bare := NewFSHandler(&ServerResource { Match: "/", Type: "file_system", Path: dir }, nil, nil)
+	if r := HttpGet("/missing.html", bare, t); r.RespCode != 404 || r.Headers.Get("Cache-Control") != ValueCacheControlError {
+		t.Error("Bare error status should be sent with Cache-Control: no-store, got:", r.Headers)
+	}
+
+	// Normal files keep the revalidation headers
+	if r := HttpGet("/page.html", fsHandler, t); r.Headers.Get("Cache-Control") != ValueCacheControl || r.Headers.Get("Last-Modified") == "" {
+		t.Error("Files should still be sent with revalidation headers, got:", r.Headers)
+	}
 }
 
-// DummyCache
+func TestContentTypeFromLoader(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/module.wasm", []byte("wasm"), 0644)
+	ioutil.WriteFile(dir + "/page.html", []byte("page"), 0644)
 
-type DummyCache struct {
-	lastAddKey string
-	lastAddVal memcache.CacheItem
-	lastGetKey string
-	lastRemoveKey string
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir,
+		MimeTypes: map[string]string{ ".wasm": "application/wasm", ".html": "text/html; charset=utf-8" } }
+	fsHandler := NewFSHandler(sr, nil, nil)
+
+	// Header comes from the loaders MimeType rather than being recomputed from the extension
+	fc, _ := fsHandler.FileAccessor.GetFile(httptest.NewRequest("GET", "/module.wasm", nil), sr, false)
+	fc.MimeType = "application/x-from-loader"
+	w := CreateDummyResponseWriter()
+	fsHandler.writeFile(w, httptest.NewRequest("GET", "/module.wasm", nil), fc, http.StatusOK)
+	if w.Headers.Get("Content-Type") != "application/x-from-loader" {
+		t.Error("Content-Type should come from FileContent.MimeType, got:", w.Headers.Get("Content-Type"))
+	}
+
+	// Custom types override and extend the built in ones
+	if r := HttpGet("/module.wasm", fsHandler, t); r.Headers.Get("Content-Type") != "application/wasm" {
+		t.Error("Expected custom wasm type, got:", r.Headers.Get("Content-Type"))
+	}
+	if r := HttpGet("/page.html", fsHandler, t); r.Headers.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Error("Expected overridden html type, got:", r.Headers.Get("Content-Type"))
+	}
 }
 
-func (this *DummyCache) Add(key string, val memcache.CacheItem) error {
-	this.lastAddKey = key
-	this.lastAddVal = val
-	return nil
+func TestContentTypeCharset(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/page.html", []byte("page"), 0644)
+	ioutil.WriteFile(dir + "/image.png", []byte("png"), 0644)
+
+	fsHandler := NewFSHandler(&ServerResource { Match: "/", Type: "file_system", Path: dir }, nil, nil)
+	if r := HttpGet("/page.html", fsHandler, t); r.Headers.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Error("Text types should have charset=utf-8, got:", r.Headers.Get("Content-Type"))
+	}
+	if r := HttpGet("/image.png", fsHandler, t); r.Headers.Get("Content-Type") != "image/png" {
+		t.Error("Image types shouldn't have a charset, got:", r.Headers.Get("Content-Type"))
+	}
+
+	latin := NewFSHandler(&ServerResource { Match: "/", Type: "file_system", Path: dir, Charset: "iso-8859-1" }, nil, nil)
+	if r := HttpGet("/page.html", latin, t); r.Headers.Get("Content-Type") != "text/html; charset=iso-8859-1" {
+		t.Error("Configured charset should be used, got:", r.Headers.Get("Content-Type"))
+	}
 }
 
-func (this *DummyCache) Get(key string) (memcache.CacheItem, bool) {
-	this.lastGetKey = key
-	return nil, false
+func TestHeadWithoutReadingFile(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/large.html", bytes.Repeat([]byte("<p>large</p>"), 100000), 0644)
+	info, _ := os.Stat(dir + "/large.html")
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, Compression: true }
+	fsHandler := NewFSHandler(sr, nil, nil)
+	counting := &CountingRetriever{ Wrapped: fsHandler.FileAccessor }
+	fsHandler.FileAccessor = counting
+
+	head := func(headers map[string][]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", "http://localhost/large.html", nil)
+		for k, v := range headers {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		fsHandler.HandleRequest(rec, req)
+		return rec
+	}
+
+	rec := head(nil)
+	if rec.Code != 200 || rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != strconv.FormatInt(info.Size(), 10) {
+		t.Error("HEAD should report the file size with no body, got:", rec.Code, rec.Header())
+	}
+	if rec.Header().Get("Content-Type") != "text/html; charset=utf-8" || rec.Header().Get("Last-Modified") == "" || rec.Header().Get("Cache-Control") != ValueCacheControl {
+		t.Error("HEAD should have content type and caching headers, got:", rec.Header())
+	}
+
+	// Compressed, encoding but no length (we'd have to compress to know it)
+	rec = head(map[string][]string{ "Accept-Encoding": { "gzip" } })
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Content-Length") != "" {
+		t.Error("Compressed HEAD should have Content-Encoding and no Content-Length, got:", rec.Header())
+	}
+
+	// Not modified
+	rec = head(map[string][]string{ "If-Modified-Since": { rec.Header().Get("Last-Modified") } })
+	if rec.Code != http.StatusNotModified {
+		t.Error("HEAD with If-Modified-Since should be 304, got:", rec.Code)
+	}
+
+	if counting.Reads != 0 {
+		t.Error("HEAD shouldn't read the file, read", counting.Reads, "times")
+	}
 }
 
-func (this *DummyCache) Remove(key string) {
-	this.lastRemoveKey = key
+func TestIsModifiedSince(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/file.html", []byte("file"), 0644)
+	modTime := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+	os.Chtimes(dir + "/file.html", modTime, modTime)
+	fi, _ := os.Stat(dir + "/file.html")
+
+	check := func(value string) bool {
+		req := httptest.NewRequest("GET", "http://localhost/file.html", nil)
+		req.Header[HeaderIfModifiedSince] = []string{ value }
+		return isModifiedSince(req, "/file.html", fi)
+	}
+
+	// All three HTTP date formats
+	for _, value := range []string{ "Sun, 06 Nov 1994 08:49:37 GMT", "Sunday, 06-Nov-94 08:49:37 GMT", "Sun Nov  6 08:49:37 1994" } {
+		if check(value) {
+			t.Error("File should be unmodified for", value)
+		}
+	}
+	if !check("Sun, 06 Nov 1994 08:49:38 GMT") {
+		t.Error("Different time should be treated as modified")
+	}
+
+	// Empty and malformed values don't panic, they're treated as modified
+	for _, value := range []string{ "", "x", "Sun", "not a date at all" } {
+		if !check(value) {
+			t.Error("Malformed value should be treated as modified:", value)
+		}
+	}
+	if !isModifiedSince(httptest.NewRequest("GET", "http://localhost/file.html", nil), "/file.html", fi) {
+		t.Error("No header should be treated as modified")
+	}
 }
 
-// Utility http request functions
+func TestNotModifiedWithCompression(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/page.html", []byte("<p>page</p>"), 0644)
 
-func HttpGet(path string, handler RequestHandler, t *testing.T) (*DummyResponseWriter) {
-	return HttpGetWithHeaders(path, handler, nil, t)
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, Compression: true }
+	fsHandler := NewFSHandler(sr, nil, nil)
+
+	get := HttpGetWithHeaders("/page.html", fsHandler, map[string][]string{ "Accept-Encoding": { "gzip" } }, t)
+	lastModified := get.Headers.Get("Last-Modified")
+
+	for _, method := range []string{ "GET", "HEAD" } {
+		req := httptest.NewRequest(method, "http://localhost/page.html", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("If-Modified-Since", lastModified)
+		w := CreateDummyResponseWriter()
+		w.Headers.Set("ETag", "\"abc\"")
+		fsHandler.HandleRequest(w, req)
+
+		if w.RespCode != http.StatusNotModified || len(w.Data) != 0 {
+			t.Error(method, "- Expected a 304 with no body, got:", w.RespCode, len(w.Data))
+		}
+		if w.Headers.Get("Content-Encoding") != "" || w.Headers.Get("Content-Length") != "" || w.Headers.Get("Content-Type") != "" {
+			t.Error(method, "- 304 shouldn't describe a body, got:", w.Headers)
+		}
+		if w.Headers.Get("Last-Modified") != lastModified || w.Headers.Get("ETag") != "\"abc\"" {
+			t.Error(method, "- 304 should keep the validators, got:", w.Headers)
+		}
+	}
 }
 
-func HttpGetWithHeaders(path string, handler RequestHandler, headers map[string][]string, t *testing.T) (*DummyResponseWriter) {
-	if rq, err := http.NewRequest("GET", BaseUrl + path, nil); err != nil {
-		t.Error("Failed to create request " + path)
-		return nil
-	} else {
-		// Add additional headers
-		if headers != nil {
-			for k, v := range headers {
-				rq.Header[k] = v
+func TestVaryAcceptEncoding(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/page.html", []byte("<p>page</p>"), 0644)
+	ioutil.WriteFile(dir + "/image.png", []byte("png"), 0644)
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, Compression: true }
+	fsHandler := NewFSHandler(sr, nil, nil)
+	gzipHeaders := map[string][]string{ "Accept-Encoding": { "gzip" } }
+
+	// Compressible content varies whether or not this client asked for gzip
+	for _, headers := range []map[string][]string{ gzipHeaders, nil } {
+		if r := HttpGetWithHeaders("/page.html", fsHandler, headers, t); r.Headers.Get("Vary") != "Accept-Encoding" {
+			t.Error("Vary: Accept-Encoding should be set on compressible content, got", r.Headers["Vary"])
+		}
+	}
+
+	// Content which is never compressed doesn't vary
+	if r := HttpGetWithHeaders("/image.png", fsHandler, gzipHeaders, t); len(r.Headers["Vary"]) != 0 {
+		t.Error("Vary shouldn't be set for non-compressible content, got", r.Headers["Vary"])
+	}
+}
+
+func TestWellKnownDefaults(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/index.html", []byte("<p>index</p>"), 0644)
+
+	// Off by default, missing files 404
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir }
+	fsHandler := NewFSHandler(sr, nil, nil)
+	for _, p := range []string{ "/robots.txt", "/favicon.ico" } {
+		if r := HttpGet(p, fsHandler, t); r.RespCode != http.StatusNotFound {
+			t.Error(p, "should 404 without WellKnownDefaults, got", r.RespCode)
+		}
+	}
+
+	sr.WellKnownDefaults = true
+	if r := HttpGet("/robots.txt", fsHandler, t); r.RespCode != 200 || string(r.Data) != "User-agent: *\nDisallow:\n" ||
+		r.Headers.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Error("Default robots.txt should be served, got", r.RespCode, string(r.Data))
+	}
+	if r := HttpGet("/favicon.ico", fsHandler, t); r.RespCode != 200 || len(r.Data) == 0 || r.Headers.Get("Content-Type") != "image/x-icon" {
+		t.Error("Default favicon.ico should be served, got", r.RespCode)
+	}
+	if r := HttpGet("/missing.txt", fsHandler, t); r.RespCode != http.StatusNotFound {
+		t.Error("Other missing files should still 404, got", r.RespCode)
+	}
+
+	// A real file takes priority
+	ioutil.WriteFile(dir + "/robots.txt", []byte("User-agent: *\nDisallow: /\n"), 0644)
+	if r := HttpGet("/robots.txt", fsHandler, t); string(r.Data) != "User-agent: *\nDisallow: /\n" {
+		t.Error("Existing robots.txt should be served instead of the default, got", string(r.Data))
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/404.html", []byte("<p>missing</p>"), 0644)
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, ErrorFormat: ErrorFormatJSON,
+		Error: []ErrorRedirect{ ErrorRedirect{ Match: "404", Path: "/404.html" } } }
+	fsHandler := NewFSHandler(sr, CreateErrorMapping(*sr), nil)
+
+	// JSON replaces the error page
+	r := HttpGet("/missing", fsHandler, t)
+	if r.RespCode != 404 || r.Headers.Get("Content-Type") != "application/json" {
+		t.Error("Expected a JSON 404, got", r.RespCode, r.Headers.Get("Content-Type"))
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(r.Data, &body); err != nil || body["error"] != "not found" || body["status"] != float64(404) {
+		t.Error("Unexpected JSON error body:", string(r.Data))
+	}
+
+	sr.ErrorFormat = ErrorFormatText
+	if r := HttpGet("/missing", fsHandler, t); r.RespCode != 404 || string(r.Data) != "404 not found\n" || r.Headers.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Error("Expected a text 404, got", r.RespCode, string(r.Data))
+	}
+
+	// Default is still the error page
+	sr.ErrorFormat = ""
+	if r := HttpGet("/missing", fsHandler, t); r.RespCode != 404 || string(r.Data) != "<p>missing</p>" {
+		t.Error("Expected the error page, got", r.RespCode, string(r.Data))
+	}
+}
+
+func TestCompressedContentLength(t *testing.T) {
+	BaseUrl = "http://localhost"
+	workingDir, _ := os.Getwd()
+	gzipHeaders := map[string][]string{ "Accept-Encoding": []string{ "gzip" } }
+	info, _ := os.Stat(workingDir + "/testfiles/test.css")
+
+	// Compressed straight from disk, from an identity-only cache and from a compressed-only cache
+	resources := map[string]*ServerResource {
+		"no cache": &ServerResource{ Match: "/", Type: "file_system", Path: workingDir + "/testfiles", Compression: true },
+		"identity cache": &ServerResource{ Match: "/", Type: "file_system", Path: workingDir + "/testfiles", Compression: true,
+			Cache: CacheStrategy{ Strategy: "lru", Limit: 4096, Store: CacheStoreIdentity } },
+		"compressed cache": &ServerResource{ Match: "/", Type: "file_system", Path: workingDir + "/testfiles", Compression: true,
+			Cache: CacheStrategy{ Strategy: "lru", Limit: 4096, Store: CacheStoreCompressed } },
+	}
+	for name, sr := range resources {
+		fsHandler := NewFSHandler(sr, nil, &MapCacheBuilder{})
+		for i := 0; i < 2; i++ {
+			r := HttpGetWithHeaders("/test.css", fsHandler, gzipHeaders, t)
+			if r == nil || r.RespCode != 200 || r.Headers.Get("Content-Encoding") != "gzip" {
+				t.Error(name, "- expected a gzip response")
+			} else if cl := r.Headers.Get("Content-Length"); cl != strconv.Itoa(len(r.Data)) {
+				t.Error(name, "- Content-Length should be the compressed length", len(r.Data), "was", cl)
+			} else if cl == strconv.FormatInt(info.Size(), 10) {
+				t.Error(name, "- Content-Length is the uncompressed size")
 			}
 		}
+	}
+}
 
-		rw := CreateDummyResponseWriter()
-		handler.HandleRequest(rw, rq)
-		return rw
+func TestResourceCacheControl(t *testing.T) {
+	BaseUrl = "http://localhost"
+	workingDir, _ := os.Getwd()
+
+	// Default when unset
+	sr := &ServerResource{ Match: "/", Type: "file_system", Path: workingDir + "/testfiles" }
+	if r := HttpGet("/test.css", NewFSHandler(sr, nil, nil), t); r.Headers.Get("Cache-Control") != ValueCacheControl || r.Headers.Get("Expires") != ValueExpires {
+		t.Error("Default cache headers expected, got", r.Headers.Get("Cache-Control"), r.Headers.Get("Expires"))
+	}
+
+	// Expires follows max-age
+	sr.CacheControl = "public, max-age=31536000, immutable"
+	before := time.Now().Add(31536000 * time.Second).Truncate(time.Second)
+	r := HttpGet("/test.css", NewFSHandler(sr, nil, nil), t)
+	if r.Headers.Get("Cache-Control") != sr.CacheControl {
+		t.Error("Configured Cache-Control expected, got", r.Headers.Get("Cache-Control"))
+	}
+	if expires, err := time.Parse(time.RFC1123, r.Headers.Get("Expires")); err != nil || expires.Before(before) || expires.After(before.Add(5 * time.Second)) {
+		t.Error("Expires should be a year away, got", r.Headers.Get("Expires"))
+	}
+
+	// No max-age means no freshness
+	sr.CacheControl = "no-cache"
+	if r := HttpGet("/test.css", NewFSHandler(sr, nil, nil), t); r.Headers.Get("Cache-Control") != "no-cache" || r.Headers.Get("Expires") != ValueExpires {
+		t.Error("no-cache should be sent already expired, got", r.Headers.Get("Cache-Control"), r.Headers.Get("Expires"))
+	}
+
+	// Errors are still never cached
+	sr.CacheControl = "public, max-age=60"
+	if r := HttpGet("/missing.css", NewFSHandler(sr, nil, nil), t); r.RespCode != 404 || r.Headers.Get("Cache-Control") != ValueCacheControlError {
+		t.Error("Errors shouldn't use the resources Cache-Control, got", r.Headers.Get("Cache-Control"))
 	}
 }
 
+func TestFingerprintCacheControl(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/app.3f9a12bc.js", []byte("var a;"), 0644)
+	ioutil.WriteFile(dir + "/app.js", []byte("var a;"), 0644)
 
+	sr := &ServerResource{ Match: "/", Type: "file_system", Path: dir, Fingerprint: `\.[0-9a-f]{8,}\.(js|css)$` }
+	fsHandler := NewFSHandler(sr, nil, nil)
 
-// Write test for server.go
+	if r := HttpGet("/app.3f9a12bc.js", fsHandler, t); r.Headers.Get("Cache-Control") != ValueCacheControlImmutable {
+		t.Error("Fingerprinted file should be immutable, got", r.Headers.Get("Cache-Control"))
+	} else if expires, err := time.Parse(time.RFC1123, r.Headers.Get("Expires")); err != nil || expires.Before(time.Now().Add(364 * 24 * time.Hour)) {
+		t.Error("Fingerprinted file should expire in a year, got", r.Headers.Get("Expires"))
+	}
 
-// Write test for loader_file.go
+	if r := HttpGet("/app.js", fsHandler, t); r.Headers.Get("Cache-Control") != ValueCacheControlShort {
+		t.Error("Plain file should get a short TTL, got", r.Headers.Get("Cache-Control"))
+	} else if expires, err := time.Parse(time.RFC1123, r.Headers.Get("Expires")); err != nil || expires.After(time.Now().Add(6 * time.Minute)) {
+		t.Error("Plain file should expire within minutes, got", r.Headers.Get("Expires"))
+	}
+
+	// The resources own CacheControl is used for plain files
+	sr.CacheControl = "no-cache"
+	if r := HttpGet("/app.js", NewFSHandler(sr, nil, nil), t); r.Headers.Get("Cache-Control") != "no-cache" {
+		t.Error("Plain file should use CacheControl when set, got", r.Headers.Get("Cache-Control"))
+	}
+
+	sr.Fingerprint = "("
+	if problems := checkConfig([]ServerBlock{ ServerBlock{ Hosts: []Host{ Host{ Host: "localhost", Port: 80 } }, Content: []ServerResource{ *sr } } }); len(problems) != 1 {
+		t.Error("Invalid Fingerprint should be a problem, got", problems)
+	}
+}
 
-// Write test for loader_cache.go
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing loader_file.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestPrecompressedFiles(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	gzipHeaders := map[string][]string{ "Accept-Encoding": []string{ "gzip" } }
+
+	// app.js has a precompressed sibling (with different content so we can tell which was served), other.js doesn't
+	ioutil.WriteFile(dir + "/app.js", []byte("runtime"), 0644)
+	ioutil.WriteFile(dir + "/other.js", []byte("runtime"), 0644)
+	precompressed, _ := compressData([]byte("precompressed"), gzip.DefaultCompression)
+	ioutil.WriteFile(dir + "/app.js.gz", precompressed, 0644)
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, Compression: true }
+	fsHandler := NewFSHandler(sr, nil, nil)
+	appInfo, _ := os.Stat(dir + "/app.js")
+
+	var r *DummyResponseWriter
+	if r = HttpGetWithHeaders("/app.js", fsHandler, gzipHeaders, t); r == nil || r.RespCode != 200 || r.Headers.Get("Content-Encoding") != "gzip" {
+		t.Error("/app.js should be served gzip encoded")
+	} else if data, _ := decompressData(r.Data); string(data) != "precompressed" {
+		t.Error("/app.js should have been served from app.js.gz, served", string(data))
+	} else if r.Headers.Get("Last-Modified") != appInfo.ModTime().In(GMTLoc).Format(time.RFC1123) {
+		t.Error("Last-Modified should match the original file")
+	}
+
+	if r = HttpGetWithHeaders("/other.js", fsHandler, gzipHeaders, t); r == nil || r.RespCode != 200 || r.Headers.Get("Content-Encoding") != "gzip" {
+		t.Error("/other.js should be served gzip encoded")
+	} else if data, _ := decompressData(r.Data); string(data) != "runtime" {
+		t.Error("/other.js should have been compressed at runtime, served", string(data))
+	}
+
+	// Client that can't accept gzip gets the original
+	if r = HttpGet("/app.js", fsHandler, t); r == nil || r.RespCode != 200 || string(r.Data) != "runtime" {
+		t.Error("/app.js should be served uncompressed without Accept-Encoding")
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	gzipHeaders := map[string][]string{ "Accept-Encoding": []string{ "gzip" } }
+
+	// Repetitive but not trivially so, enough for the levels to differ
+	content := &bytes.Buffer{}
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(content, "line %d: %d %s\n", i, (i * 7919) % 1013, strings.Repeat("ab", i % 17))
+	}
+	ioutil.WriteFile(dir + "/big.txt", content.Bytes(), 0644)
+
+	sizes := make(map[int]int)
+	for _, level := range []int{ gzip.BestSpeed, gzip.BestCompression } {
+		sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, Compression: true, CompressionLevel: level }
+		r := HttpGetWithHeaders("/big.txt", NewFSHandler(sr, nil, nil), gzipHeaders, t)
+		if data, _ := decompressData(r.Data); string(data) != content.String() {
+			t.Error("Compressed content should decompress to the original at level", level)
+		}
+		sizes[level] = len(r.Data)
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Error("Higher level should give smaller output:", sizes)
+	}
+
+	// Invalid levels are rejected when loading config
+	if _, err := LoadConfigFromReader(strings.NewReader(`[{"Content": [{"Match": "/", "Compression": true, "CompressionLevel": 10}]}]`)); err == nil {
+		t.Error("CompressionLevel 10 should fail validation")
+	}
+	if _, err := LoadConfigFromReader(strings.NewReader(`[{"Content": [{"Match": "/", "Compression": true, "CompressionLevel": 9}]}]`)); err != nil {
+		t.Error("CompressionLevel 9 should be valid:", err)
+	}
+}
+
+func TestNegotiateExtensions(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/data.html", []byte("html"), 0644)
+	ioutil.WriteFile(dir + "/data.json", []byte("json"), 0644)
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, Cache: CacheStrategy{ Name: "negotiate", Strategy: "lru", Limit: 1024 },
+		FSDefaults: FileSystemDefaults{ DefaultExtensions: []string{ ".html", ".json" }, NegotiateExtensions: true } }
+	fsHandler := NewFSHandler(sr, nil, &MapCacheBuilder{})
+
+	cases := []struct{ accept string; expected string }{
+		{ "application/json", "json" },
+		{ "text/html", "html" },
+		{ "text/html;q=0.5, application/json", "json" },
+		{ "application/*", "json" },
+		{ "*/*", "html" },
+		{ "", "html" },
+	}
+	for _, c := range cases {
+		headers := map[string][]string{}
+		if c.accept != "" {
+			headers["Accept"] = []string{ c.accept }
+		}
+		if r := HttpGetWithHeaders("/data", fsHandler, headers, t); string(r.Data) != c.expected {
+			t.Error("Accept:", c.accept, "should resolve to data." + c.expected, "got:", string(r.Data))
+		} else if r.Headers.Get("Vary") != "Accept" {
+			t.Error("Accept:", c.accept, "negotiated responses should Vary on Accept, got:", r.Headers.Get("Vary"))
+		}
+	}
+
+	// Explicit extensions aren't negotiated
+	if r := HttpGetWithHeaders("/data.json", fsHandler, map[string][]string{ "Accept": { "text/html" } }, t); r.Headers.Get("Vary") != "" {
+		t.Error("A path with an extension shouldn't Vary on Accept")
+	}
+
+	// Config order when negotiation is off
+	sr.FSDefaults.NegotiateExtensions = false
+	if r := HttpGetWithHeaders("/data", NewFSHandler(sr, nil, &MapCacheBuilder{}), map[string][]string{ "Accept": { "application/json" } }, t); string(r.Data) != "html" {
+		t.Error("Without negotiation the first DefaultExtension should be used")
+	} else if r.Headers.Get("Vary") != "" {
+		t.Error("Without negotiation there's nothing to Vary on")
+	}
+}
+
+func TestContentTypeSniffing(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	workingDir, _ := os.Getwd()
+	png, _ := ioutil.ReadFile(workingDir + "/testfiles/gopher.png")
+	ioutil.WriteFile(dir + "/gopher", png, 0644)
+	ioutil.WriteFile(dir + "/notes", []byte("just some text"), 0644)
+	ioutil.WriteFile(dir + "/page.html", png, 0644)
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir }
+	fsHandler := NewFSHandler(sr, nil, nil)
+
+	// Unknown extensions are sniffed, for GET & HEAD
+	for _, method := range []string{ "GET", "HEAD" } {
+		req := httptest.NewRequest(method, "http://localhost/gopher", nil)
+		w := CreateDummyResponseWriter()
+		fsHandler.HandleRequest(w, req)
+		if ct := w.Headers.Get("Content-Type"); ct != "image/png" {
+			t.Error(method, "should have detected image/png, got", ct)
+		}
+	}
+	if r := HttpGet("/notes", fsHandler, t); r.Headers.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Error("Text without an extension should be text/plain, got", r.Headers.Get("Content-Type"))
+	}
+
+	// ...but a known extension is authoritative
+	if r := HttpGet("/page.html", fsHandler, t); r.Headers.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Error("Known extension should win over sniffing, got", r.Headers.Get("Content-Type"))
+	}
+}
+
+func TestHostPlaceholder(t *testing.T) {
+	dir := t.TempDir()
+	for _, host := range []string{ "site-a.com", "site-b.com" } {
+		os.Mkdir(dir + "/" + host, 0755)
+		ioutil.WriteFile(dir + "/" + host + "/index.html", []byte(host), 0644)
+	}
+	ioutil.WriteFile(dir + "/index.html", []byte("parent"), 0644)
+
+	get := func(handler RequestHandler, method string, host string) *DummyResponseWriter {
+		req := httptest.NewRequest(method, "http://localhost/index.html", nil)
+		req.Host = host
+		w := CreateDummyResponseWriter()
+		handler.HandleRequest(w, req)
+		return w
+	}
+
+	uncached := &ServerResource { Match: "/", Type: "file_system", Path: dir + "/{host}" }
+	cached := &ServerResource { Match: "/", Type: "file_system", Path: dir + "/{host}",
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1024 * 1024 } }
+
+	for _, handler := range []RequestHandler{ NewFSHandler(uncached, nil, nil), NewFSHandler(cached, nil, &MapCacheBuilder{}) } {
+
+		// Each host resolves to its own directory (port & case don't matter)
+		for _, host := range []string{ "site-a.com", "SITE-B.com:8080" } {
+			if r := get(handler, "GET", host); r.RespCode != 200 || string(r.Data) != strings.ToLower(strings.Split(host, ":")[0]) {
+				t.Error("Host", host, "should serve its own file, got", r.RespCode, string(r.Data))
+			}
+		}
+
+		// Hosts which could escape the directory are rejected
+		for _, host := range []string{ "..", "site-a.com/..", "..\\", ".", "a..b", "" } {
+			for _, method := range []string{ "GET", "HEAD" } {
+				if r := get(handler, method, host); r.RespCode != http.StatusNotFound || string(r.Data) == "parent" {
+					t.Error("Malicious host", host, "should be rejected for", method, "got", r.RespCode, string(r.Data))
+				}
+			}
+		}
+	}
+}
+
+func TestMultipleRoots(t *testing.T) {
+	BaseUrl = "http://localhost"
+	override, base := t.TempDir(), t.TempDir()
+	ioutil.WriteFile(base + "/base.html", []byte("base only"), 0644)
+	ioutil.WriteFile(base + "/both.html", []byte("from base"), 0644)
+	ioutil.WriteFile(override + "/both.html", []byte("from override"), 0644)
+
+	sr := &ServerResource{ Match: "/", Type: "file_system", Roots: []string{ override, base } }
+	fsHandler := NewFSHandler(sr, nil, &MapCacheBuilder{})
+
+	// Only in the second root
+	if r := HttpGet("/base.html", fsHandler, t); r == nil || r.RespCode != 200 || string(r.Data) != "base only" {
+		t.Error("File only in the second root should be served")
+	}
+
+	// In both, the first wins
+	if r := HttpGet("/both.html", fsHandler, t); r == nil || r.RespCode != 200 || string(r.Data) != "from override" {
+		t.Error("File in both roots should come from the first")
+	}
+
+	if r := HttpGet("/missing.html", fsHandler, t); r == nil || r.RespCode != 404 {
+		t.Error("File in neither root should 404")
+	}
+}
+
+func TestCompressibleTypes(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	workingDir, _ := os.Getwd()
+	png, _ := ioutil.ReadFile(workingDir + "/testfiles/gopher.png")
+	ioutil.WriteFile(dir + "/data.json", []byte(`{"compress":"me"}`), 0644)
+	ioutil.WriteFile(dir + "/logo.svg", []byte("<svg></svg>"), 0644)
+	ioutil.WriteFile(dir + "/gopher.png", png, 0644)
+	gzipHeaders := map[string][]string{ "Accept-Encoding": []string{ "gzip" } }
+
+	sr := &ServerResource{ Match: "/", Type: "file_system", Path: dir, Compression: true, MimeTypes: map[string]string{ ".svg": "image/svg+xml" } }
+	fsHandler := NewFSHandler(sr, nil, nil)
+	for path, compressed := range map[string]bool{ "/data.json": true, "/logo.svg": true, "/gopher.png": false } {
+		if r := HttpGetWithHeaders(path, fsHandler, gzipHeaders, t); (r.Headers.Get("Content-Encoding") == "gzip") != compressed {
+			t.Error(path, "compressed should be", compressed, "under the default list")
+		}
+	}
+
+	// A resources own list replaces the default
+	sr.CompressibleTypes = []string{ "image/*" }
+	fsHandler = NewFSHandler(sr, nil, nil)
+	for path, compressed := range map[string]bool{ "/data.json": false, "/gopher.png": true } {
+		if r := HttpGetWithHeaders(path, fsHandler, gzipHeaders, t); (r.Headers.Get("Content-Encoding") == "gzip") != compressed {
+			t.Error(path, "compressed should be", compressed, "with CompressibleTypes image/*")
+		}
+	}
+
+	if !isCompressible("Application/JSON; charset=utf-8", &ServerResource{}) || isCompressible("application/octet-stream", &ServerResource{}) {
+		t.Error("Parameters & case shouldn't affect matching")
+	}
+}
+
+func TestDefaultMimeType(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/LICENSE", []byte("Plain text with no extension"), 0644)
+
+	sr := &ServerResource{ Match: "/", Type: "file_system", Path: dir }
+	if r := HttpGet("/LICENSE", NewFSHandler(sr, nil, nil), t); !strings.HasPrefix(r.Headers.Get("Content-Type"), "text/plain") {
+		t.Error("Without a default the content should be sniffed, got", r.Headers.Get("Content-Type"))
+	}
+
+	sr = &ServerResource{ Match: "/", Type: "file_system", Path: dir, DefaultMimeType: "application/octet-stream" }
+	if r := HttpGet("/LICENSE", NewFSHandler(sr, nil, nil), t); r.Headers.Get("Content-Type") != "application/octet-stream" {
+		t.Error("Unknown extensions should use the DefaultMimeType, got", r.Headers.Get("Content-Type"))
+	}
+	if mimeTypeForName("file.unknown", sr) != "application/octet-stream" || mimeTypeForName("page.html", sr) != "text/html" {
+		t.Error("DefaultMimeType should only apply to unknown extensions")
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing loader_cache.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestCacheStorePolicy(t *testing.T) {
+	BaseUrl = "http://localhost"
+	workingDir, _ := os.Getwd()
+	gzipHeaders := map[string][]string{ "Accept-Encoding": []string{ "gzip" } }
+
+	for _, policy := range []string{ CacheStoreCompressed, CacheStoreIdentity } {
+		sr := &ServerResource {
+			Match: "/", Type: "file_system", Path: workingDir + "/testfiles",
+			Cache: CacheStrategy{ Strategy: "lru", Limit: 4096, Store: policy },
+			Compression: true,
+		}
+		cb := &MapCacheBuilder{}
+		fsHandler := NewFSHandler(sr, nil, cb)
+
+		// Request both variants of the same file
+		var r *DummyResponseWriter
+		if r = HttpGetWithHeaders("/test.css", fsHandler, gzipHeaders, t); r == nil || r.RespCode != 200 {
+			t.Error(policy, "- gzip request should return 200")
+		} else if ce, ok := r.Headers["Content-Encoding"]; !ok || ce[0] != "gzip" {
+			t.Error(policy, "- gzip request should be gzip encoded")
+		}
+		if r = HttpGet("/test.css", fsHandler, t); r == nil || r.RespCode != 200 {
+			t.Error(policy, "- plain request should return 200")
+		} else if _, ok := r.Headers["Content-Encoding"]; ok {
+			t.Error(policy, "- plain request shouldn't be encoded")
+		} else if expected, _ := ioutil.ReadFile(workingDir + "/testfiles/test.css"); string(r.Data) != string(expected) {
+			t.Error(policy, "- plain request should return the original file content")
+		}
+
+		// Only a single variant should have been cached
+		if len(cb.Cache.Items) != 1 {
+			t.Error(policy, "- expected a single cached variant, found", len(cb.Cache.Items))
+		}
+		for _, item := range cb.Cache.Items {
+			if item.(*FileContent).Compression != (policy == CacheStoreCompressed) {
+				t.Error(policy, "- wrong variant cached")
+			}
+		}
+	}
+}
+
+func TestCacheEncodingVariants(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+	gzipHeaders := map[string][]string{ "Accept-Encoding": []string{ "gzip" } }
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles",
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1024 * 1024 }, Compression: true }
+	cb := &MapCacheBuilder{}
+	fsHandler := NewFSHandler(sr, nil, cb)
+	expected, _ := ioutil.ReadFile(workingDir + "/testfiles/test.css")
+
+	// Run twice so the second pass is served from the cache
+	for i := 0; i < 2; i++ {
+		var r *DummyResponseWriter
+		if r = HttpGetWithHeaders("/test.css", fsHandler, gzipHeaders, t); r == nil || r.RespCode != 200 || r.Headers.Get("Content-Encoding") != "gzip" {
+			t.Error(i, "- gzip request should be gzip encoded")
+		} else if data, _ := decompressData(r.Data); string(data) != string(expected) {
+			t.Error(i, "- gzip request returned the wrong content")
+		}
+
+		if r = HttpGet("/test.css", fsHandler, t); r == nil || r.RespCode != 200 || r.Headers.Get("Content-Encoding") != "" {
+			t.Error(i, "- plain request shouldn't be encoded")
+		} else if string(r.Data) != string(expected) {
+			t.Error(i, "- plain request returned the wrong content")
+		}
+
+		// Images aren't compressed so a gzip request should get the identity variant
+		if r = HttpGetWithHeaders("/gopher.png", fsHandler, gzipHeaders, t); r == nil || r.RespCode != 200 || r.Headers.Get("Content-Encoding") != "" {
+			t.Error(i, "- image request shouldn't be encoded")
+		}
+	}
+
+	if _, ok := cb.Cache.Items[CacheKey("/test.css", true)]; !ok {
+		t.Error("Compressed variant should be cached")
+	}
+	if _, ok := cb.Cache.Items[CacheKey("/test.css", false)]; !ok {
+		t.Error("Identity variant should be cached")
+	}
+	if _, ok := cb.Cache.Items[CacheKey("/gopher.png", true)]; ok {
+		t.Error("Image should only be cached as the identity variant")
+	}
+}
+
+func TestCacheRevalidateInterval(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/file.txt", []byte("original"), 0644)
+
+	// Fake clock + counting stat so we can check how often the file is hit
+	now := time.Now()
+	statCount := 0
+	loader := NewCacheFileLoader(&FileSystemLoader{}, &MapCache{ Items: make(map[string]memcache.CacheItem) }, 10 * time.Second)
+	loader.Clock = func() time.Time { return now }
+	loader.StatFile = func(name string) (os.FileInfo, error) {
+		statCount++
+		return os.Stat(name)
+	}
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir }
+	getFile := func() string {
+		rq, _ := http.NewRequest("GET", "http://localhost/file.txt", nil)
+		if fc, err := loader.GetFile(rq, sr, false); err == nil {
+			return string(fc.Data)
+		}
+		return ""
+	}
+
+	// First request loads from disk, the rest within the interval shouldn't stat
+	for i := 0; i < 5; i++ {
+		getFile()
+	}
+	if statCount != 0 {
+		t.Error("File shouldn't have been stat'd within the revalidate interval, stat'd", statCount)
+	}
+
+	// Past the interval we stat once then trust it again
+	now = now.Add(11 * time.Second)
+	for i := 0; i < 5; i++ {
+		getFile()
+	}
+	if statCount != 1 {
+		t.Error("File should have been stat'd once after the interval, stat'd", statCount)
+	}
+
+	// Change the file, the old content is served until the interval passes
+	ioutil.WriteFile(dir + "/file.txt", []byte("changed"), 0644)
+	os.Chtimes(dir + "/file.txt", now.Add(time.Minute), now.Add(time.Minute))
+	if data := getFile(); data != "original" {
+		t.Error("Cached content should be trusted within the interval, got", data)
+	}
+	now = now.Add(11 * time.Second)
+	if data := getFile(); data != "changed" {
+		t.Error("Changed file should have been detected after the interval, got", data)
+	}
+}
+
+func TestCachePrecompress(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	os.Mkdir(dir + "/css", 0755)
+	ioutil.WriteFile(dir + "/index.html", []byte(strings.Repeat("<p>index</p>", 100)), 0644)
+	ioutil.WriteFile(dir + "/css/site.css", []byte(strings.Repeat("p { color: red; }", 100)), 0644)
+	ioutil.WriteFile(dir + "/image.png", []byte("png"), 0644)
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir, Compression: true,
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1024 * 1024, Precompress: true } }
+	fsHandler := NewFSHandler(sr, nil, &MapCacheBuilder{})
+
+	cacheLoader := fsHandler.FileAccessor.(*CacheFileLoader)
+	counting := &CountingRetriever{ Wrapped: cacheLoader.WrappedRetriever }
+	cacheLoader.WrappedRetriever = counting
+
+	// Text files were loaded (compressed) at startup so the first request is a cache hit
+	for _, p := range []string{ "/index.html", "/css/site.css" } {
+		if r := HttpGetWithHeaders(p, fsHandler, map[string][]string{ "Accept-Encoding": { "gzip" } }, t); r.RespCode != 200 || r.Headers.Get("Content-Encoding") != "gzip" {
+			t.Error(p, "should be served compressed, got", r.RespCode)
+		}
+	}
+	if counting.Reads != 0 {
+		t.Error("First requests should have been cache hits, read", counting.Reads, "files")
+	}
+
+	// Images aren't worth compressing so they're left for the first request
+	HttpGetWithHeaders("/image.png", fsHandler, map[string][]string{ "Accept-Encoding": { "gzip" } }, t)
+	if counting.Reads != 1 {
+		t.Error("Image shouldn't have been precompressed")
+	}
+
+	// Loading stops once the cache limit is reached
+	small := &ServerResource { Match: "/", Type: "file_system", Path: dir, Compression: true,
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1, Precompress: true } }
+	smallCache := &MapCache{ Items: make(map[string]memcache.CacheItem) }
+	if loaded := NewCacheFileLoader(&FileSystemLoader{}, smallCache, 0).Precompress(small, listFiles(os.DirFS(dir), ".")); loaded != 0 || len(smallCache.Items) != 0 {
+		t.Error("Nothing should fit in a 1 byte cache, loaded", loaded, "cached", len(smallCache.Items))
+	}
+
+	// Without Compression the uncompressed copies are loaded instead, gzip variants would never be served
+	plain := &ServerResource { Match: "/", Type: "file_system", Path: dir,
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1024 * 1024, Precompress: true } }
+	mapCache := &MapCache{ Items: make(map[string]memcache.CacheItem) }
+	NewCacheFileLoader(&FileSystemLoader{}, mapCache, 0).Precompress(plain, listFiles(os.DirFS(dir), "."))
+	if _, found := mapCache.Items[CacheKey("/index.html", false)]; !found {
+		t.Error("Uncompressed index.html should have been loaded")
+	}
+	for key := range mapCache.Items {
+		if strings.HasPrefix(key, CompressionSuffix) {
+			t.Error("Nothing compressed should have been loaded, found", key)
+		}
+	}
+}
+
+func TestCacheMixedClients(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+	gzipHeaders := map[string][]string{ "Accept-Encoding": []string{ "gzip" } }
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles",
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1024 * 1024 }, Compression: true }
+	fsHandler := NewFSHandler(sr, nil, &MapCacheBuilder{})
+	expected, _ := ioutil.ReadFile(workingDir + "/testfiles/test.css")
+
+	// A plain client fills the cache first, gzip clients mustn't be handed its bytes (or vice versa)
+	for i, gzipClient := range []bool{ false, true, false, true } {
+		var r *DummyResponseWriter
+		if gzipClient {
+			r = HttpGetWithHeaders("/test.css", fsHandler, gzipHeaders, t)
+		} else {
+			r = HttpGet("/test.css", fsHandler, t)
+		}
+
+		if r == nil || r.RespCode != 200 {
+			t.Error(i, "- request should return 200")
+		} else if gzipClient != (r.Headers.Get("Content-Encoding") == "gzip") {
+			t.Error(i, "- Content-Encoding doesn't match the client, gzip:", gzipClient, "got:", r.Headers.Get("Content-Encoding"))
+		} else if data, _ := decompressData(r.Data); gzipClient && string(data) != string(expected) {
+			t.Error(i, "- gzip client got the wrong bytes")
+		} else if !gzipClient && string(r.Data) != string(expected) {
+			t.Error(i, "- plain client got the wrong bytes")
+		}
+	}
+}
+
+func TestCacheVaryHeaders(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/greeting.txt", []byte("unused"), 0644)
+
+	sr := &ServerResource{ Match: "/", Type: "file_system", Path: dir,
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 4096, VaryHeaders: []string{ "accept-language" },
+			VaryValues: map[string][]string{ "Accept-Language": { "en", "fr" } } } }
+	retriever := &HeaderRetriever{ Header: "Accept-Language", Wrapped: &FileSystemLoader{} }
+	mapCache := &MapCache{ Items: make(map[string]memcache.CacheItem) }
+	fsHandler := &FSHandler{ BaseHandler{ sr, nil }, NewCacheFileLoader(retriever, mapCache, 0), nil }
+
+	// Twice each so the second pass comes from the cache
+	for i := 0; i < 2; i++ {
+		for _, language := range []string{ "en", "fr" } {
+			r := HttpGetWithHeaders("/greeting.txt", fsHandler, map[string][]string{ "Accept-Language": []string{ language } }, t)
+			if r == nil || r.RespCode != 200 || string(r.Data) != language {
+				t.Error(i, "- expected the", language, "variant")
+			} else if r.Headers.Get("Vary") != "Accept-Language" {
+				t.Error(i, "- Vary should list Accept-Language, got", r.Headers.Get("Vary"))
+			}
+		}
+	}
+	if retriever.Reads != 2 {
+		t.Error("Each variant should only be read once, read", retriever.Reads)
+	}
+
+	// A full header picks the first listed value it contains
+	if r := HttpGetWithHeaders("/greeting.txt", fsHandler, map[string][]string{ "Accept-Language": { "fr-CH, FR;q=0.9, en;q=0.8" } }, t); r == nil || string(r.Data) != "fr" || retriever.Reads != 2 {
+		t.Error("fr-CH, FR;q=0.9 should have been served the cached fr variant")
+	}
+
+	// Values that aren't listed share a single entry rather than one each
+	for _, language := range []string{ "xx-1", "xx-2", "xx-3" } {
+		HttpGetWithHeaders("/greeting.txt", fsHandler, map[string][]string{ "Accept-Language": { language } }, t)
+	}
+	if retriever.Reads != 3 || len(mapCache.Items) != 3 {
+		t.Error("Unlisted values should share one entry, read", retriever.Reads, "cached", len(mapCache.Items))
+	}
+
+	// Every VaryHeader needs its values listed
+	sr.Cache.VaryHeaders = append(sr.Cache.VaryHeaders, "X-Device")
+	if err := validateConfig([]ServerBlock{ ServerBlock{ Content: []ServerResource{ *sr } } }); err == nil || !strings.Contains(err.Error(), "X-Device") {
+		t.Error("VaryHeader without VaryValues should fail to load, got", err)
+	}
+}
+
+func TestCacheNoCachePatterns(t *testing.T) {
+	BaseUrl = "http://localhost"
+	workingDir, _ := os.Getwd()
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles",
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1024 * 1024 }, NoCachePatterns: []string{ "^/subdir/" } }
+	if problems := checkConfig([]ServerBlock{ ServerBlock{ Hosts: []Host{ Host{ Host: "localhost", Port: 80 } }, Content: []ServerResource{ *sr } } }); len(problems) != 0 {
+		t.Error("Valid NoCachePatterns shouldn't be a problem:", problems)
+	}
+
+	cb := &MapCacheBuilder{}
+	fsHandler := NewFSHandler(sr, nil, cb)
+	for i := 0; i < 2; i++ {
+		for _, path := range []string{ "/test.css", "/subdir/hello.html" } {
+			if r := HttpGet(path, fsHandler, t); r == nil || r.RespCode != 200 {
+				t.Error(path, "should return 200")
+			}
+		}
+	}
+
+	if _, ok := cb.Cache.Items[CacheKey("/test.css", false)]; !ok {
+		t.Error("Non-matching path should be cached")
+	}
+	if len(cb.Cache.Items) != 1 {
+		t.Error("Matching path should never be cached, cache has", len(cb.Cache.Items), "items")
+	}
+
+	sr.NoCachePatterns = []string{ "(" }
+	if problems := checkConfig([]ServerBlock{ ServerBlock{ Hosts: []Host{ Host{ Host: "localhost", Port: 80 } }, Content: []ServerResource{ *sr } } }); len(problems) != 1 {
+		t.Error("Invalid NoCachePattern should be a problem, got", problems)
+	}
+}
+
+func TestCacheWrongItemType(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+	expected, _ := ioutil.ReadFile(workingDir + "/testfiles/test.css")
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles",
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1024 * 1024 }, Compression: true }
+	builder := &MapCacheBuilder{}
+	fsHandler := NewFSHandler(sr, nil, builder)
+
+	// Something else sharing the cache has stored its own type under our keys
+	builder.Cache.Items[CacheKey("/test.css", false)] = &WrongCacheItem{}
+	builder.Cache.Items[CacheKey("/test.css", true)] = &WrongCacheItem{}
+
+	r := HttpGet("/test.css", fsHandler, t)
+	if r == nil || r.RespCode != 200 || string(r.Data) != string(expected) {
+		t.Fatal("A wrong typed item should be a cache miss & the file served")
+	}
+	if _, ok := builder.Cache.Items[CacheKey("/test.css", false)].(*FileContent); !ok {
+		t.Error("The wrong typed item should be replaced with the file")
+	}
+
+	r = HttpGetWithHeaders("/test.css", fsHandler, map[string][]string{ "Accept-Encoding": []string{ "gzip" } }, t)
+	if data, _ := decompressData(r.Data); r.RespCode != 200 || string(data) != string(expected) {
+		t.Error("A gzip client should get the file too")
+	}
+	if _, ok := builder.Cache.Items[CacheKey("/test.css", true)].(*FileContent); !ok {
+		t.Error("The wrong typed compressed item should be replaced with the file")
+	}
+}
+
+func TestCacheRevalidateForgetsEvicted(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	for _, name := range []string{ "a.txt", "b.txt", "c.txt" } {
+		ioutil.WriteFile(dir + "/" + name, make([]byte, 10), 0644)
+	}
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir }
+	cacheLoader := NewCacheFileLoader(&FileSystemLoader{}, CreateLRUCache(20), time.Minute)
+	fsHandler := &FSHandler{ BaseHandler{ sr, nil }, cacheLoader, nil }
+	for _, p := range []string{ "/a.txt", "/b.txt", "/c.txt" } {
+		if r := HttpGet(p, fsHandler, t); r == nil || r.RespCode != 200 {
+			t.Error(p, "should return 200")
+		}
+	}
+
+	// Only two files fit so /a.txt was evicted, and forgotten
+	cacheLoader.validatedMutex.Lock()
+	defer cacheLoader.validatedMutex.Unlock()
+	if _, found := cacheLoader.validated[CacheKey("/a.txt", false)]; found || len(cacheLoader.validated) != 2 {
+		t.Error("Evicted file should have been forgotten, validated:", cacheLoader.validated)
+	}
+}
+
+func TestCacheRevalidateSkipsUncached(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/a.txt", make([]byte, 10), 0644)
+	ioutil.WriteFile(dir + "/big.txt", make([]byte, 30), 0644)
+
+	// The full cache (and the oversized file) refuse new items, nothing should be recorded for them
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: dir }
+	cacheLoader := NewCacheFileLoader(&FileSystemLoader{}, CreateNoStoreWhenFullCache(10), time.Minute)
+	fsHandler := &FSHandler{ BaseHandler{ sr, nil }, cacheLoader, nil }
+	for _, p := range []string{ "/a.txt", "/big.txt" } {
+		if r := HttpGet(p, fsHandler, t); r == nil || r.RespCode != 200 {
+			t.Error(p, "should return 200")
+		}
+	}
+
+	cacheLoader.validatedMutex.Lock()
+	defer cacheLoader.validatedMutex.Unlock()
+	if _, found := cacheLoader.validated[CacheKey("/big.txt", false)]; found || len(cacheLoader.validated) != 1 {
+		t.Error("Only cached files should be recorded as validated, validated:", cacheLoader.validated)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Test HttpHandler
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestHTTPHandler(t *testing.T) {
+
+	BaseUrl = "http://localhost:7890"
+
+	// Start http handler, it'll return the path that its passed
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	go func() {
+		http.ListenAndServe(":7890", nil)
+	}()
+
+	// Wait for http server to come alive
+	for i := 0; ; i++ {
+		if i == 5 {
+			t.Error("Unable to start http server, can't complete http tests")
+			return
+		
+		} else if resp, err := http.Get("http://localhost:7890"); err == nil && resp.StatusCode == 200 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	// Create http handler
+	sr := &ServerResource {
+			Match: "/", Type: "http_socket", Path: "http://localhost:7890",
+			Error: []ErrorRedirect { ErrorRedirect{ Match:"40[0-9]", Path:"/40x.txt" }, ErrorRedirect{ Match:"404", Path:"/404.txt" } },
+	}
+	httpHandler := NewHttpHandler(sr, CreateErrorMapping(*sr))
+
+	// Check that our http request is passed to our handler
+	var r *DummyResponseWriter
+	if r = HttpGet("/heyhey", httpHandler, t); r == nil || r.RespCode != 200 || r.Data == nil || len(r.Data) == 0 || string(r.Data) != "/heyhey" {
+		t.Error("Data should be /heyhey")
+	}
+}
+
+func TestHTTPHandlerEmptyResponse(t *testing.T) {
+
+	// Backend which always returns an empty 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	BaseUrl = backend.URL
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }
+	httpHandler := NewHttpHandler(sr, CreateErrorMapping(*sr))
+
+	// Empty body is passed through by default
+	var r *DummyResponseWriter
+	if r = HttpGet("/empty", httpHandler, t); r == nil || r.RespCode != 200 || len(r.Data) != 0 {
+		t.Error("Empty response should be passed through when TreatEmptyResponseAsError isn't set")
+	}
+
+	// ...and handled as an error when configured
+	sr.TreatEmptyResponseAsError = true
+	if r = HttpGet("/empty", httpHandler, t); r == nil || r.RespCode != http.StatusBadGateway {
+		t.Error("Empty response should have been treated as a bad gateway error")
+	}
+}
+
+func TestHTTPHandlerDecompression(t *testing.T) {
+
+	// Backend which always returns gzip regardless of what the client asks for
+	compressed, _ := compressData([]byte("uncompressed content"), gzip.DefaultCompression)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+		w.Write(compressed)
+	}))
+	defer backend.Close()
+	BaseUrl = "http://localhost"
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }
+	httpHandler := NewHttpHandler(sr, nil)
+
+	// Client which doesn't accept gzip gets decompressed content
+	var r *DummyResponseWriter
+	for _, acceptEncoding := range [][]string{ nil, []string{ "deflate" } } {
+		if r = HttpGetWithHeaders("/", httpHandler, map[string][]string{ "Accept-Encoding": acceptEncoding }, t); r == nil || r.RespCode != 200 {
+			t.Error("Request should return 200")
+		} else if string(r.Data) != "uncompressed content" {
+			t.Error("Response should have been decompressed, returned", string(r.Data))
+		} else if _, ok := r.Headers["Content-Encoding"]; ok {
+			t.Error("Content-Encoding header should have been removed")
+		} else if _, ok := r.Headers["Content-Length"]; ok {
+			t.Error("Content-Length of the compressed body should have been removed")
+		}
+	}
+
+	// Client which accepts gzip gets it untouched
+	if r = HttpGetWithHeaders("/", httpHandler, map[string][]string{ "Accept-Encoding": []string{ "gzip" } }, t); r == nil || r.RespCode != 200 {
+		t.Error("Request should return 200")
+	} else if ce := r.Headers["Content-Encoding"]; len(ce) == 0 || ce[0] != "gzip" || string(r.Data) != string(compressed) {
+		t.Error("Response should have been passed through compressed")
+	}
+}
+
+func TestHTTPHandlerResponseRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := `<a href="http://internal/page">page</a> <img src="http://internal/img.png">`
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+	BaseUrl = "http://localhost"
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, ResponseRewrite: []ResponseRewrite {
+		ResponseRewrite{ From: "http://internal", To: "https://public" },
+		ResponseRewrite{ From: `src="([^"]*)\.png"`, To: `src="$1.webp"`, Regex: true },
+	}}
+	httpHandler := NewHttpHandler(sr, nil)
+
+	// Text content is rewritten and Content-Length corrected
+	expected := `<a href="https://public/page">page</a> <img src="https://public/img.webp">`
+	var r *DummyResponseWriter
+	if r = HttpGet("/page", httpHandler, t); r == nil || r.RespCode != 200 || string(r.Data) != expected {
+		t.Error("Text response should have been rewritten, returned", string(r.Data))
+	} else if cl := r.Headers.Get("Content-Length"); cl != strconv.Itoa(len(expected)) {
+		t.Error("Content-Length should have been corrected, was", cl)
+	}
+
+	// Non-text content is passed through
+	if r = HttpGet("/image", httpHandler, t); r == nil || r.RespCode != 200 || !strings.Contains(string(r.Data), "http://internal") {
+		t.Error("Non-text response shouldn't have been rewritten")
+	}
+
+	// Bodies too big to hold in memory (here a gzip bomb) aren't read in whole
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	gz.Write(make([]byte, MaxRewriteSize + 1))
+	gz.Close()
+	large := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer large.Close()
+	sr = &ServerResource { Match: "/", Type: "http_socket", Path: large.URL, ResponseRewrite: sr.ResponseRewrite }
+	if r = HttpGetWithHeaders("/", NewHttpHandler(sr, nil), map[string][]string{ "Accept-Encoding": { "gzip" } }, t); r == nil || r.RespCode != http.StatusBadGateway {
+		t.Error("Response over MaxRewriteSize should return a 502")
+	}
+}
+
+func TestHTTPHandlerUntrustedBackend(t *testing.T) {
+
+	// TLS backend with a self-signed (untrusted) cert
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	backend.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	defer backend.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fallback"))
+	}))
+	defer fallback.Close()
+	BaseUrl = "http://localhost"
+
+	fake := &FakeLogger{}
+	SetLogger(fake)
+	defer SetLogger(nil)
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }
+	httpHandler := NewHttpHandler(sr, nil)
+
+	var r *DummyResponseWriter
+	if r = HttpGet("/", httpHandler, t); r == nil || r.RespCode != http.StatusBadGateway {
+		t.Error("Untrusted backend certificate should return a 502")
+	}
+	if !fake.Contains("ERROR", "TLS handshake with backend " + backend.URL) {
+		t.Error("TLS failure should have been logged:", fake.Calls)
+	}
+
+	// Configure a fallback backend
+	sr.TLSFallbackPath = fallback.URL
+	if r = HttpGet("/", httpHandler, t); r == nil || r.RespCode != 200 || string(r.Data) != "fallback" {
+		t.Error("Request should have been sent to the fallback backend")
+	}
+
+	// The first attempt used up the body so it can't be sent again
+	rq, _ := http.NewRequest("POST", BaseUrl + "/", strings.NewReader("upload"))
+	r = CreateDummyResponseWriter()
+	httpHandler.HandleRequest(r, rq)
+	if r.RespCode != http.StatusBadGateway {
+		t.Error("A request with a body shouldn't fall back, got", r.RespCode)
+	}
+
+	if isTLSError(errors.New("tls: looks like a TLS error but isn't one")) {
+		t.Error("Only typed TLS errors should count")
+	}
+}
+
+func TestHTTPHandlerTimeouts(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	// Unroutable address so the connection can't be made, dial should give up well before the overall timeout
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: "http://10.255.255.1:81",
+		Transport: TransportConfig{ DialTimeout: 200, Timeout: 10000 } }
+	start := time.Now()
+	if r := HttpGet("/", NewHttpHandler(sr, nil), t); r == nil || r.RespCode != http.StatusInternalServerError {
+		t.Error("Unreachable backend should return an error")
+	}
+	if elapsed := time.Since(start); elapsed > 2 * time.Second {
+		t.Error("Dial should have failed within DialTimeout, took", elapsed)
+	}
+
+	// Backend which is slow to send headers
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer backend.Close()
+
+	sr = &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, Transport: TransportConfig{ ResponseHeaderTimeout: 50 } }
+	start = time.Now()
+	if r := HttpGet("/", NewHttpHandler(sr, nil), t); r == nil || r.RespCode != http.StatusInternalServerError {
+		t.Error("Slow backend should return an error")
+	}
+	if elapsed := time.Since(start); elapsed >= 500 * time.Millisecond {
+		t.Error("Request should have failed within ResponseHeaderTimeout, took", elapsed)
+	}
+
+	// No timeouts uses the shared client
+	if NewHttpHandler(&ServerResource { Path: backend.URL }, nil).Client != client {
+		t.Error("Handler without timeouts should use the shared client")
+	}
+}
+
+func TestHTTPHandlerRetries(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	// Backend which drops the connection for the first failures requests then echoes the method + body
+	createBackend := func(failures int32) (*httptest.Server, *int32) {
+		attempts := int32(0)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) <= failures {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(r.Method + ":" + string(body)))
+		}))
+		return backend, &attempts
+	}
+
+	request := func(handler RequestHandler, method string, body string) *DummyResponseWriter {
+		rq, _ := http.NewRequest(method, BaseUrl + "/", strings.NewReader(body))
+		rw := CreateDummyResponseWriter()
+		handler.HandleRequest(rw, rq)
+		return rw
+	}
+
+	// Safe methods are retried (with the body resent)
+	for _, method := range []string{ "GET", "PUT" } {
+		backend, attempts := createBackend(2)
+		sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, Transport: TransportConfig{ MaxRetries: 2, RetryBackoff: 5 } }
+		if r := request(NewHttpHandler(sr, nil), method, "data"); r.RespCode != 200 || string(r.Data) != method + ":data" {
+			t.Error(method, "should have succeeded after retrying, returned", r.RespCode, string(r.Data))
+		}
+		if atomic.LoadInt32(attempts) != 3 {
+			t.Error(method, "backend should have been hit 3 times, was hit", atomic.LoadInt32(attempts))
+		}
+		backend.Close()
+	}
+
+	// Give up after MaxRetries
+	backend, attempts := createBackend(5)
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, Transport: TransportConfig{ MaxRetries: 1 } }
+	if r := request(NewHttpHandler(sr, nil), "GET", ""); r.RespCode != http.StatusInternalServerError || atomic.LoadInt32(attempts) != 2 {
+		t.Error("GET should have failed after 1 retry, backend hit", atomic.LoadInt32(attempts))
+	}
+	backend.Close()
+
+	// Non-idempotent methods are never retried
+	backend, attempts = createBackend(1)
+	sr = &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, Transport: TransportConfig{ MaxRetries: 3 } }
+	if r := request(NewHttpHandler(sr, nil), "POST", "data"); r.RespCode != http.StatusInternalServerError || atomic.LoadInt32(attempts) != 1 {
+		t.Error("POST shouldn't be retried, backend hit", atomic.LoadInt32(attempts))
+	}
+	backend.Close()
+}
+
+func TestHTTPHandlerUpstreamHost(t *testing.T) {
+	BaseUrl = "http://proxy.example.com"
+
+	var host, forwarded string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		forwarded = r.Header.Get(HeaderForwardedHost)
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+
+	// Original Host by default
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }
+	HttpGet("/", NewHttpHandler(sr, nil), t)
+	if host != "proxy.example.com" || forwarded != "" {
+		t.Error("Backend should see the original Host by default, got:", host, forwarded)
+	}
+
+	// Backends own host
+	sr = &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, UpstreamHost: UpstreamHostBackend, ForwardedHost: true }
+	HttpGet("/", NewHttpHandler(sr, nil), t)
+	if host != backendHost || forwarded != "proxy.example.com" {
+		t.Error("Backend should see its own host and the original in X-Forwarded-Host, got:", host, forwarded)
+	}
+
+	// Configured value
+	sr = &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, UpstreamHost: "internal.example.com" }
+	HttpGet("/", NewHttpHandler(sr, nil), t)
+	if host != "internal.example.com" {
+		t.Error("Backend should see the configured host, got:", host)
+	}
+}
+
+func TestHTTPHandlerForwardHeaders(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	var seen http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+	}))
+	defer backend.Close()
+
+	headers := map[string][]string{ "Authorization": { "Bearer x" }, "X-Internal-Debug": { "1" }, "X-Request-Id": { "abc" },
+		"Connection": { "X-Hop" }, "X-Hop": { "1" }, "Proxy-Authorization": { "secret" } }
+
+	// Allowlist
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, ForwardHeaders: []string{ "authorization", "X-Hop" } }
+	HttpGetWithHeaders("/", NewHttpHandler(sr, nil), headers, t)
+	if seen.Get("Authorization") != "Bearer x" || seen.Get(HeaderRequestID) != "abc" {
+		t.Error("Allowlisted headers should be forwarded:", seen)
+	}
+	if seen.Get("X-Internal-Debug") != "" || seen.Get("X-Hop") != "" || seen.Get("Proxy-Authorization") != "" {
+		t.Error("Non-listed and hop-by-hop headers should be dropped:", seen)
+	}
+
+	// Denylist
+	sr = &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, BlockHeaders: []string{ "x-internal-debug" } }
+	HttpGetWithHeaders("/", NewHttpHandler(sr, nil), headers, t)
+	if seen.Get("Authorization") != "Bearer x" || seen.Get("X-Internal-Debug") != "" || seen.Get("Proxy-Authorization") != "" {
+		t.Error("Only blocked and hop-by-hop headers should be dropped:", seen)
+	}
+}
+
+func TestHTTPHandlerBackendTLS(t *testing.T) {
+	BaseUrl = "http://localhost"
+	dir := t.TempDir()
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	backend.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	defer backend.Close()
+
+	// Backends self-signed cert as our CA bundle
+	caFile := dir + "/ca.pem"
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: backend.Certificate().Raw }), 0644)
+
+	untrusted := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }, nil)
+	if r := HttpGet("/", untrusted, t); r.RespCode != http.StatusBadGateway {
+		t.Error("Self-signed backend should fail without the CA, got:", r.RespCode)
+	}
+
+	trusted := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL,
+		Transport: TransportConfig{ CAFile: caFile } }, nil)
+	if r := HttpGet("/", trusted, t); r.RespCode != 200 || string(r.Data) != "secure" {
+		t.Error("Self-signed backend should succeed with its CA trusted, got:", r.RespCode)
+	}
+
+	skip := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL,
+		Transport: TransportConfig{ InsecureSkipVerify: true } }, nil)
+	if r := HttpGet("/", skip, t); r.RespCode != 200 || string(r.Data) != "secure" {
+		t.Error("Self-signed backend should succeed with verification skipped, got:", r.RespCode)
+	}
+
+	// Backend requiring a client cert, reuse the test cert as ours
+	mtlsBackend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("mutual"))
+	}))
+	mtlsBackend.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	mtlsBackend.TLS = &tls.Config{ ClientAuth: tls.RequireAnyClientCert }
+	mtlsBackend.StartTLS()
+	defer mtlsBackend.Close()
+
+	cert := backend.TLS.Certificates[0]
+	key, _ := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	ioutil.WriteFile(dir + "/client.pem", pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: cert.Certificate[0] }), 0644)
+	ioutil.WriteFile(dir + "/client.key", pem.EncodeToMemory(&pem.Block{ Type: "PRIVATE KEY", Bytes: key }), 0644)
+
+	noCert := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: mtlsBackend.URL,
+		Transport: TransportConfig{ InsecureSkipVerify: true } }, nil)
+	if r := HttpGet("/", noCert, t); r.RespCode == 200 {
+		t.Error("mTLS backend should reject us without a client cert")
+	}
+
+	withCert := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: mtlsBackend.URL,
+		Transport: TransportConfig{ InsecureSkipVerify: true, CertFile: dir + "/client.pem", KeyFile: dir + "/client.key" } }, nil)
+	if r := HttpGet("/", withCert, t); r.RespCode != 200 || string(r.Data) != "mutual" {
+		t.Error("mTLS backend should accept our client cert, got:", r.RespCode)
+	}
+}
+
+func TestHTTPHandlerBufferSize(t *testing.T) {
+
+	// Backend returning a body much larger than the buffer, both with & without a Content-Length
+	body := bytes.Repeat([]byte("0123456789abcdef"), 64 * 1024)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sized" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+	BaseUrl = "http://localhost"
+
+	if handler := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }, nil); handler.BufferSize != BufferMax {
+		t.Error("Default buffer size should be", BufferMax)
+	}
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, BufferSize: 4096 }
+	httpHandler := NewHttpHandler(sr, nil)
+	if len(httpHandler.getByteBuffer()) != 4096 {
+		t.Error("Buffers should use the configured size")
+	}
+
+	for _, path := range []string{ "/sized", "/unsized" } {
+		if r := HttpGet(path, httpHandler, t); r == nil || r.RespCode != 200 {
+			t.Error("Request should return 200")
+		} else if !bytes.Equal(r.Data, body) {
+			t.Error("Large response should stream through intact for", path, "got", len(r.Data), "bytes")
+		}
+	}
+}
+
+func TestHTTPHandlerVaryAcceptEncoding(t *testing.T) {
+	compressed, _ := compressData([]byte("content"), gzip.DefaultCompression)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Vary", "Origin")
+			w.Write(compressed)
+		} else {
+			w.Write([]byte("content"))
+		}
+	}))
+	defer backend.Close()
+	BaseUrl = "http://localhost"
+
+	httpHandler := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }, nil)
+
+	// Gzip responses vary, whether passed through or decompressed, keeping the backends own Vary
+	for _, acceptEncoding := range [][]string{ { "gzip" }, nil } {
+		r := HttpGetWithHeaders("/gzip", httpHandler, map[string][]string{ "Accept-Encoding": acceptEncoding }, t)
+		if vary := r.Headers["Vary"]; len(vary) != 2 || vary[0] != "Origin" || vary[1] != "Accept-Encoding" {
+			t.Error("Vary should list Origin & Accept-Encoding, got", vary)
+		}
+	}
+
+	if r := HttpGetWithHeaders("/plain", httpHandler, map[string][]string{ "Accept-Encoding": { "gzip" } }, t); len(r.Headers["Vary"]) != 0 {
+		t.Error("Uncompressed response shouldn't vary, got", r.Headers["Vary"])
+	}
+}
+
+func TestHTTPHandlerRewriteLocation(t *testing.T) {
+	var backendURL string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/absolute":
+			http.Redirect(w, r, backendURL + "/login?next=%2F", http.StatusFound)
+		case "/relative":
+			w.Header().Set("Location", "/login")
+			w.WriteHeader(http.StatusMovedPermanently)
+		case "/external":
+			http.Redirect(w, r, "https://example.org/elsewhere", http.StatusFound)
+		case "/login":
+			w.Write([]byte("login page"))
+		}
+	}))
+	defer backend.Close()
+	backendURL = backend.URL
+	BaseUrl = "http://proxy.example.com"
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }
+	httpHandler := NewHttpHandler(sr, nil)
+
+	// Redirects are followed by default
+	if r := HttpGet("/absolute", httpHandler, t); r.RespCode != http.StatusOK || string(r.Data) != "login page" || r.Headers.Get("Location") != "" {
+		t.Error("Redirect should be followed without RewriteLocation, got", r.RespCode, r.Headers.Get("Location"))
+	}
+
+	// ...and passed on (rewritten if they point at the backend) with it
+	sr.RewriteLocation = true
+	httpHandler = NewHttpHandler(sr, nil)
+	tests := []struct { path string; status int; location string } {
+		{ "/absolute", http.StatusFound, "http://proxy.example.com/login?next=%2F" },
+		{ "/relative", http.StatusMovedPermanently, "/login" },
+		{ "/external", http.StatusFound, "https://example.org/elsewhere" },
+	}
+	for _, test := range tests {
+		if r := HttpGet(test.path, httpHandler, t); r.RespCode != test.status || r.Headers.Get("Location") != test.location {
+			t.Error(test.path, "expected", test.status, test.location, "got", r.RespCode, r.Headers.Get("Location"))
+		}
+	}
+}
+
+func TestHTTPHandlerNotModified(t *testing.T) {
+	lastModified := "Wed, 21 Oct 2015 07:28:00 GMT"
+	var ifNoneMatch string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer backend.Close()
+	BaseUrl = "http://localhost"
+
+	// The client doesn't accept gzip, there's no body to decompress so that shouldn't matter
+	httpHandler := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }, nil)
+	r := HttpGetWithHeaders("/page", httpHandler, map[string][]string{ "If-None-Match": []string{ `"v1"` } }, t)
+	if ifNoneMatch != `"v1"` {
+		t.Error("If-None-Match should be forwarded, backend got", ifNoneMatch)
+	}
+	if r.RespCode != http.StatusNotModified {
+		t.Error("304 should be passed through, got", r.RespCode)
+	}
+	if r.Headers.Get("ETag") != `"v1"` || r.Headers.Get("Last-Modified") != lastModified {
+		t.Error("Validators should reach the client, got", r.Headers.Get("ETag"), r.Headers.Get("Last-Modified"))
+	}
+	if len(r.Data) != 0 || r.Headers.Get("Content-Encoding") != "" || r.Headers.Get("Content-Length") != "" {
+		t.Error("304 shouldn't have a body or describe one")
+	}
+}
+
+func TestHTTPHandlerCompressUpstream(t *testing.T) {
+	text := strings.Repeat("some uncompressed text ", 4096)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "image/png")
+		} else {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(text)))
+		w.Write([]byte(text))
+	}))
+	defer backend.Close()
+	BaseUrl = "http://localhost"
+	gzipHeaders := map[string][]string{ "Accept-Encoding": []string{ "gzip" } }
+
+	httpHandler := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, CompressUpstream: true }, nil)
+
+	r := HttpGetWithHeaders("/text", httpHandler, gzipHeaders, t)
+	if r.RespCode != 200 || r.Headers.Get("Content-Encoding") != "gzip" {
+		t.Fatal("Text should be gzip'd for a gzip client, got", r.RespCode, r.Headers.Get("Content-Encoding"))
+	}
+	if data, err := decompressData(r.Data); err != nil || string(data) != text {
+		t.Error("Compressed body should decompress to the original:", err)
+	}
+	if r.Headers.Get("Content-Length") != "" || r.Headers.Get("Vary") != "Accept-Encoding" {
+		t.Error("Compressed response shouldn't have the original Content-Length and should Vary, got", r.Headers)
+	}
+	if r.Headers.Get("ETag") != `W/"v1"` {
+		t.Error("Compressed response should have a weak ETag, got", r.Headers.Get("ETag"))
+	}
+
+	if r := HttpGet("/text", httpHandler, t); r.Headers.Get("Content-Encoding") != "" || string(r.Data) != text || r.Headers.Get("ETag") != `"v1"` {
+		t.Error("Client without gzip should get the original text & ETag")
+	}
+	if r := HttpGetWithHeaders("/image", httpHandler, gzipHeaders, t); r.Headers.Get("Content-Encoding") != "" || string(r.Data) != text {
+		t.Error("Non-text responses shouldn't be compressed")
+	}
+
+	// Off by default
+	plain := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }, nil)
+	if r := HttpGetWithHeaders("/text", plain, gzipHeaders, t); r.Headers.Get("Content-Encoding") != "" {
+		t.Error("Upstream responses shouldn't be compressed unless CompressUpstream is set")
+	}
+}
+
+func TestHTTPHandlerExpectContinue(t *testing.T) {
+	upload := strings.Repeat("upload ", 8192)
+	var expect, received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect = r.Header.Get("Expect")
+		w.WriteHeader(http.StatusContinue)
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("stored"))
+	}))
+	defer backend.Close()
+
+	httpHandler := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket", Path: backend.URL,
+		Transport: TransportConfig{ MaxRetries: 2 } }, nil)
+	proxy := httptest.NewServer(http.HandlerFunc(httpHandler.HandleRequest))
+	defer proxy.Close()
+
+	// Wait long enough that the body is only sent once the 100 Continue arrives
+	continued := false
+	trace := &httptrace.ClientTrace{ Got100Continue: func() { continued = true } }
+	req, _ := http.NewRequest("PUT", proxy.URL + "/upload", strings.NewReader(upload))
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req.Header.Set("Expect", "100-continue")
+	client := &http.Client{ Transport: &http.Transport{ ExpectContinueTimeout: 10 * time.Second } }
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal("Upload failed:", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "stored" {
+		t.Error("Upload should complete, got", resp.StatusCode, string(body))
+	}
+	if !continued {
+		t.Error("Client should be sent 100 Continue")
+	}
+	if expect != "100-continue" || received != upload {
+		t.Error("Backend should get the Expect header and the whole body, got", expect, len(received))
+	}
+}
+
+func TestHTTPHandlerServerErrorPage(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(status)
+		w.Write([]byte("backend error"))
+	}))
+	defer backend.Close()
+	BaseUrl = "http://localhost"
+	errors := t.TempDir()
+	ioutil.WriteFile(errors + "/5xx.html", []byte("<h1>Something went wrong</h1>"), 0644)
+	ioutil.WriteFile(errors + "/502.html", []byte("<h1>Bad gateway</h1>"), 0644)
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, ErrorRoot: errors, ServerErrorPage: "/5xx.html",
+		Error: []ErrorRedirect { ErrorRedirect{ Match: "^502$", Path: "/502.html" } } }
+	httpHandler := NewHttpHandler(sr, CreateErrorMapping(*sr))
+
+	for path, expected := range map[string]string{ "/500": "<h1>Something went wrong</h1>", "/503": "<h1>Something went wrong</h1>",
+		"/502": "<h1>Bad gateway</h1>" } {
+		status, _ := strconv.Atoi(path[1:])
+		if r := HttpGet(path, httpHandler, t); r.RespCode != status || string(r.Data) != expected {
+			t.Error(path, "should keep its status & serve", expected, "got", r.RespCode, string(r.Data))
+		}
+	}
+}
+
+func TestHTTPHandlerRetryLimits(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	attempts := int32(0)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(strconv.Itoa(len(body))))
+	}))
+	defer backend.Close()
+
+	// Bodies over MaxRetryBodySize are sent whole, but only the once
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL, Transport: TransportConfig{ MaxRetries: 2 } }
+	rq, _ := http.NewRequest("PUT", BaseUrl + "/", bytes.NewReader(make([]byte, MaxRetryBodySize + 10)))
+	rw := CreateDummyResponseWriter()
+	NewHttpHandler(sr, nil).HandleRequest(rw, rq)
+	if rw.RespCode == 200 || atomic.LoadInt32(&attempts) != 1 {
+		t.Error("Oversized body shouldn't have been retried, returned", rw.RespCode, "after", atomic.LoadInt32(&attempts), "attempts")
+	}
+
+	rq, _ = http.NewRequest("PUT", BaseUrl + "/", bytes.NewReader(make([]byte, MaxRetryBodySize + 10)))
+	rw = CreateDummyResponseWriter()
+	NewHttpHandler(sr, nil).HandleRequest(rw, rq)
+	if rw.RespCode != 200 || string(rw.Data) != strconv.Itoa(MaxRetryBodySize + 10) {
+		t.Error("Oversized body should have been sent whole, returned", rw.RespCode, string(rw.Data))
+	}
+
+	// A cancelled request stops waiting to retry
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+	sr = &ServerResource { Match: "/", Type: "http_socket", Path: "http://" + addr, Transport: TransportConfig{ MaxRetries: 3, RetryBackoff: 5000 } }
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	rq, _ = http.NewRequestWithContext(ctx, "GET", BaseUrl + "/", nil)
+	rw = CreateDummyResponseWriter()
+	start := time.Now()
+	NewHttpHandler(sr, nil).HandleRequest(rw, rq)
+	if time.Since(start) > 2 * time.Second || rw.RespCode == 200 {
+		t.Error("Cancelled request should have stopped retrying, took", time.Since(start), "returned", rw.RespCode)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_health.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestHealthHandler(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	// Liveness - no upstreams to check
+	var r *DummyResponseWriter
+	if r = HttpGet("/health", NewHealthHandler(&ServerResource{ Match: "/health", Type: "health" }, nil), t); r == nil || r.RespCode != 200 {
+		t.Error("Liveness check should return 200")
+	} else if string(r.Data) != `{"status":"ok"}` || r.Headers.Get("Content-Type") != "application/json" {
+		t.Error("Liveness check should return a json ok status, returned", string(r.Data))
+	}
+
+	// Readiness - one upstream up, one down
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	sr := &ServerResource{ Match: "/ready", Type: "health", HealthChecks: []string{ up.URL } }
+	if r = HttpGet("/ready", NewHealthHandler(sr, nil), t); r == nil || r.RespCode != 200 {
+		t.Error("Readiness check should return 200 when upstreams are reachable")
+	}
+
+	sr.HealthChecks = append(sr.HealthChecks, down.URL)
+	if r = HttpGet("/ready", NewHealthHandler(sr, nil), t); r == nil || r.RespCode != http.StatusServiceUnavailable {
+		t.Error("Readiness check should return 503 when an upstream is down")
+	} else if !strings.Contains(string(r.Data), `"status":"unavailable"`) || !strings.Contains(string(r.Data), down.URL) {
+		t.Error("Readiness check should report the unreachable upstream, returned", string(r.Data))
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_metrics.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestMetricsHandler(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	sh := createServerHandler([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource {
+				ServerResource{ Match: "^/metrics$", Type: "metrics" },
+				ServerResource{ Match: "/", Type: "file_system", Path: workingDir + "/testfiles" },
+			},
+		},
+	})
+
+	// Two successful requests and one not found
+	for _, path := range []string{ "/index.html", "/test.css", "/doesntexist.html" } {
+		sh.HostHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost" + path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	sh.HostHandler(rec, httptest.NewRequest("GET", "http://localhost/metrics", nil))
+	body := rec.Body.String()
+
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != MetricsContentType {
+		t.Error("Metrics endpoint should return 200 with the prometheus content type")
+	}
+	for _, expected := range []string {
+		`reverseproxy_requests_total{resource="/",status="2xx"} 2`,
+		`reverseproxy_requests_total{resource="/",status="4xx"} 1`,
+		`reverseproxy_request_duration_seconds_count{resource="/"} 3`,
+		`reverseproxy_request_duration_seconds_bucket{resource="/",le="+Inf"} 3`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Error("Metrics output should contain", expected, "\n", body)
+		}
+	}
+
+	// Scraping the endpoint shouldn't be counted
+	if strings.Contains(body, `resource="^/metrics$"`) {
+		t.Error("Metrics requests shouldn't be recorded")
+	}
+}
+
+func TestMetricsByteCounts(t *testing.T) {
+	upload := strings.Repeat("u", 3000)
+	download := strings.Repeat("d", 5000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte(download))
+	}))
+	defer backend.Close()
+
+	collector := NewMetricsCollector()
+	sr := &ServerResource { Match: "/api", Type: "http_socket", Path: backend.URL }
+	recorder := &MetricsRecorder{ Handler: NewHttpHandler(sr, nil), Resource: sr.Match, Collector: collector }
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		recorder.HandleRequest(rec, httptest.NewRequest("POST", "http://localhost/api", strings.NewReader(upload)))
+		if rec.Code != 200 || rec.Body.String() != download {
+			t.Fatal("Proxied request failed:", rec.Code)
+		}
+	}
+
+	if in, out := collector.Bytes("/api"); in != 6000 || out != 10000 {
+		t.Error("Expected 6000 bytes in & 10000 out, got", in, out)
+	}
+
+	var output bytes.Buffer
+	collector.WritePrometheus(&output)
+	for _, expected := range []string {
+		`reverseproxy_request_bytes_total{resource="/api"} 6000`,
+		`reverseproxy_response_bytes_total{resource="/api"} 10000`,
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Error("Metrics output should contain", expected, "\n", output.String())
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_cors.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestCORSHandler(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles",
+		CORS: CORSConfig{ AllowedOrigins: []string{ "https://app.example.com" }, AllowedMethods: []string{ "GET", "PUT" },
+			AllowedHeaders: []string{ "Content-Type" }, AllowCredentials: true, MaxAge: 600 },
+	}
+	handler := NewCORSHandler(NewFSHandler(sr, nil, nil), sr)
+
+	// Preflight
+	rq, _ := http.NewRequest("OPTIONS", BaseUrl + "/index.html", nil)
+	rq.Header.Set("Origin", "https://app.example.com")
+	rq.Header.Set("Access-Control-Request-Method", "PUT")
+	r := CreateDummyResponseWriter()
+	handler.HandleRequest(r, rq)
+
+	if r.RespCode != http.StatusNoContent || len(r.Data) != 0 {
+		t.Error("Preflight should return 204 with no body, returned", r.RespCode)
+	}
+	for header, expected := range map[string]string {
+		"Access-Control-Allow-Origin": "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "Content-Type",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age": "600",
+	} {
+		if r.Headers.Get(header) != expected {
+			t.Error("Preflight header", header, "should be", expected, "was", r.Headers.Get(header))
+		}
+	}
+
+	// Simple GET from an allowed origin
+	if r = HttpGetWithHeaders("/index.html", handler, map[string][]string{ "Origin": []string{ "https://app.example.com" } }, t); r == nil || r.RespCode != 200 || len(r.Data) == 0 {
+		t.Error("GET with allowed origin should return the file")
+	} else if r.Headers.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Error("GET with allowed origin should have Access-Control-Allow-Origin set")
+	}
+
+	// ...and from an origin that isn't allowed
+	if r = HttpGetWithHeaders("/index.html", handler, map[string][]string{ "Origin": []string{ "https://evil.example.com" } }, t); r == nil || r.RespCode != 200 {
+		t.Error("GET with other origin should still be served")
+	} else if _, ok := r.Headers["Access-Control-Allow-Origin"]; ok {
+		t.Error("GET with other origin shouldn't have Access-Control-Allow-Origin set")
+	}
+
+	// Origin isn't listed in Vary twice when something else has already added it
+	rq, _ = http.NewRequest("GET", BaseUrl + "/index.html", nil)
+	rq.Header.Set("Origin", "https://app.example.com")
+	r = CreateDummyResponseWriter()
+	r.Headers.Set("Vary", "Origin")
+	handler.HandleRequest(r, rq)
+	if vary := r.Headers["Vary"]; len(vary) != 1 || vary[0] != "Origin" {
+		t.Error("Vary should list Origin once, got", vary)
+	}
+}
+
+func TestCORSWildcardCredentials(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles",
+		CORS: CORSConfig{ AllowedOrigins: []string{ "*", "https://app.example.com" }, AllowCredentials: true } }
+	handler := NewCORSHandler(NewFSHandler(sr, nil, nil), sr)
+
+	// Any origin is allowed, but without credentials
+	r := HttpGetWithHeaders("/index.html", handler, map[string][]string{ "Origin": []string{ "https://evil.example.com" } }, t)
+	if r.Headers.Get("Access-Control-Allow-Origin") != "*" || r.Headers.Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("Wildcard origins shouldn't get credentials, got", r.Headers)
+	}
+	r = HttpGetWithHeaders("/index.html", handler, map[string][]string{ "Origin": []string{ "https://app.example.com" } }, t)
+	if r.Headers.Get("Access-Control-Allow-Origin") != "https://app.example.com" || r.Headers.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("Listed origins should still get credentials, got", r.Headers)
+	}
+
+	problems := checkConfig([]ServerBlock{ ServerBlock{ Hosts: []Host{ Host{ Host: "localhost", Port: 80 } },
+		Content: []ServerResource{ *sr } } })
+	if len(problems) != 1 || !strings.Contains(problems[0], "AllowCredentials") {
+		t.Error("'*' with AllowCredentials should be a config problem, got", problems)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_headers.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestHeaderRewriter(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	BaseUrl = "http://localhost"
+
+	// Response rules on a file system resource
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles",
+		AddHeaders: map[string]string{ "X-Content-Type-Options": "nosniff" },
+		RemoveHeaders: []string{ "Expires" },
+	}
+	handler := NewHeaderRewriter(NewFSHandler(sr, nil, nil), sr)
+
+	var r *DummyResponseWriter
+	if r = HttpGet("/index.html", handler, t); r == nil || r.RespCode != 200 {
+		t.Error("/index.html request failed")
+	} else if r.Headers.Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("Added header should be present in the response")
+	} else if _, ok := r.Headers["Expires"]; ok {
+		t.Error("Removed header shouldn't be present in the response")
+	}
+
+	// Request rules on a proxied resource, backend echoes the headers it receives
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Added") + "|" + r.Header.Get("X-Internal")))
+	}))
+	defer backend.Close()
+
+	sr = &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL,
+		AddRequestHeaders: map[string]string{ "X-Added": "added" },
+		RemoveRequestHeaders: []string{ "X-Internal" },
+	}
+	handler = NewHeaderRewriter(NewHttpHandler(sr, nil), sr)
+	if r = HttpGetWithHeaders("/", handler, map[string][]string{ "X-Internal": []string{ "secret" } }, t); r == nil || string(r.Data) != "added|" {
+		t.Error("Backend should have received the added header but not the removed one, received", string(r.Data))
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_slow_request.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestSlowRequestLogger(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	fake := &FakeLogger{}
+	SetLogger(fake)
+	defer SetLogger(nil)
+
+	slowHandler := &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+
+			// As if an error page was served
+			req.URL.Path = "/500.html"
+		}
+	}}
+	handler := NewSlowRequestLogger(slowHandler, 20)
+
+	HttpGet("/fast", handler, t)
+	if fake.Contains("WARNING", "/fast") {
+		t.Error("Fast request shouldn't have been logged as slow")
+	}
+
+	HttpGet("/slow", handler, t)
+	if !fake.Contains("WARNING", "Slow request - Host: localhost Path: /slow Duration:") {
+		t.Error("Slow request should have been logged as a warning:", fake.Calls)
+	}
+}
+
+func TestSlowRequestLoggerIncludesRequestID(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	fake := &FakeLogger{}
+	SetLogger(fake)
+	defer SetLogger(nil)
+
+	slowHandler := &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	}}
+	handler := &RequestIDHandler{ Handler: NewSlowRequestLogger(slowHandler, 10) }
+
+	HttpGetWithHeaders("/slow", handler, map[string][]string{ "X-Request-Id": { "abc-123" } }, t)
+	if !fake.Contains("WARNING", "RequestID: abc-123") {
+		t.Error("Slow request log should include the request ID:", fake.Calls)
+	}
+}
+
+func TestSlowRequestThreshold(t *testing.T) {
+	fake := &FakeLogger{}
+	SetLogger(fake)
+	defer SetLogger(nil)
+
+	RegisterHandler("sleepy", func(rsc *ServerResource, errorMappings []ErrorMapping) RequestHandler {
+		return &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/api/slow" {
+				time.Sleep(50 * time.Millisecond)
+			}
+		} }
+	})
+	server := NewServer([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			SlowRequestThreshold: 20,
+			Content: []ServerResource { ServerResource{ Match: "/api", Type: "sleepy" } },
+		},
+	})
+
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/api/fast", nil))
+	if fake.Contains("WARNING", "Slow request") {
+		t.Error("Fast request shouldn't have been logged as slow:", fake.Calls)
+	}
+
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/api/slow", nil))
+	if !fake.Contains("WARNING", "Path: /api/slow Duration:") || !fake.Contains("WARNING", "Resource: /api") {
+		t.Error("Slow request should have been logged with its resource & duration:", fake.Calls)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing serverlogger.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestLogLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	InitLog(LevelWarning | LevelError, buf)
+	defer SetLevel(0)
+
+	Debug("debug message")
+	Info("info message")
+	Warning("warning message")
+	Error("error message")
+
+	output := buf.String()
+	if strings.Contains(output, "debug message") || strings.Contains(output, "info message") {
+		t.Error("Debug and Info should have been filtered out:", output)
+	}
+	if !strings.Contains(output, "WARNING: warning message") || !strings.Contains(output, "ERROR: error message") {
+		t.Error("Warning and Error should have been logged:", output)
+	}
+
+	// Change level and check Debug is formatted the same as the other levels
+	buf.Reset()
+	SetLevel(LevelDebug)
+	Debug("debug message", 1)
+	Error("error message")
+	if output = buf.String(); !strings.Contains(output, "DEBUG: debug message 1") || strings.Contains(output, "[") {
+		t.Error("Debug should have been logged without wrapping its arguments:", output)
+	}
+	if strings.Contains(output, "error message") {
+		t.Error("Error should have been filtered out after SetLevel:", output)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	BaseUrl = "http://localhost"
+	workingDir, _ := os.Getwd()
+
+	fake := &FakeLogger{}
+	SetLogger(fake)
+	defer SetLogger(nil)
+
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles" }
+	fsHandler := NewFSHandler(sr, nil, nil)
+	if r := HttpGet("/index.html", fsHandler, t); r == nil || r.RespCode != 200 {
+		t.Error("/index.html request failed")
+	}
+
+	if !fake.Contains("DEBUG", "+HandlerFS - Path: /index.html") {
+		t.Error("Handler should have logged its request path through the injected logger:", fake.Calls)
+	}
+}
+
+// countingStringer counts how often it's formatted
+type countingStringer struct {
+	count int
+}
+
+func (this *countingStringer) String() string {
+	this.count++
+	return "counted"
+}
+
+func TestLogLevelSkipsFormatting(t *testing.T) {
+	buf := &bytes.Buffer{}
+	InitLog(LevelError, buf)
+	defer SetLevel(0)
+
+	arg := &countingStringer{}
+	Debug("debug message", arg)
+	Info("info message", arg)
+	if arg.count != 0 {
+		t.Error("Arguments for levels that are off shouldn't be formatted, were formatted", arg.count, "times")
+	}
+
+	Error("error message", arg)
+	if arg.count != 1 || !strings.Contains(buf.String(), "ERROR: error message counted") {
+		t.Error("Error should have been formatted & logged:", buf.String())
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing loader_embed.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestEmbedHandler(t *testing.T) {
+	BaseUrl = "http://localhost"
+	fsys := fstest.MapFS {
+		"site/index.html": &fstest.MapFile{ Data: []byte("index") },
+		"site/css/app.css": &fstest.MapFile{ Data: []byte("body {}") },
+		"site/sub/hello.html": &fstest.MapFile{ Data: []byte("hello") },
+		"site/about.html": &fstest.MapFile{ Data: []byte("about") },
+	}
+
+	sr := &ServerResource { Match: "/", Path: "site", Compression: true,
+		Cache: CacheStrategy{ Strategy: "lru", Limit: 1024 },
+		FSDefaults: FileSystemDefaults{ DefaultFiles: []string{ "index.html", "hello.html" }, DefaultExtensions: []string{ ".html" } },
+	}
+	handler := NewEmbedHandler(sr, fsys, nil)
+
+	// Run twice so the second pass comes from the cache
+	for i := 0; i < 2; i++ {
+		for path, expected := range map[string]string { "/": "index", "/sub/": "hello", "/about": "about", "/css/app.css": "body {}" } {
+			if r := HttpGet(path, handler, t); r == nil || r.RespCode != 200 || string(r.Data) != expected {
+				t.Error(path, "should return", expected)
+			}
+		}
+	}
+
+	var r *DummyResponseWriter
+	if r = HttpGet("/css/app.css", handler, t); r.Headers.Get("Content-Type") != "text/css; charset=utf-8" {
+		t.Error("/css/app.css should have content type text/css")
+	}
+
+	if r = HttpGetWithHeaders("/about.html", handler, map[string][]string{ "Accept-Encoding": []string{ "gzip" } }, t); r == nil || r.Headers.Get("Content-Encoding") != "gzip" {
+		t.Error("/about.html should be compressed")
+	} else if data, _ := decompressData(r.Data); string(data) != "about" {
+		t.Error("/about.html compressed content is wrong")
+	}
+
+	if r = HttpGet("/missing.html", handler, t); r == nil || r.RespCode != 404 {
+		t.Error("/missing.html should return 404")
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing circuit_breaker.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestCircuitBreaker(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	failing := int32(1)
+	hits := int32(0)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer backend.Close()
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL,
+		CircuitBreaker: CircuitBreakerConfig{ FailureRatio: 0.5, MinRequests: 4, Window: 10000, OpenDuration: 1000 } }
+	httpHandler := NewHttpHandler(sr, nil)
+	breaker := httpHandler.Breakers[backend.URL]
+	now := time.Now()
+	breaker.Clock = func() time.Time { return now }
+
+	// Drive failures to open the breaker
+	for i := 0; i < 4; i++ {
+		if r := HttpGet("/", httpHandler, t); r.RespCode != 500 {
+			t.Error("Failing backend should return 500")
+		}
+	}
+	if breaker.State() != BreakerOpen {
+		t.Error("Breaker should be open after 4 failures")
+	}
+
+	// Open breaker fails fast without hitting the backend
+	for i := 0; i < 3; i++ {
+		if r := HttpGet("/", httpHandler, t); r.RespCode != http.StatusServiceUnavailable {
+			t.Error("Open breaker should return 503")
+		} else if r.Headers.Get("Retry-After") != "1" {
+			t.Error("Open breaker should ask clients to retry once it's half open, got", r.Headers.Get("Retry-After"))
+		}
+	}
+	if atomic.LoadInt32(&hits) != 4 {
+		t.Error("Backend shouldn't be hit while the breaker is open, hit", atomic.LoadInt32(&hits))
+	}
+
+	// Once OpenDuration has passed a successful probe closes it
+	atomic.StoreInt32(&failing, 0)
+	now = now.Add(time.Second)
+	if r := HttpGet("/", httpHandler, t); r.RespCode != 200 || string(r.Data) != "ok" {
+		t.Error("Probe request should have reached the recovered backend")
+	}
+	if breaker.State() != BreakerClosed {
+		t.Error("Breaker should close after a successful probe")
+	}
+	if r := HttpGet("/", httpHandler, t); r.RespCode != 200 {
+		t.Error("Closed breaker should let requests through")
+	}
+
+	// Hammer a breaker concurrently (checked with -race)
+	breaker = NewCircuitBreaker(CircuitBreakerConfig{ FailureRatio: 0.5, MinRequests: 10, Window: 1000, OpenDuration: 1 })
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if breaker.Allow() {
+					breaker.Record(j % 2 == 0)
+				}
+				breaker.State()
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_request_id.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestRequestIDHandler(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	var seen []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get(HeaderRequestID))
+	}))
+	defer backend.Close()
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: backend.URL }
+	handler := &RequestIDHandler{ Handler: NewHttpHandler(sr, nil) }
+
+	// Generated when missing
+	r := HttpGet("/", handler, t)
+	id := r.Headers.Get(HeaderRequestID)
+	if len(id) != RequestIDBytes * 2 {
+		t.Error("Expected a generated request ID, got:", id)
+	}
+	if len(seen) != 1 || seen[0] != id {
+		t.Error("Upstream should have received the generated ID:", seen)
+	}
+
+	// Preserved when present
+	r = HttpGetWithHeaders("/", handler, map[string][]string{ "X-Request-Id": { "abc-123" } }, t)
+	if r.Headers.Get(HeaderRequestID) != "abc-123" {
+		t.Error("Inbound request ID should be preserved in the response")
+	}
+	if len(seen) != 2 || seen[1] != "abc-123" {
+		t.Error("Inbound request ID should be passed upstream:", seen)
+	}
+
+	// Replaced when it's not something we'd want in a log line
+	for _, invalid := range []string{ "abc 123", "abc\"123", "<script>", strings.Repeat("a", 129) } {
+		r = HttpGetWithHeaders("/", handler, map[string][]string{ "X-Request-Id": { invalid } }, t)
+		if generated := r.Headers.Get(HeaderRequestID); len(generated) != RequestIDBytes * 2 || seen[len(seen) - 1] != generated {
+			t.Error("Invalid request ID", invalid, "should have been replaced, got", generated)
+		}
+	}
+
+	// Different every time
+	if NewRequestID() == NewRequestID() {
+		t.Error("Generated request IDs should be unique")
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_maintenance.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestMaintenanceHandler(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	dir := t.TempDir()
+	page := dir + "/maintenance.html"
+	ioutil.WriteFile(page, []byte("<h1>Back soon</h1>"), 0644)
+
+	called := 0
+	wrapped := &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+		called++
+		w.Write([]byte("normal"))
+	}}
+	sr := &ServerResource { Match: "/", Type: "file_system" }
+	handler := NewMaintenanceHandler(wrapped, sr)
+
+	// Normal serving when switched off
+	if r := HttpGet("/", handler, t); r.RespCode != 200 || string(r.Data) != "normal" || r.Headers.Get(HeaderRetryAfter) != "" {
+		t.Error("Request should be passed through when not in maintenance")
+	}
+
+	// 503 with no page
+	sr.MaintenanceMode = true
+	r := HttpGet("/", handler, t)
+	if r.RespCode != http.StatusServiceUnavailable || r.Headers.Get(HeaderRetryAfter) != "300" || len(r.Data) != 0 {
+		t.Error("Expected a bare 503 with the default Retry-After, got:", r.RespCode, r.Headers)
+	}
+
+	// 503 with the custom page
+	sr.MaintenancePage = page
+	sr.MaintenanceRetryAfter = 60
+	r = HttpGet("/", handler, t)
+	if r.RespCode != http.StatusServiceUnavailable || string(r.Data) != "<h1>Back soon</h1>" || r.Headers.Get(HeaderRetryAfter) != "60" {
+		t.Error("Expected the maintenance page with a 503, got:", r.RespCode, string(r.Data))
+	}
+	if r.Headers.Get(HeaderContentType) != "text/html; charset=utf-8" {
+		t.Error("Maintenance page should have its content type set, got:", r.Headers.Get(HeaderContentType))
+	}
+	if called != 1 {
+		t.Error("Wrapped handler shouldn't be called while in maintenance")
+	}
+
+	// Switched back on
+	sr.MaintenanceMode = false
+	if r := HttpGet("/", handler, t); r.RespCode != 200 || called != 2 {
+		t.Error("Request should be passed through once maintenance is over")
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	for wait, expected := range map[time.Duration]string{ 0: "1", 300 * time.Millisecond: "1", 2500 * time.Millisecond: "3", 5 * time.Second: "5" } {
+		rec := httptest.NewRecorder()
+		setRetryAfter(rec, wait)
+		if rec.Header().Get("Retry-After") != expected {
+			t.Error("Expected Retry-After", expected, "for", wait, "got", rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing server.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestServerReload(t *testing.T) {
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	ioutil.WriteFile(dir1 + "/page.html", []byte("old"), 0644)
+	ioutil.WriteFile(dir2 + "/page.html", []byte("new"), 0644)
+
+	config := func(dir string, match string) []ServerBlock {
+		return []ServerBlock {
+			ServerBlock {
+				Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+				Content: []ServerResource { ServerResource{ Match: match, Type: "file_system", Path: dir } },
+			},
+		}
+	}
+	get := func(server *Server) string {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/page.html", nil))
+		return rec.Body.String()
+	}
+
+	server := NewServer(config(dir1, "/"))
+	if body := get(server); body != "old" {
+		t.Error("Expected the original mapping, got:", body)
+	}
+
+	if err := server.Reload(config(dir2, "/")); err != nil {
+		t.Error("Reload shouldn't fail:", err)
+	}
+	if body := get(server); body != "new" {
+		t.Error("Expected the reloaded mapping, got:", body)
+	}
+
+	// Bad config is rejected and the current one kept
+	if err := server.Reload(config(dir1, "(")); err == nil {
+		t.Error("Reload with an invalid regex should fail")
+	}
+	if body := get(server); body != "new" {
+		t.Error("Failed reload shouldn't replace the running config, got:", body)
+	}
+}
+
+func TestServeUnix(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/page.html", []byte("over a socket"), 0644)
+	socketPath := dir + "/proxy.sock"
+
+	server := NewServer([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Socket: socketPath } },
+			Content: []ServerResource { ServerResource{ Match: "/", Type: "file_system", Path: dir } },
+		},
+	})
+	if err := server.ServeUnix(socketPath); err != nil {
+		t.Fatal("Failed to listen on unix socket:", err)
+	}
+
+	unixClient := &http.Client{ Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	resp, err := unixClient.Get("http://localhost/page.html")
+	if err != nil {
+		t.Fatal("Request over unix socket failed:", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "over a socket" {
+		t.Error("Unexpected response over unix socket:", resp.StatusCode, string(body))
+	}
+
+	// Socket file is cleaned up
+	server.Close()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Error("Socket file should be removed on Close")
+	}
+}
+
+func TestServeUnixTraversal(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir + "/site", 0755)
+	ioutil.WriteFile(dir + "/secret.txt", []byte("secret"), 0644)
+	socketPath := dir + "/proxy.sock"
+
+	server := NewServer([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Socket: socketPath } },
+			Content: []ServerResource { ServerResource{ Match: "/", Type: "file_system", Path: dir + "/site" } },
+		},
+	})
+	if err := server.ServeUnix(socketPath); err != nil {
+		t.Fatal("Failed to listen on unix socket:", err)
+	}
+	defer server.Close()
+
+	if status, body := rawRequest(t, "unix", socketPath, "/../secret.txt"); status != http.StatusBadRequest || strings.Contains(body, "secret") {
+		t.Error("Traversal over the unix socket should be rejected, got", status, body)
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	caCert, clientCert := CreateTestClientCert(t)
+	ioutil.WriteFile(dir + "/clientca.pem", pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: caCert.Raw }), 0644)
+
+	tlsConfig, err := CreateClientAuthTLSConfig(Host{ Host: "localhost", ClientCAFile: dir + "/clientca.pem" })
+	if err != nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatal("Expected RequireAndVerifyClientCert by default:", err)
+	}
+
+	front := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("authenticated"))
+	}))
+	front.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	front.TLS = tlsConfig
+	front.StartTLS()
+	defer front.Close()
+
+	get := func(certs []tls.Certificate) (string, error) {
+		c := &http.Client{ Transport: &http.Transport{ TLSClientConfig: &tls.Config{ InsecureSkipVerify: true, Certificates: certs } } }
+		resp, err := c.Get(front.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	if body, err := get([]tls.Certificate{ clientCert }); err != nil || body != "authenticated" {
+		t.Error("Client with a valid cert should be accepted:", err)
+	}
+	if _, err := get(nil); err == nil {
+		t.Error("Client without a cert should be rejected")
+	}
+
+	// Cert not signed by the client CA
+	_, otherCert := CreateTestClientCert(t)
+	if _, err := get([]tls.Certificate{ otherCert }); err == nil {
+		t.Error("Client with an untrusted cert should be rejected")
+	}
+
+	// Bad config
+	if _, err := CreateClientAuthTLSConfig(Host{ ClientAuth: "sometimes" }); err == nil {
+		t.Error("Unknown ClientAuth should fail")
+	}
+	if _, err := CreateClientAuthTLSConfig(Host{ ClientAuth: ClientAuthRequireAndVerify }); err == nil {
+		t.Error("Verifying without a ClientCAFile should fail")
+	}
+}
+
+func TestExcludeMatching(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/page.html", []byte("static"), 0644)
+	RegisterHandler("api", func(rsc *ServerResource, errorMappings []ErrorMapping) RequestHandler {
+		return RequestHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("api"))
+		})
+	})
+
+	server := NewServer([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource {
+				ServerResource{ Match: "/", Exclude: "^/api", Type: "file_system", Path: dir },
+				ServerResource{ Match: "^/api", Type: "api" },
+			},
+		},
+	})
+	get := func(p string) string {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost" + p, nil))
+		return rec.Body.String()
+	}
+
+	// Matches both Match & Exclude so it falls through to the next resource
+	if body := get("/api/page.html"); body != "api" {
+		t.Error("Excluded path should be routed to the next resource, got", body)
+	}
+	if body := get("/page.html"); body != "static" {
+		t.Error("Path only matching Match should be served by the first resource, got", body)
+	}
+}
+
+func TestExcludedPathNotFound(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/page.html", []byte("static"), 0644)
+
+	server := NewServer([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource {
+				ServerResource{ Match: "/", Exclude: "^/private", Methods: []string{ "GET" }, Type: "file_system", Path: dir },
+			},
+		},
+	})
+
+	// Nothing else handles it so it's a 404 (not a 405, the excluded resource's Methods don't count)
+	for _, method := range []string{ "GET", "POST" } {
+		rec := httptest.NewRecorder()
+		server.Handler().HostHandler(rec, httptest.NewRequest(method, "http://localhost/private/page.html", nil))
+		if rec.Code != http.StatusNotFound || rec.Header().Get("Allow") != "" {
+			t.Error(method, "to an excluded path should be a 404, got", rec.Code)
+		}
+	}
+}
+
+func TestMethodMatching(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/form.html", []byte("static form"), 0644)
+	RegisterHandler("submit", func(rsc *ServerResource, errorMappings []ErrorMapping) RequestHandler {
+		return RequestHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("submitted " + req.Method))
+		})
+	})
+
+	server := NewServer([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource {
+				ServerResource{ Match: "^/form", Methods: []string{ "get", "HEAD" }, Type: "file_system", Path: dir },
+				ServerResource{ Match: "^/form", Type: "submit" },
+			},
+		},
+	})
+	request := func(method string) string {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(method, "http://localhost/form.html", nil))
+		return rec.Body.String()
+	}
+
+	if body := request("GET"); body != "static form" {
+		t.Error("GET should be served by the file_system resource, got", body)
+	}
+	for _, method := range []string{ "POST", "PUT" } {
+		if body := request(method); body != "submitted " + method {
+			t.Error(method, "should be routed to the submit resource, got", body)
+		}
+	}
+}
+
+func TestResourceMethodNotAllowed(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/form.html", []byte("static form"), 0644)
+
+	server := NewServer([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource {
+				ServerResource{ Match: "^/form", Methods: []string{ "GET", "HEAD" }, Type: "file_system", Path: dir },
+				ServerResource{ Match: "^/form", Methods: []string{ "GET", "OPTIONS" }, Type: "file_system", Path: dir },
+			},
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/form.html", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Error("A path handled for other methods should be a 405, got", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "http://localhost/other.html", nil))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Allow") != "" {
+		t.Error("A path nothing handles should be a 404, got", rec.Code)
+	}
+}
+
+func TestHostPatterns(t *testing.T) {
+	site := func(name string) ServerResource {
+		RegisterHandler("site-" + name, func(rsc *ServerResource, errorMappings []ErrorMapping) RequestHandler {
+			return RequestHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(name))
+			})
+		})
+		return ServerResource{ Match: "/", Type: "site-" + name }
+	}
+
+	server := NewServer([]ServerBlock {
+		ServerBlock { Hosts: []Host { Host{ Host: "example.com" } }, Content: []ServerResource { site("default") }, Default: true },
+		ServerBlock { Hosts: []Host { Host{ Host: "*.example.com" } }, Content: []ServerResource { site("wildcard") } },
+		ServerBlock { Hosts: []Host { Host{ Host: "~^api[0-9]+\\.example\\.org$" } }, Content: []ServerResource { site("regex") } },
+		ServerBlock { Hosts: []Host { Host{ Host: "www.example.com" } }, Content: []ServerResource { site("exact") } },
+	})
+
+	tests := map[string]string {
+		"www.example.com": "exact",
+		"blog.example.com": "wildcard",
+		"a.b.Example.com:8080": "wildcard",
+		"api12.example.org": "regex",
+		"api.example.org": "default",
+		"example.com": "default",
+		"other.net": "default",
+	}
+	for host, expected := range tests {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		if rec.Body.String() != expected {
+			t.Error("Host", host, "should have been served by", expected, "got", rec.Body.String())
+		}
+	}
+
+	if _, err := CompileHostPattern("~(["); err == nil {
+		t.Error("Invalid host regex should fail to compile")
+	}
+}
+
+func TestSharedNamedCache(t *testing.T) {
+	site, other := t.TempDir(), t.TempDir()
+	ioutil.WriteFile(site + "/page.txt", []byte("original"), 0644)
+	ioutil.WriteFile(other + "/page.txt", []byte("other site"), 0644)
+	info, _ := os.Stat(site + "/page.txt")
+
+	shared := CacheStrategy{ Name: "shared", Strategy: "lru", Limit: 4096 }
+	block := func(host string, dir string) ServerBlock {
+		return ServerBlock {
+			Hosts: []Host { Host{ Host: host, Port: 80 } },
+			Content: []ServerResource { ServerResource{ Match: "/", Type: "file_system", Path: dir, Cache: shared } },
+		}
+	}
+	server := NewServer([]ServerBlock{ block("a.local", site), block("b.local", site), block("c.local", other) })
+	get := func(host string) string {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "http://" + host + "/page.txt", nil))
+		return rec.Body.String()
+	}
+
+	// Cached by the first block, then changed on disk without touching the modtime so only a cache hit returns the original
+	if body := get("a.local"); body != "original" {
+		t.Fatal("First block should serve the file, got", body)
+	}
+	ioutil.WriteFile(site + "/page.txt", []byte("modified"), 0644)
+	os.Chtimes(site + "/page.txt", info.ModTime(), info.ModTime())
+
+	if body := get("b.local"); body != "original" {
+		t.Error("Second block should see the entry the first block cached, got", body)
+	}
+
+	// Same cache, different directory so it mustn't pick up the other sites entry
+	if body := get("c.local"); body != "other site" {
+		t.Error("Resource with a different Path shouldn't share entries, got", body)
+	}
+}
+
+func TestCreateTLSServerHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	_, cert := CreateTestClientCert(t)
+	key, _ := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	ioutil.WriteFile(dir + "/cert.pem", pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: cert.Certificate[0] }), 0644)
+	ioutil.WriteFile(dir + "/cert.key", pem.EncodeToMemory(&pem.Block{ Type: "PRIVATE KEY", Bytes: key }), 0644)
+
+	protocol := func(host Host) string {
+		tlsServer, err := CreateTLSServer(host, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+		if err != nil {
+			t.Fatal("Failed to create TLS server:", err)
+		}
+		tlsServer.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go tlsServer.ServeTLS(listener, host.CertFile, host.KeyFile)
+		defer tlsServer.Close()
+
+		c := &http.Client{ Transport: &http.Transport{ TLSClientConfig: &tls.Config{ InsecureSkipVerify: true }, ForceAttemptHTTP2: true } }
+		resp, err := c.Get("https://" + listener.Addr().String() + "/")
+		if err != nil {
+			t.Fatal("Request failed:", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != resp.Proto {
+			t.Error("Server and client should agree on the protocol:", string(body), resp.Proto)
+		}
+		return resp.Proto
+	}
+
+	host := Host{ Host: "localhost", CertFile: dir + "/cert.pem", KeyFile: dir + "/cert.key", HTTP2MaxConcurrentStreams: 10 }
+	if proto := protocol(host); proto != "HTTP/2.0" {
+		t.Error("HTTP/2 should be negotiated by default, got", proto)
+	}
+
+	host.DisableHTTP2 = true
+	if proto := protocol(host); proto != "HTTP/1.1" {
+		t.Error("HTTP/2 should be disabled, got", proto)
+	}
+}
+
+func TestServeWithListener(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/page.html", []byte("over tcp"), 0644)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ServeWithListener(listener, []ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource { ServerResource{ Match: "/", Type: "file_system", Path: dir } },
+		},
+	})
+
+	// The listener is already bound so there's nothing to wait for
+	req, _ := http.NewRequest("GET", "http://" + listener.Addr().String() + "/page.html", nil)
+	req.Host = "localhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "over tcp" {
+		t.Error("Unexpected response:", resp.StatusCode, string(body))
+	}
+
+	// Only new connections are refused, the one above is still open
+	server.Close()
+	fresh := &http.Client{ Transport: &http.Transport{ DisableKeepAlives: true } }
+	if _, err := fresh.Get("http://" + listener.Addr().String() + "/page.html"); err == nil {
+		t.Error("Close should stop the listener")
+	}
+}
+
+func TestServeListenerTraversal(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir + "/site", 0755)
+	ioutil.WriteFile(dir + "/secret.txt", []byte("secret"), 0644)
+
+	server := NewServer([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource { ServerResource{ Match: "/", Type: "file_system", Path: dir + "/site" } },
+		},
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ServeListener(listener)
+	defer server.Close()
+
+	if status, body := rawRequest(t, "tcp", listener.Addr().String(), "/../secret.txt"); status != http.StatusBadRequest || strings.Contains(body, "secret") {
+		t.Error("Traversal through ServeListener should be rejected, got", status, body)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	released := make(chan bool)
+	RegisterHandler("hung", func(rsc *ServerResource, errorMappings []ErrorMapping) RequestHandler {
+		return &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/hung" {
+				select {
+				case <-released:
+				case <-req.Context().Done():
+				}
+				return
+			}
+			w.Write([]byte("quick"))
+		} }
+	})
+	defer close(released)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ServeWithListener(listener, []ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource { ServerResource{ Match: "/", Type: "hung" } },
+		},
+	})
+	base := "http://" + listener.Addr().String()
+
+	// An idle keep-alive connection drains straight away
+	if resp, err := http.Get(base + "/quick"); err != nil {
+		t.Fatal("Quick request failed:", err)
+	} else {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// A request stuck on a hung backend
+	hungErr := make(chan error, 1)
+	go func() {
+		client := &http.Client{ Transport: &http.Transport{ DisableKeepAlives: true } }
+		_, err := client.Get(base + "/hung")
+		hungErr <- err
+	}()
+	for deadline := time.Now().Add(2 * time.Second); server.openConnections() < 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	start := time.Now()
+	drained, err := server.Shutdown(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100 * time.Millisecond || elapsed > 2 * time.Second {
+		t.Error("Shutdown should return after the drain timeout, took", elapsed)
+	}
+	if err == nil {
+		t.Error("Shutdown should report it timed out")
+	}
+	if drained != 1 {
+		t.Error("Only the idle connection should have drained, got", drained)
+	}
+
+	select {
+	case err := <-hungErr:
+		if err == nil {
+			t.Error("Hung request's connection should have been closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Hung request's connection wasn't closed")
+	}
+}
+
+func TestHostHandlerLogsRouting(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	blocks := []ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource {
+				ServerResource{ Match: "^/api/", Type: "health" },
+				ServerResource{ Match: "/", Type: "file_system", Path: workingDir + "/testfiles" },
+			},
+		},
+	}
+	server := NewServer(blocks)
+
+	fake := &FakeLogger{}
+	SetLogger(fake)
+	defer SetLogger(nil)
+
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost:8080/test.css", nil))
+	if !fake.Contains("DEBUG", "+HostHandler - Host: localhost Path: /test.css Matched: / Type: file_system") {
+		t.Error("The matched resource should be logged:", fake.Calls)
+	}
+}
+
+func TestServeWithListenerTraversal(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir + "/site", 0755)
+	os.Mkdir(dir + "/secret", 0755)
+	ioutil.WriteFile(dir + "/site/page.html", []byte("public"), 0644)
+	ioutil.WriteFile(dir + "/secret/s.txt", []byte("secret"), 0644)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := ServeWithListener(listener, []ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource { ServerResource{ Match: "/", Type: "file_system", Path: dir + "/site" } },
+		},
+	})
+	defer server.Close()
+
+	for _, target := range []string{ "/../secret/s.txt", "/%2e%2e/secret/s.txt", "/page.html/../../secret/s.txt" } {
+		status, body := rawRequest(t, "tcp", listener.Addr().String(), target)
+		if status != http.StatusBadRequest || strings.Contains(body, "secret") {
+			t.Error(target, "should be rejected, got", status, body)
+		}
+	}
+
+	// Cleaning doesn't stop normal (if untidy) paths being served
+	if status, body := rawRequest(t, "tcp", listener.Addr().String(), "//./page.html"); status != 200 || !strings.HasSuffix(body, "public") {
+		t.Error("Cleaned path should be served, got", status, body)
+	}
+
+	// The loader won't leave the root even if it's handed a .. path
+	if fi, _ := (&FileSystemLoader{}).LocateFile("/../secret/s.txt", &ServerResource{ Path: dir + "/site" }); fi != nil {
+		t.Error("LocateFile shouldn't find files outside the root")
+	}
+}
+
+func TestStartServerAsyncTwice(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/index.html", []byte("index"), 0644)
+
+	// Each server has its own http.Server, nothing's registered globally so a second one can start
+	for _, name := range []string{ "first", "second" } {
+		socketPath := dir + "/" + name + ".sock"
+		server := StartServerAsync([]ServerBlock {
+			ServerBlock {
+				Hosts: []Host { Host{ Host: "localhost", Socket: socketPath } },
+				Content: []ServerResource { ServerResource{ Match: "/", Type: "file_system", Path: dir } },
+			},
+		})
+		defer server.Close()
+
+		if status, body := rawRequest(t, "unix", socketPath, "/index.html"); status != http.StatusOK || !strings.Contains(body, "index") {
+			t.Error(name, "server should serve index.html, got", status, body)
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing config_watcher.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestWatchConfigFile(t *testing.T) {
+	dir1, dir2 := t.TempDir(), t.TempDir()
+	ioutil.WriteFile(dir1 + "/page.html", []byte("old"), 0644)
+	ioutil.WriteFile(dir2 + "/page.html", []byte("new"), 0644)
+
+	configFile := t.TempDir() + "/proxy.config"
+	writeConfig := func(contents string, modTime time.Time) {
+		ioutil.WriteFile(configFile, []byte(contents), 0644)
+		os.Chtimes(configFile, modTime, modTime)
+	}
+	configFor := func(dir string) string {
+		return `[{"hosts": [{"host": "localhost", "port": 80}], "content": [{"type": "file_system", "match": "/", "path": "` + dir + `"}]}]`
+	}
+	get := func(server *Server) string {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/page.html", nil))
+		return rec.Body.String()
+	}
+	waitFor := func(server *Server, expected string) bool {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if get(server) == expected {
+				return true
+			}
+		}
+		return false
+	}
+
+	now := time.Now()
+	writeConfig(configFor(dir1), now.Add(-time.Minute))
+	blocks, _ := LoadConfigFromFile(configFile)
+	server := NewServer(blocks)
+	stop := server.WatchConfigFile(configFile, 5 * time.Millisecond)
+	defer stop()
+
+	// Invalid configs are ignored
+	writeConfig(`[{"hosts": [`, now.Add(-30 * time.Second))
+	time.Sleep(50 * time.Millisecond)
+	if body := get(server); body != "old" {
+		t.Error("Invalid config shouldn't replace the running one, got:", body)
+	}
+
+	writeConfig(configFor(dir2), now)
+	if !waitFor(server, "new") {
+		t.Error("Running handler should have picked up the changed config")
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing serverConfig.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestCheckConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/cert.pem", []byte("cert"), 0644)
+	ioutil.WriteFile(dir + "/key.pem", []byte("key"), 0644)
+
+	check := func(name string, contents string) error {
+		ioutil.WriteFile(dir + "/" + name, []byte(contents), 0644)
+		return CheckConfigFile(dir + "/" + name)
+	}
+
+	valid := `[{"hosts": [{"host": "localhost", "port": 80}, {"host": "secure", "port": 443, "certfile": "` + dir + `/cert.pem", "keyfile": "` + dir + `/key.pem"}],
+		"content": [{"type": "file_system", "match": "^/static", "path": "` + dir + `", "error": [{"match": "^404$", "path": "/404.html"}]},
+			{"type": "http_socket", "match": "/", "path": "http://localhost:8080"}]}]`
+	if err := check("valid.config", valid); err != nil {
+		t.Error("Valid config should pass:", err)
+	}
+
+	if err := CheckConfigFile(dir + "/missing.config"); err == nil {
+		t.Error("Missing config file should fail")
+	}
+	if err := check("json.config", `[{"hosts": [`); err == nil {
+		t.Error("Malformed JSON should fail")
+	}
+
+	// Every problem is reported together
+	invalid := `[{"hosts": [{"host": "localhost", "port": 80}, {"host": "secure", "port": 80, "certfile": "` + dir + `/nocert.pem", "keyfile": "` + dir + `/key.pem"},
+			{"host": "other", "port": 8443, "certfile": "` + dir + `/cert.pem", "keyfile": "` + dir + `/key.pem"}],
+		"content": [{"type": "file_system", "match": "(", "error": [{"match": "[", "path": "/404.html"}]},
+			{"type": "ftp", "match": "/", "balancing": "random", "transport": {"cafile": "` + dir + `/noca.pem"}}]},
+		{"content": []}]`
+	err := check("invalid.config", invalid)
+	if err == nil {
+		t.Fatal("Invalid config should fail")
+	}
+	for _, expected := range []string{ "has no hosts", "nocert.pem", "invalid Match", "invalid Error Match", "unknown Type: ftp", "unknown Balancing: random", "noca.pem",
+			"HTTPS can only be served on one port", "Port 80 is used for both HTTP and HTTPS" } {
+		if !strings.Contains(err.Error(), expected) {
+			t.Error("Expected error to contain", expected, "got:", err)
+		}
+	}
+}
+
+func TestLoadConfigSizeLimit(t *testing.T) {
+	defer func(max int64) { MaxConfigSize = max }(MaxConfigSize)
+	MaxConfigSize = 1024
+
+	// Never ending whitespace, the decoder would keep reading forever
+	endless := &CountingReader{ Reader: io.MultiReader(strings.NewReader("["), &SpaceReader{}) }
+	if _, err := LoadConfigFromReader(endless); err == nil || !strings.Contains(err.Error(), "maximum size") {
+		t.Error("Oversized config should return the limit error, got:", err)
+	}
+	if endless.Count > MaxConfigSize + 1 {
+		t.Error("Shouldn't read past the limit, read", endless.Count)
+	}
+
+	// Just under the limit is fine
+	config := `[{"hosts": [{"host": "localhost", "port": 80}]}]`
+	config += strings.Repeat(" ", int(MaxConfigSize) - len(config))
+	if _, err := LoadConfigFromReader(strings.NewReader(config)); err != nil {
+		t.Error("Config at the limit should load:", err)
+	}
+}
+
+func TestLoadConfigMalformed(t *testing.T) {
+	if _, err := LoadConfigFromReader(strings.NewReader(`[{"hosts": [`)); err == nil || !strings.Contains(err.Error(), "Invalid config JSON") {
+		t.Error("Malformed JSON should return an error, got:", err)
+	}
+}
+
+func TestLoadConfigFromURL(t *testing.T) {
+	config := `[{"hosts": [{"host": "localhost", "port": 80}], "content": [{"match": "/", "type": "file_system", "path": "./testfiles"}]}]`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/config.json":
+			w.Write([]byte(config))
+		case "/huge.json":
+			w.Header().Set("Content-Length", strconv.FormatInt(MaxConfigSize + 1, 10))
+		case "/malformed.json":
+			w.Write([]byte(`[{"hosts": [`))
+		case "/include.json":
+			w.Write([]byte(`[{"include": ["sites/*.json"]}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	blocks, err := LoadConfigFromURL(backend.URL + "/config.json")
+	if err != nil || len(blocks) != 1 || blocks[0].Hosts[0].Port != 80 || blocks[0].Content[0].Path != "./testfiles" {
+		t.Error("Config should load from the URL, got", blocks, err)
+	}
+	if _, err := LoadConfigFromURL(backend.URL + "/missing.json"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Error("A 404 should return an error, got", err)
+	}
+	if _, err := LoadConfigFromURL(backend.URL + "/huge.json"); err == nil || !strings.Contains(err.Error(), "maximum size") {
+		t.Error("An oversized Content-Length should return the limit error, got", err)
+	}
+	if _, err := LoadConfigFromURL(backend.URL + "/malformed.json"); err == nil || !strings.Contains(err.Error(), "Invalid config JSON") {
+		t.Error("Malformed JSON should return an error, got", err)
+	}
+	if _, err := LoadConfigFromURL(backend.URL + "/include.json"); err == nil || !strings.Contains(err.Error(), "Include isn't supported") {
+		t.Error("Include should be rejected for URL configs, got", err)
+	}
+}
+
+func TestLoadConfigFromURLTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { ConfigFetchTimeout = timeout }(ConfigFetchTimeout)
+	ConfigFetchTimeout = 50 * time.Millisecond
+
+	release := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	start := time.Now()
+	if _, err := LoadConfigFromURL(backend.URL + "/config.json"); err == nil {
+		t.Error("A backend that never answers should time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5 * time.Second {
+		t.Error("Should give up after ConfigFetchTimeout, took", elapsed)
+	}
+}
+
+func TestConfigEnvInterpolation(t *testing.T) {
+	t.Setenv("PROXY_TEST_ROOT", "/var/www")
+	t.Setenv("PROXY_TEST_CERTS", "/etc/certs")
+
+	config := `[{"hosts": [{"host": "localhost", "port": 443, "certfile": "${PROXY_TEST_CERTS}/cert.pem",
+		"keyfile": "${PROXY_TEST_KEYS:-/etc/keys}/key.pem"}],
+		"content": [{"match": "/", "type": "file_system", "path": "${PROXY_TEST_ROOT}/site"}]}]`
+	blocks, err := LoadConfigFromReader(strings.NewReader(config))
+	if err != nil {
+		t.Fatal("Config should load:", err)
+	}
+	if blocks[0].Content[0].Path != "/var/www/site" || blocks[0].Hosts[0].CertFile != "/etc/certs/cert.pem" {
+		t.Error("Set variables should be interpolated, got", blocks[0].Content[0].Path, blocks[0].Hosts[0].CertFile)
+	}
+	if blocks[0].Hosts[0].KeyFile != "/etc/keys/key.pem" {
+		t.Error("An unset variable should use its default, got", blocks[0].Hosts[0].KeyFile)
+	}
+
+	missing := `[{"content": [{"match": "/", "type": "file_system", "path": "${PROXY_TEST_MISSING}/site"}]}]`
+	if _, err := LoadConfigFromReader(strings.NewReader(missing)); err == nil || !strings.Contains(err.Error(), "PROXY_TEST_MISSING") {
+		t.Error("An unset variable without a default should return an error naming it, got", err)
+	}
+}
+
+func TestConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(dir + "/sites", 0755)
+	ioutil.WriteFile(dir + "/sites/b.json", []byte(`[{"hosts": [{"host": "b.com", "port": 80}]}]`), 0644)
+	ioutil.WriteFile(dir + "/sites/a.json", []byte(`[{"hosts": [{"host": "a.com", "port": 80}]}]`), 0644)
+	ioutil.WriteFile(dir + "/proxy.config", []byte(`[{"hosts": [{"host": "main.com", "port": 80}]}, {"include": ["sites/*.json"]},
+		{"include": ["sites/b.json"]}]`), 0644)
+
+	blocks, err := LoadConfigFromFile(dir + "/proxy.config")
+	if err != nil {
+		t.Fatal("Config with includes should load:", err)
+	}
+	hosts := make([]string, 0)
+	for _, block := range blocks {
+		hosts = append(hosts, block.Hosts[0].Host)
+	}
+	if strings.Join(hosts, ",") != "main.com,a.com,b.com,b.com" {
+		t.Error("Included blocks should replace the include in sorted order, got", hosts)
+	}
+
+	if _, err := LoadConfigFromFile(dir + "/missing.config"); err == nil {
+		t.Error("A missing config should return an error")
+	}
+	ioutil.WriteFile(dir + "/broken.config", []byte(`[{"include": ["sites/missing.json"]}]`), 0644)
+	if _, err := LoadConfigFromFile(dir + "/broken.config"); err == nil {
+		t.Error("A missing include should return an error")
+	}
+}
+
+func TestConfigCircularInclude(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(dir + "/a.json", []byte(`[{"hosts": [{"host": "a.com", "port": 80}]}, {"include": ["b.json"]}]`), 0644)
+	ioutil.WriteFile(dir + "/b.json", []byte(`[{"include": ["a.json"]}]`), 0644)
+
+	if _, err := LoadConfigFromFile(dir + "/a.json"); err == nil || !strings.Contains(err.Error(), "Circular include") {
+		t.Error("Circular includes should be rejected, got", err)
+	}
+
+	ioutil.WriteFile(dir + "/self.json", []byte(`[{"include": ["self.json"]}]`), 0644)
+	if _, err := LoadConfigFromFile(dir + "/self.json"); err == nil || !strings.Contains(err.Error(), "Circular include") {
+		t.Error("A file including itself should be rejected, got", err)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing upstream.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestWeightedUpstreams(t *testing.T) {
+	BaseUrl = "http://localhost"
+
+	counts := make([]int32, 2)
+	backends := make([]*httptest.Server, 2)
+	for i := range backends {
+		index := i
+		backends[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&counts[index], 1)
+		}))
+		defer backends[i].Close()
+	}
+
+	sr := &ServerResource { Match: "/", Type: "http_socket",
+		Upstreams: []Upstream{ Upstream{ URL: backends[0].URL, Weight: 3 }, Upstream{ URL: backends[1].URL, Weight: 1 } } }
+	httpHandler := NewHttpHandler(sr, nil)
+
+	for i := 0; i < 400; i++ {
+		HttpGet("/", httpHandler, t)
+	}
+	if counts[0] < 290 || counts[0] > 310 || counts[1] < 90 || counts[1] > 110 {
+		t.Error("Expected roughly 300/100 split for weights 3:1, got:", counts)
+	}
+
+	// Smooth, the lighter backend isn't starved for a burst
+	wrr := NewWeightedRoundRobin([]Upstream{ Upstream{ URL: "a", Weight: 3 }, Upstream{ URL: "b", Weight: 1 } })
+	order := ""
+	for i := 0; i < 8; i++ {
+		order += wrr.Select(nil)
+	}
+	if order != "aabaaaba" {
+		t.Error("Unexpected weighted order:", order)
+	}
+}
+
+func TestStickySessions(t *testing.T) {
+	failing := int32(0)
+	backends := make([]*httptest.Server, 3)
+	for i := range backends {
+		name := strconv.Itoa(i)
+		backends[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&failing) == 1 && name == "0" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(name))
+		}))
+		defer backends[i].Close()
+	}
+
+	sr := &ServerResource { Match: "/", Type: "http_socket", StickySessions: true, StickyCookie: "session",
+		Upstreams: []Upstream{ Upstream{ URL: backends[0].URL }, Upstream{ URL: backends[1].URL }, Upstream{ URL: backends[2].URL } },
+		CircuitBreaker: CircuitBreakerConfig{ FailureRatio: 0.5, MinRequests: 2, Window: 60000, OpenDuration: 60000 } }
+	httpHandler := NewHttpHandler(sr, nil)
+
+	get := func(remoteAddr string, cookie string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.RemoteAddr = remoteAddr
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{ Name: "session", Value: cookie })
+		}
+		rec := httptest.NewRecorder()
+		httpHandler.HandleRequest(rec, req)
+		return rec
+	}
+
+	// Same client, same backend. Different clients spread out
+	seen := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		addr := fmt.Sprintf("10.0.0.%d:%d", i, 1000 + i)
+		first := get(addr, "").Body.String()
+		for j := 0; j < 3; j++ {
+			if body := get(fmt.Sprintf("10.0.0.%d:%d", i, 2000 + j), "").Body.String(); body != first {
+				t.Error("Client", addr, "should stick to backend", first, "got", body)
+			}
+		}
+		seen[first] = true
+	}
+	if len(seen) < 2 {
+		t.Error("Different clients should be spread across backends:", seen)
+	}
+
+	// Cookie takes precedence over the IP
+	byCookie := get("10.0.0.1:1", "user-42").Body.String()
+	if body := get("10.0.0.2:1", "user-42").Body.String(); body != byCookie {
+		t.Error("Same cookie from a different IP should stick to", byCookie, "got", body)
+	}
+
+	// Find a client stuck to backend 0, then break it
+	client := ""
+	for i := 0; client == "" && i < 100; i++ {
+		if addr := fmt.Sprintf("10.1.0.%d:1", i); get(addr, "").Body.String() == "0" {
+			client = addr
+		}
+	}
+
+	// Fresh breakers so the earlier successes don't count
+	httpHandler = NewHttpHandler(sr, nil)
+	now := time.Now()
+	breaker := httpHandler.Breakers[backends[0].URL]
+	breaker.Clock = func() time.Time { return now }
+	atomic.StoreInt32(&failing, 1)
+	get(client, "")
+	get(client, "")
+	for i := 0; i < 5; i++ {
+		if rec := get(client, ""); rec.Code != 200 || rec.Body.String() == "0" {
+			t.Error("Client should be rebalanced away from the unhealthy backend, got:", rec.Code, rec.Body.String())
+		}
+	}
+
+	// Once OpenDuration has passed the client goes back to probe its backend, which closes the breaker
+	atomic.StoreInt32(&failing, 0)
+	now = now.Add(time.Minute)
+	if rec := get(client, ""); rec.Code != 200 || rec.Body.String() != "0" {
+		t.Error("Client should be sent back to its recovered backend, got:", rec.Code, rec.Body.String())
+	}
+	if breaker.State() != BreakerClosed {
+		t.Error("Probe should have closed the breaker, it's", breaker.State())
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	upstreams := []Upstream{ Upstream{ URL: "a" }, Upstream{ URL: "b" }, Upstream{ URL: "c" }, Upstream{ URL: "d" } }
+	ring := NewHashRing(upstreams, "")
+	smaller := NewHashRing(upstreams[:3], "")
+
+	moved, counts := 0, make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		key := "/shard/" + strconv.Itoa(i)
+		before := ring.Get(key)
+		if ring.Get(key) != before {
+			t.Error("Same key should always map to the same backend")
+		}
+		counts[before]++
+
+		// Removing d should only remap keys that were on d
+		if after := smaller.Get(key); after != before {
+			moved++
+			if before != "d" {
+				t.Error("Key", key, "moved from", before, "to", after, "but only d was removed")
+			}
+		}
+	}
+	if moved != counts["d"] {
+		t.Error("All of d's keys should have moved, moved", moved, "of", counts["d"])
+	}
+	for _, upstream := range upstreams {
+		if counts[upstream.URL] < 250 {
+			t.Error("Keys should be spread across backends:", counts)
+		}
+	}
+
+	// Through the handler keyed by a header
+	backends := make([]*httptest.Server, 2)
+	for i := range backends {
+		name := strconv.Itoa(i)
+		backends[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer backends[i].Close()
+	}
+	sr := &ServerResource { Match: "/", Type: "http_socket", Balancing: BalanceConsistentHash, HashKey: "X-Tenant",
+		Upstreams: []Upstream{ Upstream{ URL: backends[0].URL }, Upstream{ URL: backends[1].URL } } }
+	httpHandler := NewHttpHandler(sr, nil)
+
+	BaseUrl = "http://localhost"
+	for i := 0; i < 10; i++ {
+		tenant := map[string][]string{ "X-Tenant": { "tenant-" + strconv.Itoa(i) } }
+		first := string(HttpGetWithHeaders("/a", httpHandler, tenant, t).Data)
+		if second := string(HttpGetWithHeaders("/b", httpHandler, tenant, t).Data); second != first {
+			t.Error("Same tenant should go to the same backend regardless of path")
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_concurrency.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestConcurrencyLimiter(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	blocking := &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+	}}
+
+	fire := func(handler RequestHandler, n int) chan int {
+		codes := make(chan int, n)
+		for i := 0; i < n; i++ {
+			go func() {
+				rec := httptest.NewRecorder()
+				handler.HandleRequest(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+				codes <- rec.Code
+			}()
+		}
+		return codes
+	}
+
+	// Excess requests are rejected straight away
+	limiter := NewConcurrencyLimiter(blocking, 2, 0)
+	codes := fire(limiter, 5)
+	<-started
+	<-started
+	rejected := 0
+	for i := 0; i < 3; i++ {
+		if code := <-codes; code == http.StatusServiceUnavailable {
+			rejected++
+		}
+	}
+	if rejected != 3 {
+		t.Error("Expected 3 requests over the limit to get 503, got", rejected)
+	}
+	rec := httptest.NewRecorder()
+	limiter.HandleRequest(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Error("Rejected request should carry Retry-After, got", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	release <- struct{}{}
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != 200 {
+			t.Error("Requests within the limit should succeed, got", code)
+		}
+	}
+
+	// Queued requests get a slot once one is released
+	limiter = NewConcurrencyLimiter(blocking, 1, 5000)
+	codes = fire(limiter, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			<-started
+			release <- struct{}{}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if code := <-codes; code != 200 {
+			t.Error("Queued request should have been handled, got", code)
+		}
+	}
+
+	// Slot is released when the handler panics
+	panicking := NewConcurrencyLimiter(&FuncHandler{ func(w http.ResponseWriter, req *http.Request) { panic("boom") } }, 1, 0)
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() { recover() }()
+			panicking.HandleRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+		}()
+	}
+	if len(panicking.slots) != 0 {
+		t.Error("Slot should be released when the handler panics")
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing buffer_pool.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestBoundedPool(t *testing.T) {
+	sr := &ServerResource { Match: "/", Type: "http_socket", Path: "http://localhost", BufferPoolMax: 8 }
+	pool, ok := NewHttpHandler(sr, nil).BufferPool.(*BoundedPool)
+	if !ok || pool.Max != 8 {
+		t.Fatal("Handler should use a BoundedPool with the configured max")
+	}
+
+	for i := 0; i < 100; i++ {
+		pool.Add(make([]byte, BufferMax))
+	}
+	if pool.Size() != 8 {
+		t.Error("Pool should cap retained buffers at 8, holding", pool.Size())
+	}
+
+	retrieved := 0
+	for _, ok := pool.Retrieve(); ok; _, ok = pool.Retrieve() {
+		retrieved++
+	}
+	if retrieved != 8 || pool.Size() != 0 {
+		t.Error("Expected 8 buffers back from the pool, got", retrieved)
+	}
+
+	if defaultPool := NewHttpHandler(&ServerResource { Match: "/", Type: "http_socket" }, nil).BufferPool.(*BoundedPool); defaultPool.Max != DefaultBufferPoolMax {
+		t.Error("Default max should be", DefaultBufferPoolMax)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_client_ip.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestClientIPHandler(t *testing.T) {
+	var remoteAddr string
+	wrapped := &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+		remoteAddr = req.RemoteAddr
+	} }
+	handler := NewClientIPHandler(wrapped, []string{ "10.0.0.0/8", "192.0.2.1" })
+
+	tests := []struct { peer, forwardedFor, expected string } {
+		// Trusted peer, forwarded header is used
+		{ "10.1.2.3:4000", "203.0.113.5", "203.0.113.5" },
+		{ "192.0.2.1:4000", "203.0.113.5", "203.0.113.5" },
+
+		// Untrusted peer, it could have sent anything
+		{ "198.51.100.7:4000", "203.0.113.5", "198.51.100.7" },
+
+		// Chain of trusted proxies is walked back to the first untrusted address
+		{ "10.1.2.3:4000", "198.51.100.9, 203.0.113.5, 10.0.0.2", "203.0.113.5" },
+
+		// No header or garbage just leaves the peer
+		{ "10.1.2.3:4000", "", "10.1.2.3" },
+		{ "10.1.2.3:4000", "not-an-ip", "10.1.2.3" },
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.RemoteAddr = test.peer
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+
+		if ip := handler.ClientIP(req); ip != test.expected {
+			t.Error("Expected client IP", test.expected, "for peer", test.peer, "got", ip)
+		}
+		handler.HandleRequest(CreateDummyResponseWriter(), req)
+		if remoteAddr != test.expected + ":4000" {
+			t.Error("RemoteAddr should have been set to", test.expected, "got", remoteAddr)
+		}
+	}
+
+	if _, err := ParseTrustedProxies([]string{ "10.0.0.0/33" }); err == nil {
+		t.Error("Invalid CIDR should have returned an error")
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_registry.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestRegisterHandler(t *testing.T) {
+	RegisterHandler("echo", func(rsc *ServerResource, errorMappings []ErrorMapping) RequestHandler {
+		return &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(rsc.Path + req.URL.Path))
+		} }
+	})
+
+	blocks := []ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource { ServerResource{ Match: "/echo", Type: "echo", Path: "echoed:" } },
+		},
+	}
+	if problems := checkConfig(blocks); len(problems) != 0 {
+		t.Error("Registered type shouldn't be a config problem:", problems)
+	}
+
+	server := NewServer(blocks)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/echo/hello", nil))
+	if rec.Body.String() != "echoed:/echo/hello" {
+		t.Error("Request should have been routed to the echo handler, got", rec.Body.String())
+	}
+
+	// Unregistered types still fail
+	blocks[0].Content[0].Type = "unregistered"
+	if err := server.Reload(blocks); err == nil {
+		t.Error("Unknown handler type should fail")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Replacing a built in type should panic")
+		}
+	}()
+	RegisterHandler(FileSystem, nil)
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing middleware.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestMiddlewareChain(t *testing.T) {
+	calls := make([]string, 0)
+	record := func(name string) Middleware {
+		return func(handler RequestHandler) RequestHandler {
+			return RequestHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				calls = append(calls, name + " before")
+				handler.HandleRequest(w, req)
+				calls = append(calls, name + " after")
+			})
+		}
+	}
+	RegisterMiddleware("outer", record("outer"))
+	RegisterMiddleware("inner", record("inner"))
+	RegisterHandler("recorder", func(rsc *ServerResource, errorMappings []ErrorMapping) RequestHandler {
+		return RequestHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			calls = append(calls, "handler")
+		})
+	})
+
+	blocks := []ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Middleware: []string{ "outer" },
+			Content: []ServerResource { ServerResource{ Match: "/", Type: "recorder", Middleware: []string{ "inner" } } },
+		},
+	}
+	NewServer(blocks).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+
+	expected := []string{ "outer before", "inner before", "handler", "inner after", "outer after" }
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Error("Expected middleware order", expected, "got", calls)
+	}
+
+	blocks[0].Content[0].Middleware = []string{ "missing" }
+	if problems := checkConfig(blocks); len(problems) != 1 {
+		t.Error("Unknown middleware should be a config problem, got", problems)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing context.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestRequestContextValues(t *testing.T) {
+	var rsc *ServerResource
+	var clientIP, requestID string
+	RegisterHandler("context", func(resource *ServerResource, errorMappings []ErrorMapping) RequestHandler {
+		return RequestHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rsc = ResourceFromContext(req.Context())
+			clientIP = ClientIPFromContext(req.Context())
+			requestID = RequestIDFromContext(req.Context())
+		})
+	})
+
+	blocks := []ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			TrustedProxies: []string{ "10.0.0.0/8" },
+			Content: []ServerResource {
+				ServerResource{ Match: "^/first", Type: "context", Path: "first" },
+				ServerResource{ Match: "^/second", Type: "context", Path: "second" },
+			},
+		},
+	}
+	server := NewServer(blocks)
+
+	req := httptest.NewRequest("GET", "http://localhost/second", nil)
+	req.RemoteAddr = "10.1.1.1:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	req.Header.Set("X-Request-Id", "abc")
+	server.ServeHTTP(httptest.NewRecorder(), req)
+
+	if rsc == nil || rsc.Path != "second" {
+		t.Error("Handler should be able to read the matched resource from the context, got", rsc)
+	}
+	if clientIP != "203.0.113.5" {
+		t.Error("Expected the resolved client IP in the context, got", clientIP)
+	}
+	if requestID != "abc" {
+		t.Error("Expected the request ID in the context, got", requestID)
+	}
+
+	// Without a trusted proxy it's the peer
+	req = httptest.NewRequest("GET", "http://localhost/first", nil)
+	req.RemoteAddr = "198.51.100.7:5000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	server.ServeHTTP(httptest.NewRecorder(), req)
+	if rsc == nil || rsc.Path != "first" || clientIP != "198.51.100.7" {
+		t.Error("Expected the first resource & peer IP, got", rsc, clientIP)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_canonical_host.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestCanonicalHostHandler(t *testing.T) {
+	served := false
+	wrapped := &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+		served = true
+		w.WriteHeader(http.StatusOK)
+	} }
+	handler := NewCanonicalHostHandler(wrapped, "www.example.com")
+
+	tests := []struct { url, location string } {
+		{ "http://example.com/page?q=1", "http://www.example.com/page?q=1" },
+		{ "https://example.com:8443/a/b", "https://www.example.com:8443/a/b" },
+		{ "http://www.example.com/page", "" },
+		{ "http://WWW.Example.com:8080/page", "" },
+	}
+	for _, test := range tests {
+		served = false
+		w := CreateDummyResponseWriter()
+		handler.HandleRequest(w, httptest.NewRequest("GET", test.url, nil))
+
+		if test.location == "" {
+			if !served || w.RespCode != http.StatusOK {
+				t.Error("Canonical host should be served:", test.url)
+			}
+		} else if served || w.RespCode != http.StatusMovedPermanently || w.Headers.Get("Location") != test.location {
+			t.Error("Expected", test.url, "to redirect to", test.location, "got", w.RespCode, w.Headers.Get("Location"))
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing host_matcher.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestHostMatcher(t *testing.T) {
+	exact := []PathMapping{ PathMapping{ Methods: []string{ "exact" } } }
+	wildcard := []PathMapping{ PathMapping{ Methods: []string{ "wildcard" } } }
+	counting := &CountingMatcher{ Matches: true }
+
+	matcher := NewHostMatcher()
+	matcher.Add("WWW.example.com", exact)
+	matcher.Add("*.example.com", wildcard)
+	matcher.Patterns = append([]HostPattern{ HostPattern{ Pattern: counting } }, matcher.Patterns...)
+
+	// Exact matches (in any case) never evaluate patterns
+	for _, host := range []string{ "www.example.com", "www.EXAMPLE.com" } {
+		if mappings := matcher.Match(host); len(mappings) != 1 || mappings[0].Methods[0] != "exact" {
+			t.Error("Expected the exact mappings for", host)
+		}
+	}
+	if counting.Calls != 0 {
+		t.Error("Exact match shouldn't have evaluated any patterns, evaluated", counting.Calls)
+	}
+
+	// Patterns are tried in order
+	counting.Matches = false
+	if mappings := matcher.Match("blog.example.com"); len(mappings) != 1 || mappings[0].Methods[0] != "wildcard" || counting.Calls != 1 {
+		t.Error("Expected the wildcard mappings after trying the first pattern")
+	}
+
+	// Wildcards need a subdomain
+	if mappings := matcher.Match("example.com"); mappings != nil {
+		t.Error("Bare domain shouldn't match the wildcard")
+	}
+}
+
+func BenchmarkHostMatcher(b *testing.B) {
+	matcher := NewHostMatcher()
+	for i := 0; i < 100; i++ {
+		matcher.Add("site" + strconv.Itoa(i) + ".example.com", []PathMapping{})
+		matcher.Add("*.site" + strconv.Itoa(i) + ".example.org", []PathMapping{})
+		matcher.Add("~^api" + strconv.Itoa(i) + "-[0-9]+\\.example\\.net$", []PathMapping{})
+	}
+
+	for _, host := range []string{ "site50.example.com", "www.site50.example.org", "api50-1.example.net", "unknown.test" } {
+		b.Run(host, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				matcher.Match(host)
+			}
+		})
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_recovery.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestRecoveryHandler(t *testing.T) {
+	RegisterHandler("panics", func(rsc *ServerResource, errorMappings []ErrorMapping) RequestHandler {
+		return &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/panic" {
+				panic("handler blew up")
+			}
+			w.Write([]byte("fine"))
+		} }
+	})
+
+	server := NewServer([]ServerBlock {
+		ServerBlock {
+			Hosts: []Host { Host{ Host: "localhost", Port: 80 } },
+			Content: []ServerResource { ServerResource{ Match: "/", Type: "panics" } },
+		},
+	})
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/panic", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Error("Panicking handler should give a 500, got", rec.Code)
+	}
+	if rec.Header().Get(HeaderRequestID) == "" {
+		t.Error("500 should still carry the request ID")
+	}
+
+	// Server keeps going
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/ok", nil))
+	if rec.Code != 200 || rec.Body.String() != "fine" {
+		t.Error("Server should keep handling requests after a panic, got", rec.Code, rec.Body.String())
+	}
+
+	// Nothing can be done once the response has started, the status stays
+	started := &RecoveryHandler{ &FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("partial"))
+		panic("too late")
+	} } }
+	rec = httptest.NewRecorder()
+	started.HandleRequest(rec, httptest.NewRequest("GET", "http://localhost/", nil))
+	if rec.Code != 200 || rec.Body.String() != "partial" {
+		t.Error("Started response shouldn't be replaced, got", rec.Code, rec.Body.String())
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing cache_lfu.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestLFUCache(t *testing.T) {
+	cb := CreateCacheBuilder()
+	item := func() memcache.CacheItem { return &FileContent{ Data: make([]byte, 10) } }
+
+	// Room for 3 items, a & b are popular but c was used last
+	caches := map[string]memcache.Cache {}
+	for _, strategy := range []string{ LRUCache, LFUCache } {
+		cache, err := cb.CreateCache("", strategy, 30)
+		if cache == nil || err != nil {
+			t.Fatal(strategy, "cache creation should have succeeded")
+		}
+		for _, key := range []string{ "a", "b", "c" } {
+			cache.Add(key, item())
+		}
+		for i := 0; i < 5; i++ {
+			cache.Get("a")
+			cache.Get("b")
+		}
+		cache.Get("c")
+		cache.Add("d", item())
+		caches[strategy] = cache
+	}
+
+	// LRU drops the least recently used (a), LFU the least frequently used (c)
+	if _, ok := caches[LRUCache].Get("a"); ok {
+		t.Error("lru should have evicted a")
+	}
+	if _, ok := caches[LRUCache].Get("c"); !ok {
+		t.Error("lru should have kept c")
+	}
+	if _, ok := caches[LFUCache].Get("c"); ok {
+		t.Error("lfu should have evicted c")
+	}
+	for _, key := range []string{ "a", "b", "d" } {
+		if _, ok := caches[LFUCache].Get(key); !ok {
+			t.Error("lfu should have kept", key)
+		}
+	}
+
+	// Eviction is by size, a big item pushes out several small ones (least frequent first)
+	lfu := CreateLFUCache(30)
+	for _, key := range []string{ "a", "b", "c" } {
+		lfu.Add(key, item())
+	}
+	lfu.Get("c")
+	lfu.Add("big", &FileContent{ Data: make([]byte, 20) })
+	if _, ok := lfu.Get("c"); !ok {
+		t.Error("Most used item should survive")
+	}
+	if _, ok := lfu.Get("a"); ok {
+		t.Error("a should have been evicted to make room")
+	}
+	if err := lfu.Add("huge", &FileContent{ Data: make([]byte, 31) }); err == nil {
+		t.Error("Item bigger than the limit should be rejected")
+	}
+
+	// Safe to share between requests
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa((i + j) % 5)
+				lfu.Add(key, item())
+				lfu.Get(key)
+				if j % 7 == 0 {
+					lfu.Remove(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing cache_fifo.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestFIFOCache(t *testing.T) {
+	cb := CreateCacheBuilder()
+	item := func() memcache.CacheItem { return &FileContent{ Data: make([]byte, 10) } }
+
+	// Room for 3 items, a is used the most but was added first
+	fifo, err := cb.CreateCache("", FIFOCache, 30)
+	if fifo == nil || err != nil {
+		t.Fatal("fifo cache creation should have succeeded")
+	}
+	for _, key := range []string{ "a", "b", "c" } {
+		fifo.Add(key, item())
+	}
+	for i := 0; i < 5; i++ {
+		fifo.Get("a")
+	}
+	if err := fifo.Add("d", item()); err != nil {
+		t.Error("fifo should make room for new items:", err)
+	}
+	if _, ok := fifo.Get("a"); ok {
+		t.Error("fifo should have evicted the oldest added (a) regardless of use")
+	}
+	for _, key := range []string{ "b", "c", "d" } {
+		if _, ok := fifo.Get(key); !ok {
+			t.Error("fifo should have kept", key)
+		}
+	}
+}
+
+func TestNoStoreWhenFullCache(t *testing.T) {
+	cb := CreateCacheBuilder()
+	item := func() memcache.CacheItem { return &FileContent{ Data: make([]byte, 10) } }
+
+	nostore, err := cb.CreateCache("", NoStoreWhenFullCache, 30)
+	if nostore == nil || err != nil {
+		t.Fatal("nostore-when-full cache creation should have succeeded")
+	}
+	for _, key := range []string{ "a", "b", "c" } {
+		nostore.Add(key, item())
+	}
+	if err := nostore.Add("d", item()); err == nil {
+		t.Error("Full cache should refuse new items")
+	}
+	if _, ok := nostore.Get("d"); ok {
+		t.Error("Refused item shouldn't be cached")
+	}
+	for _, key := range []string{ "a", "b", "c" } {
+		if _, ok := nostore.Get(key); !ok {
+			t.Error("Nothing should have been evicted, missing", key)
+		}
+	}
+
+	// Replacing an item reuses its space, removing one makes room
+	if err := nostore.Add("a", item()); err != nil {
+		t.Error("Replacing an item shouldn't need more room:", err)
+	}
+	nostore.Remove("b")
+	if err := nostore.Add("d", item()); err != nil {
+		t.Error("Removing an item should make room:", err)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing cache_lru.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestCacheOnEvict(t *testing.T) {
+	type eviction struct { cacheName string; key string; item memcache.CacheItem }
+
+	for _, strategy := range []string{ LRUCache, LFUCache, FIFOCache } {
+		evictions := make([]eviction, 0)
+		cb := &CacheBuilderImpl{ CacheMap: make(map[string]memcache.Cache) }
+		var cache memcache.Cache
+		cb.OnEvict = func(cacheName string, key string, item memcache.CacheItem) {
+			evictions = append(evictions, eviction{ cacheName, key, item })
+
+			// Called outside the lock so using the cache mustn't deadlock
+			cache.Get(key)
+		}
+		cache, _ = cb.CreateCache("evicting", strategy, 30)
+
+		first := &FileContent{ Data: make([]byte, 10) }
+		cache.Add("first", first)
+		cache.Add("second", &FileContent{ Data: make([]byte, 10) })
+		cache.Add("third", &FileContent{ Data: make([]byte, 10) })
+		cache.Remove("third")
+		cache.Add("third", &FileContent{ Data: make([]byte, 10) })
+		if len(evictions) != 0 {
+			t.Error(strategy, "- removing & adding within the limit shouldn't evict, got", evictions)
+		}
+
+		// Nothing has been used so first goes in every strategy
+		cache.Add("fourth", &FileContent{ Data: make([]byte, 10) })
+		if len(evictions) != 1 || evictions[0].cacheName != "evicting" || evictions[0].key != "first" || evictions[0].item != first {
+			t.Error(strategy, "- expected first to be evicted from 'evicting', got", evictions)
+		}
+	}
+
+	// Caches from CreateCacheBuilder log evictions
+	fake := &FakeLogger{}
+	SetLogger(fake)
+	defer SetLogger(nil)
+	SetLevel(LevelDebug)
+	defer SetLevel(0)
+
+	cache, _ := CreateCacheBuilder().CreateCache("logged", LRUCache, 10)
+	cache.Add("old", &FileContent{ Data: make([]byte, 10) })
+	cache.Add("new", &FileContent{ Data: make([]byte, 10) })
+	if !fake.Contains("DEBUG", "Evicted from cache logged : old 10 bytes") {
+		t.Error("Eviction should have been logged:", fake.Calls)
+	}
+}
+
+func TestLRUCacheWrapsMemcache(t *testing.T) {
+	evicted := make([]string, 0)
+	cache := CreateLRUCache(20).(*LRUCacheImpl)
+	cache.AddOnEvict(func(key string, item memcache.CacheItem) { evicted = append(evicted, key) })
+
+	// Items live in the memcache LRU
+	cache.Add("a", &FileContent{ Data: make([]byte, 10) })
+	cache.Add("b", &FileContent{ Data: make([]byte, 10) })
+	if _, found := cache.Cache.Get("a"); !found {
+		t.Error("Items should be held by the wrapped memcache LRU")
+	}
+
+	// Using a makes b the least recently used, so it's what's reported
+	cache.Get("a")
+	cache.Add("c", &FileContent{ Data: make([]byte, 10) })
+	if _, found := cache.Get("b"); found || len(evicted) != 1 || evicted[0] != "b" {
+		t.Error("b should have been evicted & reported, evicted:", evicted)
+	}
+	if _, found := cache.Get("a"); !found {
+		t.Error("Recently used a should still be cached")
+	}
+
+	// Nothing's reported when memcache refuses an item
+	if err := cache.Add("huge", &FileContent{ Data: make([]byte, 21) }); err == nil || len(evicted) != 1 {
+		t.Error("Oversized item should be refused without evicting anything, evicted:", evicted)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_timeout.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestTimeoutHandler(t *testing.T) {
+	lateWrite := make(chan error, 1)
+	slow := NewTimeoutHandler(RequestHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Slow", "true")
+		select {
+		case <-req.Context().Done():
+			_, err := w.Write([]byte("too late"))
+			lateWrite <- err
+		case <-time.After(5 * time.Second):
+		}
+	}), 50)
+
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	slow.HandleRequest(rec, httptest.NewRequest("GET", "http://localhost/slow", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.Len() != 0 || rec.Header().Get("X-Slow") != "" {
+		t.Error("A slow request should get a 503, got", rec.Code, rec.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 2 * time.Second {
+		t.Error("Shouldn't wait for the handler, took", elapsed)
+	}
+	select {
+	case err := <-lateWrite:
+		if err != http.ErrHandlerTimeout {
+			t.Error("Writes after the timeout should fail, got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("The handler's context should be cancelled")
+	}
+
+	fast := NewTimeoutHandler(RequestHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Fast", "true")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("made it"))
+	}), 1000)
+	rec = httptest.NewRecorder()
+	fast.HandleRequest(rec, httptest.NewRequest("GET", "http://localhost/fast", nil))
+	if rec.Code != http.StatusCreated || rec.Body.String() != "made it" || rec.Header().Get("X-Fast") != "true" {
+		t.Error("A fast response should be passed through, got", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTimeoutHandlerRequestCopy(t *testing.T) {
+	changed := make(chan struct{})
+	handler := NewTimeoutHandler(RequestHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+
+		// Still running after the timeout, as if serving an error page
+		req.URL.Path = "/500.html"
+		req.Header.Del("If-Modified-Since")
+		close(changed)
+	}), 10)
+
+	req := httptest.NewRequest("GET", "http://localhost/slow", nil)
+	req.Header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	rec := httptest.NewRecorder()
+	handler.HandleRequest(rec, req)
+	<-changed
+
+	if rec.Code != http.StatusServiceUnavailable || req.URL.Path != "/slow" || req.Header.Get("If-Modified-Since") == "" {
+		t.Error("Timed out handler shouldn't change the caller's request, got", rec.Code, req.URL.Path, req.Header)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Testing handler_access_log.go
+// ------------------------------------------------------------------------------------------------------------------------
+
+func TestAccessLogger(t *testing.T) {
+	fake := &FakeLogger{}
+	SetLogger(fake)
+	defer SetLogger(nil)
+
+	handler := NewAccessLogger(&FuncHandler{ func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}}, "{client_ip} - {method} {host}{path} -> {status} ({bytes} bytes) took {duration}")
+
+	req := httptest.NewRequest("POST", "http://example.com/items?page=2", nil)
+	req.RemoteAddr = "203.0.113.7:5000"
+	handler.HandleRequest(httptest.NewRecorder(), req)
+
+	expected := "INFO 203.0.113.7 - POST example.com/items?page=2 -> 201 (5 bytes) took "
+	if len(fake.Calls) != 1 || !strings.HasPrefix(fake.Calls[0], expected) || !strings.HasSuffix(fake.Calls[0], "s") {
+		t.Error("Line should be rendered from the template, got", fake.Calls)
+	}
+
+	// The client IP from the context wins (e.g. from a trusted proxy's X-Forwarded-For)
+	NewAccessLogger(handler.Handler, "").HandleRequest(httptest.NewRecorder(), withContextValue(req, clientIPContextKey, "198.51.100.1"))
+	if !fake.Contains("INFO", `198.51.100.1 example.com "POST /items?page=2" 201 5 `) {
+		t.Error("Empty format should use DefaultAccessLogFormat, got", fake.Calls)
+	}
+
+	if _, err := parseAccessLogFormat("{method} {unknown}"); err == nil || !strings.Contains(err.Error(), "{unknown}") {
+		t.Error("Unknown fields should be an error, got", err)
+	}
+}
+
+func TestAccessLoggerErrorPage(t *testing.T) {
+	workingDir, _ := os.Getwd()
+	fake := &FakeLogger{}
+	SetLogger(fake)
+	defer SetLogger(nil)
+
+	// Serving the error page rewrites the URL, the requested path is what's logged
+	sr := &ServerResource { Match: "/", Type: "file_system", Path: workingDir + "/testfiles", NotFoundPage: "/404.txt" }
+	handler := NewAccessLogger(NewFSHandler(sr, CreateErrorMapping(*sr), nil), "{method} {path} {status}")
+	handler.HandleRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/missing.html?x=1", nil))
+	if !fake.Contains("INFO", "GET /missing.html?x=1 404") {
+		t.Error("Requested path should have been logged, got", fake.Calls)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Test Utility/Dummy classes
+// ------------------------------------------------------------------------------------------------------------------------
+
+// FakeLogger (records each call as "LEVEL message")
+
+type FakeLogger struct {
+	Calls []string
+}
+
+func (this *FakeLogger) Debugf(format string, v ...interface{}) {
+	this.Calls = append(this.Calls, "DEBUG " + fmt.Sprintf(format, v...))
+}
+
+func (this *FakeLogger) Infof(format string, v ...interface{}) {
+	this.Calls = append(this.Calls, "INFO " + fmt.Sprintf(format, v...))
+}
+
+func (this *FakeLogger) Warningf(format string, v ...interface{}) {
+	this.Calls = append(this.Calls, "WARNING " + fmt.Sprintf(format, v...))
+}
+
+func (this *FakeLogger) Errorf(format string, v ...interface{}) {
+	this.Calls = append(this.Calls, "ERROR " + fmt.Sprintf(format, v...))
+}
+
+func (this *FakeLogger) Contains(level string, message string) bool {
+	for _, call := range this.Calls {
+		if strings.HasPrefix(call, level + " ") && strings.Contains(call, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// DummyResponseWriter
+
+type DummyResponseWriter struct {
+	Headers http.Header
+	Data []byte
+	RespCode int
+}
+
+func CreateDummyResponseWriter() *DummyResponseWriter {
+	return &DummyResponseWriter { Headers: make(map[string][]string), Data: nil, RespCode: 200 }
+}
+
+func (this *DummyResponseWriter) Header() http.Header {
+	return this.Headers
+}
+
+func (this *DummyResponseWriter) Write(newData []byte) (int, error) {
+	this.Data = append(this.Data, newData...)
+	return len(newData), nil
+}
+
+func (this *DummyResponseWriter) WriteHeader(respCode int) {
+	this.RespCode = respCode
+}
+
+// FuncHandler (RequestHandler calling a function so tests can control behaviour)
+
+type FuncHandler struct {
+	Func func(w http.ResponseWriter, req *http.Request)
+}
+
+func (this *FuncHandler) HandleRequest(w http.ResponseWriter, req *http.Request) {
+	this.Func(w, req)
+}
+
+// DummyCacheBuilder
+
+type DummyCacheBuilder struct {
+	Cache *DummyCache
+}
+
+func (this *DummyCacheBuilder) CreateCache(cacheName string, cacheType string, cacheLimit int) (memcache.Cache, error) {
+	this.Cache = &DummyCache{}
+	return this.Cache, nil
+}
+
+// DummyCache
+
+type DummyCache struct {
+	lastAddKey string
+	lastAddVal memcache.CacheItem
+	lastGetKey string
+	lastRemoveKey string
+}
+
+func (this *DummyCache) Add(key string, val memcache.CacheItem) error {
+	this.lastAddKey = key
+	this.lastAddVal = val
+	return nil
+}
+
+func (this *DummyCache) Get(key string) (memcache.CacheItem, bool) {
+	this.lastGetKey = key
+	return nil, false
+}
+
+func (this *DummyCache) Remove(key string) {
+	this.lastRemoveKey = key
+}
+
+// MapCacheBuilder
+
+type MapCacheBuilder struct {
+	Cache *MapCache
+}
+
+func (this *MapCacheBuilder) CreateCache(cacheName string, cacheType string, cacheLimit int) (memcache.Cache, error) {
+	this.Cache = &MapCache{ Items: make(map[string]memcache.CacheItem) }
+	return this.Cache, nil
+}
+
+// WrongCacheItem (a cache item which isn't *FileContent)
+
+type WrongCacheItem struct {
+}
+
+func (this *WrongCacheItem) Size() int {
+	return 1
+}
+
+// MapCache (stores items so tests can inspect what's been cached)
+
+type MapCache struct {
+	Items map[string]memcache.CacheItem
+}
+
+func (this *MapCache) Add(key string, val memcache.CacheItem) error {
+	this.Items[key] = val
+	return nil
+}
+
+func (this *MapCache) Get(key string) (memcache.CacheItem, bool) {
+	val, ok := this.Items[key]
+	return val, ok
+}
+
+func (this *MapCache) Remove(key string) {
+	delete(this.Items, key)
+}
+
+// Utility http request functions
+
+func HttpGet(path string, handler RequestHandler, t *testing.T) (*DummyResponseWriter) {
+	return HttpGetWithHeaders(path, handler, nil, t)
+}
+
+func HttpGetWithHeaders(path string, handler RequestHandler, headers map[string][]string, t *testing.T) (*DummyResponseWriter) {
+	if rq, err := http.NewRequest("GET", BaseUrl + path, nil); err != nil {
+		t.Error("Failed to create request " + path)
+		return nil
+	} else {
+		// Add additional headers
+		if headers != nil {
+			for k, v := range headers {
+				rq.Header[k] = v
+			}
+		}
+
+		rw := CreateDummyResponseWriter()
+		handler.HandleRequest(rw, rq)
+		return rw
+	}
+}
+
+// rawRequest sends target as-is in a GET request line to addr (so nothing cleans it) and returns the status & body
+
+func rawRequest(t *testing.T, network string, addr string, target string) (int, string) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal("Reading response failed:", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// SpaceReader
+
+type SpaceReader struct {
+}
+
+func (this *SpaceReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
+
+// CountingReader
+
+type CountingReader struct {
+	Reader io.Reader
+	Count int64
+}
+
+func (this *CountingReader) Read(p []byte) (int, error) {
+	n, err := this.Reader.Read(p)
+	this.Count += int64(n)
+	return n, err
+}
+// CountingRetriever
+
+type CountingRetriever struct {
+	Wrapped FileRetriever
+	Reads int
+}
+
+func (this *CountingRetriever) GetFile(req *http.Request, resource *ServerResource, compression bool) (*FileContent, error) {
+	this.Reads++
+	return this.Wrapped.GetFile(req, resource, compression)
+}
+
+func (this *CountingRetriever) LocateFile(requestPath string, res *ServerResource) (os.FileInfo, string) {
+	return this.Wrapped.(FileLocator).LocateFile(requestPath, res)
+}
+
+// HeaderRetriever (FileRetriever whose content is the value of a request header)
+
+type HeaderRetriever struct {
+	Header string
+	Wrapped FileRetriever
+	Reads int
+}
+
+func (this *HeaderRetriever) GetFile(req *http.Request, resource *ServerResource, compression bool) (*FileContent, error) {
+	this.Reads++
+	fc, err := this.Wrapped.GetFile(req, resource, compression)
+	if err != nil {
+		return nil, err
+	}
+	return &FileContent{ fc.FileInfo, fc.AbsolutePath, []byte(req.Header.Get(this.Header)), false, fc.IgnoreCompression, fc.MimeType }, nil
+}
+
+// CountingMatcher (StringMatcher counting how often it's evaluated)
+
+type CountingMatcher struct {
+	Matches bool
+	Calls int
+}
+
+func (this *CountingMatcher) MatchString(s string) bool {
+	this.Calls++
+	return this.Matches
+}
+
+// CreateTestClientCert returns a self-signed CA and a client certificate signed by it
+
+func CreateTestClientCert(t *testing.T) (*x509.Certificate, tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{ SerialNumber: big.NewInt(1), Subject: pkix.Name{ CommonName: "Test CA" },
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign, BasicConstraintsValid: true }
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal("Failed to create CA:", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientTemplate := &x509.Certificate{ SerialNumber: big.NewInt(2), Subject: pkix.Name{ CommonName: "Test Client" },
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageClientAuth } }
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal("Failed to create client cert:", err)
+	}
+	return caCert, tls.Certificate{ Certificate: [][]byte{ clientDER }, PrivateKey: clientKey }
+}
+
+
+// Write test for server.go
 
 // Write test for handler_filesystem
 
@@ -1,11 +1,21 @@
 package reverseproxy
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"net/http"
 	"fmt"
 	"strings"
 	"regexp"
+	"net"
+	"os"
+	"path"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Handler types. Known 'type' to use inside content block
@@ -13,6 +23,32 @@ const (
 	FileSystem = "file_system"
 	UnixSocket = "unix_socket"
 	HttpSocket = "http_socket"
+	Metrics = "metrics"
+	Health = "health"
+)
+
+var (
+	// builtInTypes are the handler types createServerHandler knows without registration
+	builtInTypes = []string{ FileSystem, UnixSocket, HttpSocket, Metrics, Health }
+)
+
+// Client certificate modes. Known 'clientauth' values for a host
+const (
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+	ClientAuthVerifyIfGiven = "verify_if_given"
+	ClientAuthRequireAndVerify = "require_and_verify"
+)
+
+const (
+	// DefaultDrainTimeout is how long Shutdown waits for in-flight requests if it's not given a timeout
+	DefaultDrainTimeout = 30 * time.Second
+)
+
+// Error patterns used for the ServerResource NotFoundPage & ServerErrorPage convenience fields
+const (
+	NotFoundMatch = "^404$"
+	ServerErrorMatch = "^5[0-9][0-9]$"
 )
 
 var (
@@ -39,15 +75,20 @@ type RequestHandler interface {
 // It's used to first match on a 'Host' and then match on the path requested
 type ServerHandler struct {
 
-	// HostMappings is used to grab the []PathMapping slice based on the host passed into the request
-	HostMappings map[string][]PathMapping
-	
-	// DefaultMappings holds a (ptr to) slice labelled as the default if no Host match is found
-	DefaultMappings []PathMapping
+	// Hosts is used to grab the []PathMapping slice based on the host passed into the request, its Default is used
+	// if no Host match is found
+	Hosts *HostMatcher
 }
 
 // HostHandler takes a request and passes it 
 func (sh *ServerHandler) HostHandler(w http.ResponseWriter, req *http.Request) {
+	// We're served without a ServeMux so nothing else has cleaned the path
+	if !cleanRequestPath(req) {
+		Debug("+HostHandler - Rejecting path:", req.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	// Remove port if required
 	host := req.Host
 	colonIndex := strings.Index(host, ":")
@@ -56,17 +97,32 @@ func (sh *ServerHandler) HostHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Get correct ServerBlock
-	mappings, OK := sh.HostMappings[host]
-	if !OK {
-		mappings = sh.DefaultMappings
-	}
+	mappings := sh.Hosts.Match(host)
 
 	// Now we need to match path
-	mapping := matchMapping(mappings, req)
+	mapping, allowed := matchMapping(mappings, req)
 	if mapping != nil {
+		handlerType := ""
+		if mapping.Resource != nil {
+			handlerType = mapping.Resource.Type
+		}
+		Debug("+HostHandler - Host:", host, "Path:", req.URL.Path, "Matched:", mapping.Pattern.String(), "Type:", handlerType)
+
+		req = withContextValue(req, resourceContextKey, mapping.Resource)
+		req = withContextValue(req, clientIPContextKey, remoteIP(req))
 		mapping.Handler.HandleRequest(w, req)
+
+	// Something handles the path, just not with this method
+	} else if len(allowed) > 0 {
+		Debug("+HostHandler - Method not allowed - Host:", host, "Path:", req.URL.Path, "Method:", req.Method)
+		w.Header()[HeaderAllow] = []string{ strings.Join(allowed, ", ") }
+		w.Header()[HeaderCacheControl] = []string{ ValueCacheControlError }
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
 	} else {
-		panic("Implement 404 handler")
+		Debug("+HostHandler - No match - Host:", host, "Path:", req.URL.Path)
+		w.Header()[HeaderCacheControl] = []string{ ValueCacheControlError }
+		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
@@ -80,8 +136,17 @@ type PathMapping struct {
 	// Pattern is a regex expression used to see if the request path matches
 	Pattern *regexp.Regexp
 
+	// Exclude is a regex expression, paths matching it are skipped even if Pattern matches (nil excludes nothing)
+	Exclude *regexp.Regexp
+
+	// Methods are the request methods this mapping handles, empty handles them all
+	Methods []string
+
 	// Handler is the interface implementation called (to write the response) if Pattern matches
 	Handler RequestHandler
+
+	// Resource is the ServerResource Handler was created from
+	Resource *ServerResource
 }
 
 // ------------------------------------------------------------------------------------------------------------------------
@@ -98,11 +163,22 @@ type ErrorMapping struct {
 	Path string
 }
 
+// CreateErrorMapping compiles the Error entries of a ServerResource
+//
+// NotFoundPage & ServerErrorPage are appended after them so explicit Error entries take precedence
 func CreateErrorMapping(resource ServerResource) []ErrorMapping {
-	if resource.Error != nil {
+	errorRedirects := append([]ErrorRedirect(nil), resource.Error...)
+	if resource.NotFoundPage != "" {
+		errorRedirects = append(errorRedirects, ErrorRedirect{ Match: NotFoundMatch, Path: resource.NotFoundPage })
+	}
+	if resource.ServerErrorPage != "" {
+		errorRedirects = append(errorRedirects, ErrorRedirect{ Match: ServerErrorMatch, Path: resource.ServerErrorPage })
+	}
+
+	if errorRedirects != nil {
 		em := make([]ErrorMapping, 0)
 		
-		for _, errorRedirect := range resource.Error {
+		for _, errorRedirect := range errorRedirects {
 			re, err := regexp.Compile(errorRedirect.Match)
 			if err != nil {
 				panic(err)
@@ -120,19 +196,68 @@ func CreateErrorMapping(resource ServerResource) []ErrorMapping {
 // ------------------------------------------------------------------------------------------------------------------------
 
 // matchMapping runs through PathMappings and returns a single mapping if its regular expression matches the request URL.Path
-func matchMapping(mappings []PathMapping, req *http.Request) *PathMapping {
+//
+// If none match it returns the Methods of any mappings that only failed on the request method (for an Allow header)
+func matchMapping(mappings []PathMapping, req *http.Request) (*PathMapping, []string) {
+	allowed := make([]string, 0)
 	for _, mapping := range mappings {
-		if mapping.Pattern.MatchString(req.URL.Path) {
-			return &mapping
+		if !mapping.Pattern.MatchString(req.URL.Path) || (mapping.Exclude != nil && mapping.Exclude.MatchString(req.URL.Path)) {
+			continue
+		}
+		if len(mapping.Methods) == 0 || containsString(mapping.Methods, req.Method) {
+			return &mapping, nil
+		}
+		for _, method := range mapping.Methods {
+			if !containsString(allowed, method) {
+				allowed = append(allowed, method)
+			}
 		}
 	}
-	return nil
+	return nil, allowed
+}
+
+// cleanRequestPath cleans req.URL.Path (collapsing repeated slashes & . segments, keeping a trailing slash)
+//
+// Returns false if the path has a .. segment, those are never sent by browsers and are only used to escape a root
+func cleanRequestPath(req *http.Request) bool {
+	requestPath := req.URL.Path
+	if !strings.HasPrefix(requestPath, "/") {
+		return true
+	}
+	for _, segment := range strings.Split(requestPath, "/") {
+		if segment == ".." {
+			return false
+		}
+	}
+
+	cleaned := path.Clean(requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	if cleaned != requestPath {
+		req.URL.Path = cleaned
+		req.URL.RawPath = ""
+	}
+	return true
+}
+
+// hasResourceType checks whether any ServerResource in the config is of handlerType
+func hasResourceType(blocks []ServerBlock, handlerType string) bool {
+	for _, sb := range blocks {
+		for _, resource := range sb.Content {
+			if resource.Type == handlerType {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // listenAndServe runs through server blocks and figures out what ports to listen on + whether its http or https
-func listenAndServe(serverBlocks []ServerBlock) {
+func listenAndServe(server *Server, serverBlocks []ServerBlock) {
 
 	portsServed := make(map[int]bool)
+	socketsServed := make(map[string]bool)
 	tlsPort := -1
 
 	for _, serverBlock := range serverBlocks {
@@ -143,8 +268,17 @@ func listenAndServe(serverBlocks []ServerBlock) {
 			// ...we haven't so create port string
 			strPort := strconv.Itoa(host.Port)
 
+			// Using a unix socket
+			if host.Socket != "" {
+				if _, present := socketsServed[host.Socket]; !present {
+					if err := server.ServeUnix(host.Socket); err != nil {
+						panic(err)
+					}
+					socketsServed[host.Socket] = true
+				}
+
 			// Using https
-			if host.CertFile != "" && host.KeyFile != "" {
+			} else if host.CertFile != "" && host.KeyFile != "" {
 				// We've already called ListenAndServeTLS()
 				if tlsPort != -1 {
 					// ...and now we're trying to use it for another virtual host on a different port, this can't work
@@ -153,7 +287,12 @@ func listenAndServe(serverBlocks []ServerBlock) {
 					}
 					
 				} else {
-					go http.ListenAndServeTLS(":" + strPort, host.CertFile, host.KeyFile, nil)
+					tlsServer, err := CreateTLSServer(host, server)
+					if err != nil {
+						panic(err)
+					}
+					server.track(tlsServer)
+					go tlsServer.ListenAndServeTLS(host.CertFile, host.KeyFile)
 					tlsPort = host.Port
 				}
 
@@ -161,7 +300,8 @@ func listenAndServe(serverBlocks []ServerBlock) {
 			} else {
 				// Check we've not already called ListenAndServe on this port...
 				if _, present := portsServed[host.Port]; !present {
-					go http.ListenAndServe(":" + strPort, nil)
+					httpServer := server.track(&http.Server{ Addr: ":" + strPort, Handler: server })
+					go httpServer.ListenAndServe()
 					portsServed[host.Port] = true
 				}
 			}
@@ -170,13 +310,78 @@ func listenAndServe(serverBlocks []ServerBlock) {
 }	
 
 
+// CreateTLSServer returns the http.Server for a HTTPS host, serving requests with handler
+//
+// HTTP/2 is offered (via ALPN) unless the host has DisableHTTP2 set
+func CreateTLSServer(host Host, handler http.Handler) (*http.Server, error) {
+	tlsConfig, err := CreateClientAuthTLSConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsServer := &http.Server{ Addr: ":" + strconv.Itoa(host.Port), Handler: handler, TLSConfig: tlsConfig }
+	if host.DisableHTTP2 {
+		// net/http only sets up HTTP/2 if TLSNextProto is nil
+		tlsServer.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	} else if host.HTTP2MaxConcurrentStreams > 0 {
+		tlsServer.HTTP2 = &http.HTTP2Config{ MaxConcurrentStreams: host.HTTP2MaxConcurrentStreams }
+	}
+	return tlsServer, nil
+}
+
+// CreateClientAuthTLSConfig returns the tls.Config to verify client certificates for host, nil if it doesn't use them
+func CreateClientAuthTLSConfig(host Host) (*tls.Config, error) {
+	if host.ClientCAFile == "" && host.ClientAuth == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	switch host.ClientAuth {
+	case ClientAuthRequest:
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	case ClientAuthVerifyIfGiven:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequireAndVerify, "":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Unknown ClientAuth: %s", host.ClientAuth)
+	}
+
+	if host.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(host.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in ClientCAFile: %s", host.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+
+	// Verifying needs something to verify against
+	} else if tlsConfig.ClientAuth == tls.VerifyClientCertIfGiven || tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("ClientAuth %s needs a ClientCAFile", host.ClientAuth)
+	}
+	return tlsConfig, nil
+}
+
 // createServerHandler runs through []ServerBlock and outputs ServerHandler which is used for routing http requests
 func createServerHandler(blocks []ServerBlock) (*ServerHandler) {
 
+	// One builder for every block so resources naming the same cache share it
 	cacheBuilder := CreateCacheBuilder()
 
+	// Metrics are only collected if there's a resource to expose them
+	var collector *MetricsCollector
+	if hasResourceType(blocks, Metrics) {
+		collector = NewMetricsCollector()
+	}
+
 	// Create our ServerHandler to hold all host/path mappings
-	sh := ServerHandler { HostMappings: make(map[string][]PathMapping) }
+	sh := ServerHandler { Hosts: NewHostMatcher() }
 	defaultMapping := 0
 
 	for index, sb := range blocks {
@@ -205,22 +410,109 @@ func createServerHandler(blocks []ServerBlock) (*ServerHandler) {
 				p = PathMapping {Pattern: re, Handler: NewHttpHandler( &resource, CreateErrorMapping(resource) )}
 			case HttpSocket:
 				p = PathMapping {Pattern: re, Handler: NewUnixHandler( &resource, CreateErrorMapping(resource) )}
+			case Health:
+				p = PathMapping {Pattern: re, Handler: NewHealthHandler( &resource, CreateErrorMapping(resource) )}
+			case Metrics:
+				p = PathMapping {Pattern: re, Handler: NewMetricsHandler( &resource, CreateErrorMapping(resource), collector )}
 			default:
-				panic(fmt.Sprintf("Unknown handler Type: %s", resource.Type))
+				factory, present := lookupHandler(resource.Type)
+				if !present {
+					panic(fmt.Sprintf("Unknown handler Type: %s", resource.Type))
+				}
+				p = PathMapping {Pattern: re, Handler: factory( &resource, CreateErrorMapping(resource) )}
+			}
+			p.Resource = &resource
+			for _, method := range resource.Methods {
+				p.Methods = append(p.Methods, strings.ToUpper(method))
+			}
+
+			// Paths to leave for the resources after this one
+			if resource.Exclude != "" {
+				exclude, err := regexp.Compile(resource.Exclude)
+				if err != nil {
+					panic(err)
+				}
+				p.Exclude = exclude
+			}
+
+			// Limit requests in flight, inside maintenance so that doesn't take a slot
+			if resource.MaxConcurrent > 0 {
+				p.Handler = NewConcurrencyLimiter(p.Handler, resource.MaxConcurrent, resource.MaxConcurrentQueueTimeout)
+			}
+
+			// Give up on slow requests, waiting for a slot counts towards the time
+			if resource.RequestTimeout > 0 {
+				p.Handler = NewTimeoutHandler(p.Handler, resource.RequestTimeout)
+			}
+
+			// Return 503 instead of serving while the resource is offline
+			if resource.MaintenanceMode {
+				p.Handler = NewMaintenanceHandler(p.Handler, &resource)
+			}
+
+			// Add/remove request & response headers
+			if hasHeaderRules(&resource) {
+				p.Handler = NewHeaderRewriter(p.Handler, &resource)
+			}
+
+			// Answer CORS preflights and add Access-Control-Allow-* headers
+			if len(resource.CORS.AllowedOrigins) > 0 {
+				p.Handler = NewCORSHandler(p.Handler, &resource)
+			}
+
+			// Registered middleware, the blocks runs before the resources
+			chain, err := lookupMiddleware(append(append([]string{}, sb.Middleware...), resource.Middleware...))
+			if err != nil {
+				panic(err)
+			}
+			p.Handler = Chain(p.Handler, chain...)
+
+			// Log requests that take longer than the blocks threshold
+			if sb.SlowRequestThreshold > 0 {
+				p.Handler = NewSlowRequestLogger(p.Handler, sb.SlowRequestThreshold)
+			}
+
+			// Record requests against the collector (but not scrapes of the metrics themselves)
+			if collector != nil && resource.Type != Metrics {
+				p.Handler = &MetricsRecorder{ Handler: p.Handler, Resource: resource.Match, Collector: collector }
+			}
+
+			// Redirect anything not on the canonical host before doing any work
+			if sb.CanonicalHost != "" {
+				p.Handler = NewCanonicalHostHandler(p.Handler, sb.CanonicalHost)
+			}
+
+			// Log every request (including canonical redirects), inside ClientIP so it has the real client address
+			if sb.AccessLog {
+				p.Handler = NewAccessLogger(p.Handler, sb.AccessLogFormat)
 			}
 
+			// Everything inside sees the real client address
+			if len(sb.TrustedProxies) > 0 {
+				p.Handler = NewClientIPHandler(p.Handler, sb.TrustedProxies)
+			}
+
+			// A panic anywhere inside is a 500 for this request rather than a dropped connection
+			p.Handler = &RecoveryHandler{ Handler: p.Handler }
+
+			// Make sure every request (and the upstream request) carries an X-Request-ID
+			p.Handler = &RequestIDHandler{ Handler: p.Handler }
+
 			// Add mapping to our slice
 			pathMappings = append(pathMappings, p)
 		}
 
-		// Run through hostnames and create hashmap (TODO - probably better with trie here)
+		// Run through hostnames and add them to the matcher, patterns are kept in order
 		for _, host := range sb.Hosts {
-			sh.HostMappings[host.Host] = pathMappings
+			if err := sh.Hosts.Add(host.Host, pathMappings); err != nil {
+				panic(err)
+			}
+		}
+		if index == defaultMapping {
+			sh.Hosts.Default = pathMappings
 		}
 	}
 
-	// Set the default mapping if there are no host matches
-	sh.DefaultMappings = sh.HostMappings[blocks[defaultMapping].Hosts[0].Host]
 	return &sh
 }
 
@@ -228,14 +520,195 @@ func createServerHandler(blocks []ServerBlock) (*ServerHandler) {
 // Exported function
 // ------------------------------------------------------------------------------------------------------------------------
 
+// ServeWithListener creates a Server for serverBlocks and serves it on l rather than the ports in the config (doesn't
+// block)
+//
+// It's mainly for tests, l can be bound to port 0 and it's accepting connections as soon as this returns
+func ServeWithListener(l net.Listener, serverBlocks []ServerBlock) *Server {
+	server := NewServer(serverBlocks)
+	server.ServeListener(l)
+	return server
+}
+
 // StartServerAync starts the server (doesn't block)
-func StartServerAsync(serverBlocks []ServerBlock) {
+//
+// The returned Server can be used to Reload the config, ports aren't changed by a reload
+func StartServerAsync(serverBlocks []ServerBlock) *Server {
 	// Normalise config and create all handlers
-	sh := createServerHandler(serverBlocks)
-
-	// Match base path so everything is passed through our handler
-	http.HandleFunc("/", sh.HostHandler)
+	server := NewServer(serverBlocks)
 
 	// Start listening on specified ports
-	listenAndServe(serverBlocks)
+	listenAndServe(server, serverBlocks)
+	return server
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: Server
+// ------------------------------------------------------------------------------------------------------------------------
+
+// Server routes requests through the current ServerHandler, which can be swapped out with Reload
+type Server struct {
+
+	// handler holds the current *ServerHandler, requests in flight keep the one they started with
+	handler atomic.Value
+
+	// listeners are the unix sockets & other listeners we're serving on, closed (and removed) by Close
+	listeners []net.Listener
+
+	// listenersMutex guards listeners & servers
+	listenersMutex sync.Mutex
+
+	// servers are the http.Servers started for us, stopped by Shutdown
+	servers []*http.Server
+
+	// connections are the open client connections to servers, guarded by connectionsMutex
+	connections map[net.Conn]bool
+	connectionsMutex sync.Mutex
+}
+
+// NewServer returns a Server routing with the config in serverBlocks (it doesn't listen)
+func NewServer(serverBlocks []ServerBlock) *Server {
+	server := &Server{}
+	server.handler.Store(createServerHandler(serverBlocks))
+	return server
+}
+
+// ServeHTTP passes the request to the current ServerHandler
+func (this *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	this.Handler().HostHandler(w, req)
+}
+
+// Handler returns the current ServerHandler
+func (this *Server) Handler() *ServerHandler {
+	return this.handler.Load().(*ServerHandler)
+}
+
+// ServeUnix listens on the unix socket at socketPath and serves requests with this Server (doesn't block)
+//
+// A stale socket file left by a previous run is removed first. Like every listener there's no ServeMux in front, request
+// paths are cleaned (and .. rejected) by HostHandler
+func (this *Server) ServeUnix(socketPath string) error {
+	if fi, err := os.Stat(socketPath); err == nil && fi.Mode() & os.ModeSocket != 0 {
+		os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+
+	this.ServeListener(listener)
+	return nil
+}
+
+// ServeListener serves requests accepted by listener with this Server (doesn't block), it's closed by Close
+//
+// The Server is the http.Server's Handler (no ServeMux), so HostHandler cleans request paths and rejects ..
+func (this *Server) ServeListener(listener net.Listener) {
+	this.listenersMutex.Lock()
+	this.listeners = append(this.listeners, listener)
+	this.listenersMutex.Unlock()
+
+	httpServer := this.track(&http.Server{ Handler: this })
+	go httpServer.Serve(listener)
+}
+
+// Shutdown stops accepting connections and waits (up to drainTimeout) for in-flight requests to finish, anything
+// still open after that is closed. Zero uses DefaultDrainTimeout
+//
+// Returns the number of connections which finished (or were idle) before the timeout
+func (this *Server) Shutdown(drainTimeout time.Duration) (int, error) {
+	if drainTimeout <= 0 {
+		drainTimeout = DefaultDrainTimeout
+	}
+
+	this.listenersMutex.Lock()
+	servers := this.servers
+	this.servers = nil
+	this.listenersMutex.Unlock()
+
+	open := this.openConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	var err error
+	for _, httpServer := range servers {
+		if shutdownErr := httpServer.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+
+	// A hung backend shouldn't be able to hold us up forever
+	forced := 0
+	if ctx.Err() != nil {
+		forced = this.openConnections()
+		Warning("Shutdown timed out, closing", forced, "connections")
+		for _, httpServer := range servers {
+			httpServer.Close()
+		}
+	}
+	Info("Shutdown drained", open - forced, "connections")
+	return open - forced, err
+}
+
+// track records httpServer (and its connections) so Shutdown can stop it
+func (this *Server) track(httpServer *http.Server) *http.Server {
+	httpServer.ConnState = this.trackConnection
+
+	this.listenersMutex.Lock()
+	this.servers = append(this.servers, httpServer)
+	this.listenersMutex.Unlock()
+	return httpServer
+}
+
+// trackConnection is the http.Server ConnState hook keeping connections up to date
+func (this *Server) trackConnection(conn net.Conn, state http.ConnState) {
+	this.connectionsMutex.Lock()
+	defer this.connectionsMutex.Unlock()
+
+	if this.connections == nil {
+		this.connections = make(map[net.Conn]bool)
+	}
+	if state == http.StateClosed || state == http.StateHijacked {
+		delete(this.connections, conn)
+	} else {
+		this.connections[conn] = true
+	}
+}
+
+// openConnections returns the number of connections to our servers which haven't closed
+func (this *Server) openConnections() int {
+	this.connectionsMutex.Lock()
+	defer this.connectionsMutex.Unlock()
+	return len(this.connections)
+}
+
+// Close stops serving on the unix sockets & listeners, the socket files are removed
+func (this *Server) Close() error {
+	this.listenersMutex.Lock()
+	defer this.listenersMutex.Unlock()
+
+	var firstErr error
+	for _, listener := range this.listeners {
+		if err := listener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	this.listeners = nil
+	return firstErr
+}
+
+// Reload swaps in the config from serverBlocks for new requests
+//
+// If the config can't be used (e.g. a bad regex) an error is returned and the current config is kept
+func (this *Server) Reload(serverBlocks []ServerBlock) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Invalid config: %v", r)
+		}
+	}()
+
+	this.handler.Store(createServerHandler(serverBlocks))
+	Info("Config reloaded")
+	return nil
 }
\ No newline at end of file
@@ -1,9 +1,28 @@
 package reverseproxy
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// MaxConfigSize is the most bytes LoadConfigFromReader will read
+	MaxConfigSize int64 = 10 * 1024 * 1024
+
+	// envPattern matches ${VAR} and ${VAR:-default} in config values
+	envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+	// ConfigFetchTimeout is how long LoadConfigFromURL waits for the whole config to download
+	ConfigFetchTimeout = 10 * time.Second
 )
 
 // ------------------------------------------------------------------------------------------------------------------------
@@ -23,6 +42,37 @@ type ServerBlock struct {
 
 	// Default indicates that if theres no host matches then use this as the default
 	Default bool
+
+	// SlowRequestThreshold is a duration in milliseconds, requests to these Hosts taking longer are logged as a warning
+	//
+	// Zero (the default) turns slow request logging off
+	SlowRequestThreshold int
+
+	// AccessLog logs a line (at info level) for every request to these Hosts
+	AccessLog bool
+
+	// AccessLogFormat is the template for AccessLog lines, fields like {method} {path} {status} {duration} {client_ip}
+	// {bytes} {host} & {request_id} are replaced for each request. Defaults to DefaultAccessLogFormat
+	AccessLogFormat string
+
+	// TrustedProxies are CIDRs (or single IPs) of proxies in front of us
+	//
+	// X-Forwarded-For is only used to find the client IP if the request came directly from one of these, otherwise
+	// the peer address is used. Empty (the default) trusts nobody
+	TrustedProxies []string
+
+	// CanonicalHost, if set, is the only Host served by the block. Requests for its other Hosts are 301'd to it
+	// (e.g. example.com to www.example.com)
+	CanonicalHost string
+
+	// Middleware are the names of registered Middleware (see RegisterMiddleware) wrapped around every resource in
+	// the block, the first runs first
+	Middleware []string
+
+	// Include lists other config files (or globs of them, expanded in sorted order) whose ServerBlocks take this
+	// block's place, in order. Relative paths are from the including file. A block with Include shouldn't set
+	// anything else, the rest of it is ignored
+	Include []string
 }
 
 // ------------------------------------------------------------------------------------------------------------------------
@@ -33,6 +83,9 @@ type ServerBlock struct {
 type Host struct {
 
 	// Host is used to match the "Host" header passed by the HTTP request
+	//
+	// It can be a wildcard (*.example.com matches any subdomain) or a regex prefixed with ~ (e.g. ~^api[0-9]+\.example\.com$).
+	// Exact hosts are matched first, then patterns in config order
 	Host string
 
 	// CertFile is used to point to the location of a certificate for HTTPS (empty if http)
@@ -43,6 +96,22 @@ type Host struct {
 
 	// Indicates port to start/listen on
 	Port int
+
+	// Socket is the path of a unix socket to listen on instead of Port (e.g. when sitting behind another proxy)
+	Socket string
+
+	// ClientCAFile is a PEM bundle of CAs client certificates must be signed by (mutual TLS), only used for HTTPS
+	ClientCAFile string
+
+	// ClientAuth is how client certificates are checked: "request", "require", "verify_if_given" or
+	// "require_and_verify". Defaults to "require_and_verify" if there's a ClientCAFile
+	ClientAuth string
+
+	// DisableHTTP2 only speaks HTTP/1.1 over HTTPS, otherwise clients can negotiate HTTP/2
+	DisableHTTP2 bool
+
+	// HTTP2MaxConcurrentStreams is the most streams a HTTP/2 client can have open at once, zero uses Go's default (250)
+	HTTP2MaxConcurrentStreams int
 }
 
 // ------------------------------------------------------------------------------------------------------------------------
@@ -57,6 +126,14 @@ type ServerResource struct {
 	// If its not matched then this resource won't be run - simples
 	Match string
 
+	// Exclude is an optional regular expression, paths matching it aren't handled by this resource even if Match
+	// matches (e.g. Match "/" with Exclude "^/api" serves everything except the API)
+	Exclude string
+
+	// Methods is an optional list of request methods (e.g. GET, HEAD) this resource handles, requests using any other
+	// method are matched against the following resources. Empty handles every method
+	Methods []string
+
 	// Type is the type of handler we want
 	//
 	// Right now we have a couple:
@@ -64,6 +141,8 @@ type ServerResource struct {
 	//	file_system - Form an absolute path from 'Path' and the request path and return a file
 	//	unix_socket - Direct the request to another service listening on a unix socket
 	//	http_socket - Direct the request to another service listening on a http socket
+	//	metrics - Serve request counts & latencies for all other resources in Prometheus text format
+	//	health - Serve a {"status":"ok"} liveness/readiness response for load balancers
 	Type string
 
 	// Path depends on Type but it'll indicate either a filesystem root or a socket address
@@ -72,11 +151,32 @@ type ServerResource struct {
 	// Then we'll look for a file at /var/www/somedomain/static/index.html.
 	// 
 	// If type is *_socket then it should contain the uri:port to pass it to
+	//
+	// Like the other file & address values it can use environment variables as ${VAR} or ${VAR:-default}
 	Path string
 
+	// Roots is only used if the Type is set to file_system
+	//
+	// Filesystem roots searched in order for each request (the first with the file wins), used instead of Path if
+	// set. Lets an override directory sit in front of a base one e.g. ["/site/override", "/site/base"]
+	Roots []string
+
 	// CacheStrategy is specified if we want to use in-memory caching
 	Cache CacheStrategy
 
+	// CacheControl replaces the default Cache-Control ("must-revalidate, private") sent with files, e.g.
+	// "public, max-age=31536000, immutable" for assets that never change. Expires follows its max-age
+	CacheControl string
+
+	// Fingerprint is an optional regular expression matching the names of fingerprinted files, e.g.
+	// "\\.[0-9a-f]{8,}\\.(js|css)$" for app.3f9a12bc.js. They're sent with a year long immutable Cache-Control and
+	// everything else with CacheControl, or a 5 minute max-age if that's not set
+	Fingerprint string
+
+	// NoCachePatterns are optional regular expressions, request paths matching any of them are never cached (e.g.
+	// "^/api/") even though the rest of the resource is
+	NoCachePatterns []string
+
 	// FileSystemConfig is only used if the Type is set to file_system
 	//
 	// Used to specify defaults if a full file path isn't specified
@@ -85,8 +185,295 @@ type ServerResource struct {
 	// Compression indiciates whether we want to return gzip'd responses
 	Compression bool
 
+	// CompressibleTypes are the content types worth compressing, either exact or a type/* wildcard. Defaults to text/*,
+	// application/json, application/javascript & image/svg+xml
+	CompressibleTypes []string
+
+	// MimeTypes maps file extensions (e.g. ".wasm") to content types, they're checked before the built in ones
+	MimeTypes map[string]string
+
+	// DefaultMimeType is the content type for files with an extension neither MimeTypes or the built in ones know
+	// (e.g. application/octet-stream for a downloads directory). If empty it's sniffed from the file's content
+	DefaultMimeType string
+
+	// Charset is added to text based content types, defaults to utf-8
+	Charset string
+
+	// CompressionLevel is the gzip level used when Compression is set, from -2 (huffman only) to 9 (best compression)
+	//
+	// Zero isn't a usable level here, it means the default (-1) is used
+	CompressionLevel int
+
+	// SPAFallback is only used if the Type is set to file_system
+	//
+	// It's the (relative) path of a file, e.g. /index.html, served instead of a 404 when a request without
+	// an extension can't be found. This lets single page apps handle deep links. Missing assets still 404
+	SPAFallback string
+
+	// WellKnownDefaults is only used if the Type is set to file_system
+	//
+	// If set a built-in /robots.txt (which allows everything) and /favicon.ico (a blank icon) are served when
+	// the files don't exist, rather than a 404
+	WellKnownDefaults bool
+
+	// TrailingSlash is only used if the Type is set to file_system
+	//
+	// It enforces canonical directory URLs with a 301 redirect. 'add' redirects /blog to /blog/ (if /blog/ resolves
+	// to a default file), 'remove' redirects /blog/ to /blog. Empty (the default) doesn't redirect
+	TrailingSlash string
+
 	// Error provides a map to match http error codes to error pages so the user is served these instead
 	Error []ErrorRedirect
+
+	// ErrorRoot is a directory on disk the Error pages are served from (e.g. one shared /var/www/errors), rather than
+	// the resources own Path. Error pages from it aren't cached
+	ErrorRoot string
+
+	// ErrorFormat decides how errors are rendered. Empty or 'html' uses the Error pages (or a bare status if there
+	// isn't one), 'json' sends {"error":"not found","status":404} and 'text' sends "404 not found"
+	ErrorFormat string
+
+	// NotFoundPage is the (relative) path of a page served for 404s, an Error entry matching 404 takes precedence
+	NotFoundPage string
+
+	// ServerErrorPage is the (relative) path of a page served for any 5xx, an Error entry matching the code takes precedence
+	ServerErrorPage string
+
+	// MaxConcurrent limits how many requests to this resource are handled at once (e.g. to protect a fragile
+	// backend), zero for no limit
+	MaxConcurrent int
+
+	// MaxConcurrentQueueTimeout is how long in milliseconds a request over MaxConcurrent waits for a slot before
+	// getting a 503. Zero returns the 503 straight away
+	MaxConcurrentQueueTimeout int
+
+	// RequestTimeout is how long in milliseconds a request to this resource has to complete (including any wait for
+	// a MaxConcurrent slot) before the client gets a 503. Responses are buffered when it's set, zero for no timeout
+	RequestTimeout int
+
+	// MaintenanceMode takes the resource offline, every request gets a 503 with a Retry-After header
+	MaintenanceMode bool
+
+	// MaintenancePage is the path (on disk, not relative to Path) of a page served while in MaintenanceMode
+	MaintenancePage string
+
+	// MaintenanceRetryAfter is the Retry-After in seconds sent while in MaintenanceMode, defaults to 300
+	MaintenanceRetryAfter int
+
+	// TreatEmptyResponseAsError is only used if the Type is set to *_socket
+	//
+	// Some backends return a 200 with an empty body on internal errors. If this is set we treat that as
+	// a bad gateway (502) and run it through the error handling instead of passing the empty body on
+	TreatEmptyResponseAsError bool
+
+	// TLSFallbackPath is only used if the Type is set to *_socket
+	//
+	// If the TLS handshake with the backend at Path fails (expired or untrusted cert) the request is sent here
+	// instead. If it's empty the client gets a bad gateway (502)
+	TLSFallbackPath string
+
+	// HealthChecks is only used if the Type is set to health
+	//
+	// It lists upstreams (urls or host:port) that must be reachable for a 200, otherwise a 503 is returned
+	HealthChecks []string
+
+	// ResponseRewrite is only used if the Type is set to *_socket
+	//
+	// Substitutions applied (in order) to text/* response bodies, e.g. to replace http://internal with https://public
+	ResponseRewrite []ResponseRewrite
+
+	// AddHeaders are set on the response just before it's written, e.g. Strict-Transport-Security
+	AddHeaders map[string]string
+
+	// RemoveHeaders are stripped from the response just before it's written, e.g. Server
+	RemoveHeaders []string
+
+	// AddRequestHeaders are set on the incoming request before it's handled (and passed on to any backend)
+	AddRequestHeaders map[string]string
+
+	// RemoveRequestHeaders are stripped from the incoming request before it's handled (and passed on to any backend)
+	RemoveRequestHeaders []string
+
+	// CORS allows cross origin requests to this resource, it's switched off if there are no AllowedOrigins
+	CORS CORSConfig
+
+	// Middleware are the names of registered Middleware (see RegisterMiddleware) wrapped around this resource, the
+	// first runs first. They run after the blocks Middleware
+	Middleware []string
+
+	// BufferSize is only used if the Type is set to *_socket
+	//
+	// The size in bytes of the buffers response bodies are streamed through, defaults to 32KB
+	BufferSize int
+
+	// BufferPoolMax is only used if the Type is set to *_socket
+	//
+	// The most idle response buffers kept for reuse, defaults to 64
+	BufferPoolMax int
+
+	// Upstreams is only used if the Type is set to *_socket
+	//
+	// Backends to spread requests across (by Weight), used instead of Path if set
+	Upstreams []Upstream
+
+	// Balancing is how requests are spread across Upstreams, weighted round-robin if empty or "consistent_hash" to
+	// always send the same key (see HashKey) to the same backend
+	Balancing string
+
+	// HashKey is the request header used as the key for consistent_hash Balancing, the request path is used if empty
+	HashKey string
+
+	// StickySessions sends requests from the same client to the same one of the Upstreams
+	StickySessions bool
+
+	// StickyCookie is the name of a cookie identifying the client for StickySessions, the client IP is used if empty
+	StickyCookie string
+
+	// ForwardHeaders is only used if the Type is set to *_socket
+	//
+	// If set only these client request headers are sent to the backend (X-Request-ID is always sent)
+	ForwardHeaders []string
+
+	// BlockHeaders is only used if the Type is set to *_socket. Client request headers that are never sent to the backend
+	BlockHeaders []string
+
+	// UpstreamHost is only used if the Type is set to *_socket
+	//
+	// Host header sent to the backend. Empty keeps the clients Host, "upstream" uses the backends own host and anything
+	// else is sent as is
+	UpstreamHost string
+
+	// ForwardedHost is only used if the Type is set to *_socket. Passes the clients Host to the backend in X-Forwarded-Host
+	ForwardedHost bool
+
+	// RewriteLocation is only used if the Type is set to *_socket. Redirects are passed on to the client rather than
+	// followed, and absolute Location headers pointing at the backend are rewritten to the scheme & host the client used
+	RewriteLocation bool
+
+	// CompressUpstream is only used if the Type is set to *_socket. Responses of a CompressibleTypes type the backend
+	// didn't compress are gzip'd on the way through (streamed, without a Content-Length) for clients that accept gzip
+	CompressUpstream bool
+
+	// Transport is only used if the Type is set to *_socket
+	//
+	// Used to specify timeouts for requests to the backend
+	Transport TransportConfig
+
+	// CircuitBreaker is only used if the Type is set to *_socket
+	//
+	// Used to stop sending requests to a failing backend (returning 503), it's switched off if FailureRatio is zero
+	CircuitBreaker CircuitBreakerConfig
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: CORSConfig
+// ------------------------------------------------------------------------------------------------------------------------
+
+// CORSConfig is used to configure which cross origin requests are allowed
+type CORSConfig struct {
+
+	// AllowedOrigins lists origins (e.g. https://example.com) allowed to make requests, '*' allows any
+	AllowedOrigins []string
+
+	// AllowedMethods lists methods returned to preflight requests, defaults to GET, HEAD & POST
+	AllowedMethods []string
+
+	// AllowedHeaders lists request headers returned to preflight requests, if empty the requested headers are allowed
+	AllowedHeaders []string
+
+	// AllowCredentials indicates whether cookies/auth can be sent with cross origin requests, only from origins listed
+	// in AllowedOrigins (it can't be used with '*')
+	AllowCredentials bool
+
+	// MaxAge is how long (in seconds) a preflight response can be cached, zero leaves it to the browser
+	MaxAge int
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: TransportConfig
+// ------------------------------------------------------------------------------------------------------------------------
+
+// TransportConfig is used to configure timeouts (all in milliseconds) for requests to a backend, zero means no timeout
+type TransportConfig struct {
+
+	// DialTimeout limits how long we wait to connect, so a backend that's down fails fast
+	DialTimeout int
+
+	// ResponseHeaderTimeout limits how long we wait for the response headers once the request is sent
+	ResponseHeaderTimeout int
+
+	// Timeout limits the whole request, including reading the response body
+	Timeout int
+
+	// MaxRetries is how many times an idempotent request (GET, HEAD, PUT etc.) is retried if we fail to connect/get
+	// a response. Error responses (5xx) aren't retried
+	MaxRetries int
+
+	// RetryBackoff is how long to wait before the first retry, it's doubled for each subsequent retry
+	RetryBackoff int
+
+	// CAFile is a PEM bundle of CAs trusted for https backends (e.g. self-signed), the system roots are used if empty
+	CAFile string
+
+	// CertFile & KeyFile are the client certificate presented to https backends that require mTLS
+	CertFile string
+	KeyFile string
+
+	// InsecureSkipVerify switches off verification of the backends certificate, only use it for testing
+	InsecureSkipVerify bool
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: Upstream
+// ------------------------------------------------------------------------------------------------------------------------
+
+// Upstream is a backend requests can be proxied to
+type Upstream struct {
+
+	// URL of the backend, same format as ServerResource.Path
+	URL string
+
+	// Weight is the share of requests the backend gets relative to the others, defaults to 1
+	Weight int
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: CircuitBreakerConfig
+// ------------------------------------------------------------------------------------------------------------------------
+
+// CircuitBreakerConfig is used to configure when a backend is considered to be failing
+//
+// A request fails if we can't connect/get a response or the backend returns a 5xx
+type CircuitBreakerConfig struct {
+
+	// FailureRatio (0-1) is the proportion of failed requests within Window that opens the breaker
+	FailureRatio float64
+
+	// MinRequests is the number of requests needed within Window before the ratio is checked
+	MinRequests int
+
+	// Window is the duration in milliseconds failures are counted over
+	Window int
+
+	// OpenDuration is how long in milliseconds requests are rejected before a probe request is let through
+	OpenDuration int
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: ResponseRewrite
+// ------------------------------------------------------------------------------------------------------------------------
+
+// ResponseRewrite is a substitution applied to proxied text response bodies
+type ResponseRewrite struct {
+
+	// From is the content to replace, it's a regular expression if Regex is set
+	From string
+
+	// To is the replacement. If Regex is set it can reference capture groups from From ($1 etc)
+	To string
+
+	// Regex indicates From is a regular expression rather than a plain string
+	Regex bool
 }
 
 // ------------------------------------------------------------------------------------------------------------------------
@@ -98,16 +485,44 @@ type CacheStrategy struct {
 
 	// CacheName is used when creating/accessing the cache
 	//
-	// It allows multiple ServerResource blocks to share the same cache if required
+	// It allows multiple ServerResource blocks (in any ServerBlock) to share the same cache if required. Resources serving
+	// different directories keep separate entries in it
 	Name string
 
 	// Strategy indicates the caching algorithm used.
 	//
-	// Right now this can only be lru, empty if no cache required
+	// lru (least recently used), lfu (least frequently used), fifo (oldest added) or nostore-when-full (never evicts,
+	// new files aren't cached once it's full). Empty if no cache required
 	Strategy string
 
 	// CacheLimit is the maximum size in bytes the cache is allowed to grow to
 	Limit int
+
+	// Store indicates which variant is cached when compression is on
+	//
+	// Empty caches both, 'compressed' only caches gzip'd content (decompressed for clients that can't accept it)
+	// and 'identity' only caches uncompressed content (compressed for clients that can). Pick based on your client mix
+	Store string
+
+	// RevalidateInterval is a duration in milliseconds we trust a cached file for before checking it's not changed on disk
+	//
+	// Zero (the default) checks on every request
+	RevalidateInterval int
+
+	// Precompress loads every text file under the resources Path into the cache at startup (compressed, if the
+	// ServerResource has Compression on) so the first requests don't pay for it. It stops once Limit is reached
+	Precompress bool
+
+	// VaryHeaders are request headers (e.g. Accept-Language) the content depends on, each value listed for it in
+	// VaryValues (which it must have) gets its own cache entry. They're also added to the responses Vary header
+	VaryHeaders []string
+
+	// VaryValues lists the values of each of VaryHeaders worth caching separately (e.g. "Accept-Language": ["en", "fr"])
+	//
+	// The first listed value found in the request header (a comma separated list, parameters like ;q= are ignored) picks
+	// the entry, requests with none of them share one. Only listed values are used so clients can't fill the cache with
+	// made up ones
+	VaryValues map[string][]string
 }
 
 // ------------------------------------------------------------------------------------------------------------------------
@@ -130,6 +545,10 @@ type FileSystemDefaults struct {
 	// This allows us to have search engine friend urls. For example, if '/index' is requested we
 	// could have []string{ ".html" } here so /index.html is returned
 	DefaultExtensions []string
+
+	// NegotiateExtensions orders the DefaultExtensions by the requests Accept header, so with ".html" and ".json"
+	// a client accepting application/json gets /data.json for /data
+	NegotiateExtensions bool
 }
 
 // ------------------------------------------------------------------------------------------------------------------------
@@ -153,25 +572,397 @@ type ErrorRedirect struct {
 // ------------------------------------------------------------------------------------------------------------------------
 
 // LoadConfigFromFile parses and returns our []ServerBlock from the config file it's been passed
+//
+// Relative Include paths are resolved against the config file's directory
 func LoadConfigFromFile(configLocation string) ([]ServerBlock, error) {
-	file, err := os.Open(configLocation)
+	sb, err := decodeConfigFile(configLocation)
+	if err != nil {
+		return nil, err
+	}
 
+	loading, err := filepath.Abs(configLocation)
 	if err != nil {
-		return nil, err	
+		return nil, err
+	}
+	if sb, err = includeConfigs(sb, filepath.Dir(configLocation), []string{ loading }); err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(sb); err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
+
+// LoadConfigFromURL downloads, parses and returns our []ServerBlock from the config at url
+//
+// The download is abandoned after ConfigFetchTimeout and, like LoadConfigFromReader, configs over MaxConfigSize
+// return an error. Only 200 responses are accepted. Include isn't allowed, there's no local directory its paths could
+// sensibly be relative to
+func LoadConfigFromURL(url string) ([]ServerBlock, error) {
+	client := &http.Client{ Timeout: ConfigFetchTimeout }
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	return LoadConfigFromReader(file)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching config from %s returned %s", url, resp.Status)
+	}
+
+	// Don't bother downloading it if the backend's already told us it's too big
+	if resp.ContentLength > MaxConfigSize {
+		return nil, fmt.Errorf("Config exceeds the maximum size of %d bytes", MaxConfigSize)
+	}
+
+	sb, err := decodeConfig(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range sb {
+		if len(block.Include) > 0 {
+			return nil, fmt.Errorf("Include isn't supported in configs loaded from a URL (%s)", url)
+		}
+	}
+
+	if err := validateConfig(sb); err != nil {
+		return nil, err
+	}
+	return sb, nil
 }
 
 // LoadConfigFromFile parses and returns our []ServerBlock from the Reader it's been passed
+//
+// At most MaxConfigSize bytes are read, larger configs return an error. There's no timeout, a plain io.Reader can't
+// be interrupted so a hung read would only leave a goroutine behind, readers that can hang should bring their own
+// (e.g. LoadConfigFromURL uses ConfigFetchTimeout). Relative Include paths are resolved against the working directory
 func LoadConfigFromReader(config io.Reader) ([]ServerBlock, error) {
+	sb, err := decodeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if sb, err = includeConfigs(sb, ".", nil); err != nil {
+		return nil, err
+	}
+
+	if err := validateConfig(sb); err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
+
+// decodeConfigFile opens and decodes the config file at configLocation, see decodeConfig
+func decodeConfigFile(configLocation string) ([]ServerBlock, error) {
+	file, err := os.Open(configLocation)
+
+	if err != nil {
+		return nil, err	
+	}
+	defer file.Close()
+
+	return decodeConfig(file)
+}
+
+// decodeConfig parses and interpolates the []ServerBlock in config, leaving includes & validation to the caller
+func decodeConfig(config io.Reader) ([]ServerBlock, error) {
 	sb := make([]ServerBlock, 0)
-	d := json.NewDecoder(config)
+	limited := &io.LimitedReader{ R: config, N: MaxConfigSize + 1 }
+	d := json.NewDecoder(limited)
 	decodeErr := d.Decode(&sb)
 
+	// Ran out of allowance, we only read one byte past the limit
+	if limited.N <= 0 {
+		return nil, fmt.Errorf("Config exceeds the maximum size of %d bytes", MaxConfigSize)
+	}
+
 	if decodeErr != nil {
-		panic(decodeErr)
+		return nil, fmt.Errorf("Invalid config JSON: %v", decodeErr)
 	}
 
-	return sb, decodeErr
+	if err := interpolateConfig(sb); err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
+
+// includeConfigs returns blocks with each Include block replaced by the blocks of the files it names
+//
+// Relative paths are resolved against dir. loading holds the absolute paths of the files currently being loaded
+// (outermost first), finding one of them again means the includes are circular
+func includeConfigs(blocks []ServerBlock, dir string, loading []string) ([]ServerBlock, error) {
+	included := make([]ServerBlock, 0, len(blocks))
+	for _, block := range blocks {
+		if len(block.Include) == 0 {
+			included = append(included, block)
+			continue
+		}
+
+		for _, pattern := range block.Include {
+			files, err := includeFiles(dir, pattern)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, file := range files {
+				for _, l := range loading {
+					if l == file {
+						return nil, fmt.Errorf("Circular include of %s: %s", file, strings.Join(append(loading, file), " -> "))
+					}
+				}
+
+				sb, err := decodeConfigFile(file)
+				if err != nil {
+					return nil, err
+				}
+				if sb, err = includeConfigs(sb, filepath.Dir(file), append(loading[:len(loading):len(loading)], file)); err != nil {
+					return nil, err
+				}
+				included = append(included, sb...)
+			}
+		}
+	}
+	return included, nil
+}
+
+// includeFiles returns the absolute paths pattern refers to (relative to dir), globs are expanded in sorted order
+func includeFiles(dir string, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+
+	files := []string{ pattern }
+	if strings.ContainsAny(pattern, "*?[") {
+		var err error
+		if files, err = filepath.Glob(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid Include %s: %v", pattern, err)
+		}
+		sort.Strings(files)
+	}
+
+	for i, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = abs
+	}
+	return files, nil
+}
+
+// CheckConfigFile loads the config file and checks it can be served (without starting anything)
+//
+// It checks regexes compile, handler types are known, cert/key files exist and the ports don't conflict. Every
+// problem found is returned in a single error, nil means the config is valid
+func CheckConfigFile(configLocation string) error {
+	blocks, err := LoadConfigFromFile(configLocation)
+	if err != nil {
+		return fmt.Errorf("Invalid config file %s: %v", configLocation, err)
+	}
+
+	if problems := checkConfig(blocks); len(problems) > 0 {
+		return fmt.Errorf("Invalid config file %s:\n  %s", configLocation, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// checkConfig returns a description of every problem which would stop blocks being served
+func checkConfig(blocks []ServerBlock) []string {
+	problems := make([]string, 0)
+
+	httpPorts := make(map[int]bool)
+	tlsPorts := make(map[int]bool)
+
+	for i, sb := range blocks {
+		if len(sb.Hosts) == 0 {
+			problems = append(problems, fmt.Sprintf("Server block %d has no hosts", i))
+		}
+
+		if _, err := parseAccessLogFormat(sb.AccessLogFormat); err != nil {
+			problems = append(problems, fmt.Sprintf("Server block %d has an invalid AccessLogFormat: %v", i, err))
+		}
+		if _, err := ParseTrustedProxies(sb.TrustedProxies); err != nil {
+			problems = append(problems, fmt.Sprintf("Server block %d has an invalid TrustedProxies: %v", i, err))
+		}
+
+		if _, err := lookupMiddleware(sb.Middleware); err != nil {
+			problems = append(problems, fmt.Sprintf("Server block %d: %v", i, err))
+		}
+
+		for _, host := range sb.Hosts {
+			if _, err := CompileHostPattern(host.Host); err != nil {
+				problems = append(problems, fmt.Sprintf("Host %s is an invalid pattern: %v", host.Host, err))
+			}
+			if host.Socket != "" {
+				continue
+			}
+
+			if _, err := CreateClientAuthTLSConfig(host); err != nil {
+				problems = append(problems, fmt.Sprintf("Host %s client auth: %v", host.Host, err))
+			}
+
+			if host.CertFile != "" || host.KeyFile != "" {
+				for _, file := range []string{ host.CertFile, host.KeyFile } {
+					if _, err := os.Stat(file); err != nil {
+						problems = append(problems, fmt.Sprintf("Host %s cert/key file not found: %s", host.Host, file))
+					}
+				}
+				tlsPorts[host.Port] = true
+			} else {
+				httpPorts[host.Port] = true
+			}
+		}
+
+		for _, rsc := range sb.Content {
+			if _, err := regexp.Compile(rsc.Match); err != nil {
+				problems = append(problems, fmt.Sprintf("Resource %s has an invalid Match: %v", rsc.Match, err))
+			}
+			if _, err := regexp.Compile(rsc.Exclude); err != nil {
+				problems = append(problems, fmt.Sprintf("Resource %s has an invalid Exclude: %v", rsc.Match, err))
+			}
+			if _, err := regexp.Compile(rsc.Fingerprint); err != nil {
+				problems = append(problems, fmt.Sprintf("Resource %s has an invalid Fingerprint: %v", rsc.Match, err))
+			}
+			for _, pattern := range rsc.NoCachePatterns {
+				if _, err := regexp.Compile(pattern); err != nil {
+					problems = append(problems, fmt.Sprintf("Resource %s has an invalid NoCachePattern: %v", rsc.Match, err))
+				}
+			}
+			if _, registered := lookupHandler(rsc.Type); !containsString(builtInTypes, rsc.Type) && !registered {
+				problems = append(problems, fmt.Sprintf("Resource %s has an unknown Type: %s", rsc.Match, rsc.Type))
+			}
+			for _, file := range []string{ rsc.Transport.CAFile, rsc.Transport.CertFile, rsc.Transport.KeyFile } {
+				if _, err := os.Stat(file); file != "" && err != nil {
+					problems = append(problems, fmt.Sprintf("Resource %s Transport file not found: %s", rsc.Match, file))
+				}
+			}
+			if !containsString([]string{ "", ErrorFormatHTML, ErrorFormatJSON, ErrorFormatText }, rsc.ErrorFormat) {
+				problems = append(problems, fmt.Sprintf("Resource %s has an unknown ErrorFormat: %s", rsc.Match, rsc.ErrorFormat))
+			}
+			if rsc.CORS.AllowCredentials && containsString(rsc.CORS.AllowedOrigins, AnyOrigin) {
+				problems = append(problems, fmt.Sprintf("Resource %s CORS can't AllowCredentials with '*' AllowedOrigins", rsc.Match))
+			}
+			if info, err := os.Stat(rsc.ErrorRoot); rsc.ErrorRoot != "" && (err != nil || !info.IsDir()) {
+				problems = append(problems, fmt.Sprintf("Resource %s ErrorRoot directory not found: %s", rsc.Match, rsc.ErrorRoot))
+			}
+			if rsc.Balancing != BalanceRoundRobin && rsc.Balancing != BalanceConsistentHash {
+				problems = append(problems, fmt.Sprintf("Resource %s has an unknown Balancing: %s", rsc.Match, rsc.Balancing))
+			}
+			if _, err := lookupMiddleware(rsc.Middleware); err != nil {
+				problems = append(problems, fmt.Sprintf("Resource %s: %v", rsc.Match, err))
+			}
+			for _, errorRedirect := range rsc.Error {
+				if _, err := regexp.Compile(errorRedirect.Match); err != nil {
+					problems = append(problems, fmt.Sprintf("Resource %s has an invalid Error Match: %v", rsc.Match, err))
+				}
+			}
+			for _, rewrite := range rsc.ResponseRewrite {
+				if _, err := regexp.Compile(rewrite.From); rewrite.Regex && err != nil {
+					problems = append(problems, fmt.Sprintf("Resource %s has an invalid ResponseRewrite: %v", rsc.Match, err))
+				}
+			}
+		}
+	}
+
+	if err := validateConfig(blocks); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// Only one HTTPS port can be served and a port can't be both
+	if len(tlsPorts) > 1 {
+		problems = append(problems, fmt.Sprintf("HTTPS can only be served on one port, found %v", sortedPorts(tlsPorts)))
+	}
+	for port := range tlsPorts {
+		if httpPorts[port] {
+			problems = append(problems, fmt.Sprintf("Port %d is used for both HTTP and HTTPS", port))
+		}
+	}
+	return problems
+}
+
+// sortedPorts returns the keys of ports in order
+func sortedPorts(ports map[int]bool) []int {
+	sorted := make([]int, 0, len(ports))
+	for port := range ports {
+		sorted = append(sorted, port)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// interpolateConfig replaces ${VAR} in the file & address values of blocks with the environment variable VAR
+//
+// ${VAR:-default} uses default if VAR is unset or empty, otherwise an unset VAR is an error so a missing secret
+// doesn't quietly become an empty path
+func interpolateConfig(blocks []ServerBlock) error {
+	values := make([]*string, 0)
+	for i := range blocks {
+		for j := range blocks[i].Hosts {
+			host := &blocks[i].Hosts[j]
+			values = append(values, &host.CertFile, &host.KeyFile, &host.ClientCAFile)
+		}
+		for j := range blocks[i].Content {
+			rsc := &blocks[i].Content[j]
+			values = append(values, &rsc.Path, &rsc.ErrorRoot, &rsc.TLSFallbackPath, &rsc.Transport.CAFile, &rsc.Transport.CertFile,
+				&rsc.Transport.KeyFile)
+			for k := range rsc.Roots {
+				values = append(values, &rsc.Roots[k])
+			}
+			for k := range rsc.Upstreams {
+				values = append(values, &rsc.Upstreams[k].URL)
+			}
+			for k := range rsc.Error {
+				values = append(values, &rsc.Error[k].Path)
+			}
+		}
+	}
+
+	for _, value := range values {
+		interpolated, err := interpolate(*value)
+		if err != nil {
+			return err
+		}
+		*value = interpolated
+	}
+	return nil
+}
+
+// interpolate returns value with each ${VAR} or ${VAR:-default} replaced, or an error naming the first unset VAR
+func interpolate(value string) (string, error) {
+	var err error
+	interpolated := envPattern.ReplaceAllStringFunc(value, func(match string) string {
+		parts := envPattern.FindStringSubmatch(match)
+		if env, ok := os.LookupEnv(parts[1]); ok && (env != "" || parts[2] == "") {
+			return env
+		}
+		if parts[2] != "" {
+			return parts[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("Environment variable %s used in config value %s isn't set", parts[1], value)
+		}
+		return match
+	})
+	return interpolated, err
+}
+
+// validateConfig checks the values the JSON decoder can't
+func validateConfig(blocks []ServerBlock) error {
+	for _, sb := range blocks {
+		for _, rsc := range sb.Content {
+			if rsc.CompressionLevel < gzip.HuffmanOnly || rsc.CompressionLevel > gzip.BestCompression {
+				return fmt.Errorf("Invalid CompressionLevel %d for %s, must be between %d and %d", rsc.CompressionLevel,
+					rsc.Match, gzip.HuffmanOnly, gzip.BestCompression)
+			}
+
+			// Without values every request would share one entry, whatever the header said
+			for _, header := range rsc.Cache.VaryHeaders {
+				if len(varyValues(&rsc.Cache, header)) == 0 {
+					return fmt.Errorf("No VaryValues for VaryHeader %s in %s", header, rsc.Match)
+				}
+			}
+		}
+	}
+	return nil
 }
\ No newline at end of file
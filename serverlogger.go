@@ -1,7 +1,10 @@
 package reverseproxy
 import (
+	"fmt"
 	"io"
 	"log"
+	"strings"
+	"sync"
 )
 
 const (
@@ -12,35 +15,148 @@ const (
 )
 
 var (
-	l *log.Logger
-	logFlag uint8
+	// logger is where Debug/Info/Warning/Error are routed, swap it with SetLogger
+	logger Logger = &StdLogger{}
+
+	// logMutex guards logger so it can be changed while requests are being served
+	logMutex sync.RWMutex
 )
 
+// ------------------------------------------------------------------------------------------------------------------------
+// interface: Logger
+// ------------------------------------------------------------------------------------------------------------------------
+
+// Logger is the interface a logging implementation must satisfy to receive the package's log output
+//
+// It lets users plug in zap, logrus etc. via SetLogger
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warningf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// LevelLogger can be implemented by a Logger so messages for levels it isn't logging aren't formatted at all
+type LevelLogger interface {
+	Enabled(level uint8) bool
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: StdLogger
+// ------------------------------------------------------------------------------------------------------------------------
+
+// StdLogger is the default Logger, backed by the standard library log.Logger
+type StdLogger struct {
+
+	// Logger is the underlying writer, nothing is logged if it's nil
+	Logger *log.Logger
+
+	// Flag is a combination of the Level constants indicating which levels are logged
+	Flag uint8
+}
+
+func (this *StdLogger) Debugf(format string, v ...interface{}) {
+	this.printf(LevelDebug, "DEBUG: ", format, v)
+}
+
+func (this *StdLogger) Infof(format string, v ...interface{}) {
+	this.printf(LevelInfo, "INFO: ", format, v)
+}
+
+func (this *StdLogger) Warningf(format string, v ...interface{}) {
+	this.printf(LevelWarning, "WARNING: ", format, v)
+}
+
+func (this *StdLogger) Errorf(format string, v ...interface{}) {
+	this.printf(LevelError, "ERROR: ", format, v)
+}
+
+// Enabled checks whether level is switched on in Flag (and there's somewhere to write to)
+func (this *StdLogger) Enabled(level uint8) bool {
+	return this.Logger != nil && this.Flag & level > 0
+}
+
+// printf writes the prefix + formatted message if the level is switched on in Flag
+func (this *StdLogger) printf(level uint8, prefix string, format string, v []interface{}) {
+	if this.Enabled(level) {
+		this.Logger.Printf(prefix + format, v...)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Exported functions
+// ------------------------------------------------------------------------------------------------------------------------
+
+// InitLog sets up the default StdLogger to write the levels in flag to writer
 func InitLog(flag uint8, writer io.Writer) {
-	logFlag = flag
-	l = log.New(writer, "", log.Ldate|log.Ltime)
+	SetLogger(&StdLogger{ log.New(writer, "", log.Ldate|log.Ltime), flag })
+}
+
+// SetLogger replaces the package logger, passing nil restores a (silent) StdLogger
+func SetLogger(newLogger Logger) {
+	if newLogger == nil {
+		newLogger = &StdLogger{}
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logger = newLogger
+}
+
+// SetLevel changes the levels being logged without replacing the writer passed to InitLog
+//
+// It only applies to the default StdLogger, custom loggers should handle their own levels
+func SetLevel(flag uint8) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	if std, ok := logger.(*StdLogger); ok {
+		logger = &StdLogger{ std.Logger, flag }
+	}
 }
 
 func Debug(v ...interface{}) {
-	if l != nil && logFlag & LevelDebug > 0 {
-		l.Println(append([]interface{}{"DEBUG"}, v...))
+	if l := currentLogger(); enabled(l, LevelDebug) {
+		l.Debugf("%s", sprint(v))
 	}
 }
 
 func Info(v ...interface{}) {
-	if l != nil && logFlag & LevelInfo > 0 {
-		l.Println("INFO:", v)
+	if l := currentLogger(); enabled(l, LevelInfo) {
+		l.Infof("%s", sprint(v))
 	}
 }
 
 func Warning(v ...interface{}) {
-	if l != nil && logFlag & LevelWarning > 0 {
-		l.Println("WARNING:", v)
+	if l := currentLogger(); enabled(l, LevelWarning) {
+		l.Warningf("%s", sprint(v))
 	}
 }
 
 func Error(v ...interface{}) {
-	if l != nil && logFlag & LevelError > 0 {
-		l.Println("ERRORexp:", v)
+	if l := currentLogger(); enabled(l, LevelError) {
+		l.Errorf("%s", sprint(v))
 	}
 }
+
+// ------------------------------------------------------------------------------------------------------------------------
+// Non-exported functions
+// ------------------------------------------------------------------------------------------------------------------------
+
+// currentLogger returns the logger in use, it's called outside the lock so a slow Logger doesn't block SetLogger
+func currentLogger() Logger {
+	logMutex.RLock()
+	defer logMutex.RUnlock()
+	return logger
+}
+
+// enabled checks whether l wants messages at level, loggers that don't implement LevelLogger get everything
+func enabled(l Logger, level uint8) bool {
+	levelLogger, ok := l.(LevelLogger)
+	return !ok || levelLogger.Enabled(level)
+}
+
+// sprint formats args the same way log.Println would (space separated) minus the newline
+func sprint(v []interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
@@ -0,0 +1,240 @@
+package reverseproxy
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Balancing modes. Known 'balancing' values for a resource with Upstreams
+const (
+	BalanceRoundRobin		= ""
+	BalanceConsistentHash	= "consistent_hash"
+)
+
+const (
+	// HashRingReplicas is the number of points each upstream (per unit of Weight) gets on a HashRing
+	HashRingReplicas = 100
+)
+
+// ------------------------------------------------------------------------------------------------------------------------
+// interface: UpstreamSelector
+// ------------------------------------------------------------------------------------------------------------------------
+
+// UpstreamSelector picks which backend (from ServerResource.Upstreams) a proxied request is sent to
+type UpstreamSelector interface {
+
+	// Select returns the URL of the backend for req
+	Select(req *http.Request) string
+}
+
+// CreateUpstreamSelector returns the UpstreamSelector for the resource, nil if it has no Upstreams (Path is used)
+func CreateUpstreamSelector(rsc *ServerResource) UpstreamSelector {
+	if len(rsc.Upstreams) == 0 {
+		return nil
+	}
+
+	if rsc.StickySessions {
+		return NewStickySelector(rsc.Upstreams, rsc.StickyCookie)
+	}
+
+	switch rsc.Balancing {
+	case BalanceConsistentHash:
+		return NewHashRing(rsc.Upstreams, rsc.HashKey)
+	}
+	return NewWeightedRoundRobin(rsc.Upstreams)
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: WeightedRoundRobin
+// ------------------------------------------------------------------------------------------------------------------------
+
+// WeightedRoundRobin spreads requests across upstreams in proportion to their Weight
+//
+// It's the smooth algorithm (as used by nginx) so heavier backends don't get their requests in bursts, with weights
+// 3:1 the order is a a b a rather than a a a b
+type WeightedRoundRobin struct {
+
+	// mutex guards the current weights, requests are handled concurrently
+	mutex sync.Mutex
+
+	upstreams []weightedUpstream
+	totalWeight int
+}
+
+type weightedUpstream struct {
+	URL string
+	Weight int
+	current int
+}
+
+// NewWeightedRoundRobin returns a WeightedRoundRobin over upstreams, weights below 1 are treated as 1
+func NewWeightedRoundRobin(upstreams []Upstream) *WeightedRoundRobin {
+	wrr := &WeightedRoundRobin{ upstreams: make([]weightedUpstream, 0, len(upstreams)) }
+	for _, upstream := range upstreams {
+		weight := upstream.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		wrr.upstreams = append(wrr.upstreams, weightedUpstream{ URL: upstream.URL, Weight: weight })
+		wrr.totalWeight += weight
+	}
+	return wrr
+}
+
+// Select bumps every upstream by its weight and picks the highest, which then drops back by the total
+func (this *WeightedRoundRobin) Select(req *http.Request) string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	best := -1
+	for i := range this.upstreams {
+		this.upstreams[i].current += this.upstreams[i].Weight
+		if best == -1 || this.upstreams[i].current > this.upstreams[best].current {
+			best = i
+		}
+	}
+	if best == -1 {
+		return ""
+	}
+
+	this.upstreams[best].current -= this.totalWeight
+	return this.upstreams[best].URL
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: StickySelector
+// ------------------------------------------------------------------------------------------------------------------------
+
+// StickySelector sends requests from the same client to the same upstream (session affinity)
+//
+// The client is identified by Cookie if it's set and present, otherwise by IP. If the clients upstream isn't
+// Healthy (or there's no way of identifying them) we fall back to weighted round-robin
+type StickySelector struct {
+
+	// Cookie is the name of the cookie identifying the client, empty to always use the IP
+	Cookie string
+
+	// Healthy checks whether an upstream can be used, nil treats them all as healthy
+	Healthy func(url string) bool
+
+	// Fallback is used when the client can't be identified or their upstream is unhealthy
+	Fallback UpstreamSelector
+
+	// slots holds each upstream URL Weight times, the client hash picks one
+	slots []string
+}
+
+// NewStickySelector returns a StickySelector over upstreams, cookie can be empty
+func NewStickySelector(upstreams []Upstream, cookie string) *StickySelector {
+	sticky := &StickySelector{ Cookie: cookie, Fallback: NewWeightedRoundRobin(upstreams) }
+	for _, upstream := range upstreams {
+		for i := 0; i < upstream.Weight || i == 0; i++ {
+			sticky.slots = append(sticky.slots, upstream.URL)
+		}
+	}
+	return sticky
+}
+
+func (this *StickySelector) Select(req *http.Request) string {
+	if key := this.clientKey(req); key != "" && len(this.slots) > 0 {
+		if url := this.slots[hashKey(key) % uint32(len(this.slots))]; this.isHealthy(url) {
+			return url
+		}
+	}
+
+	// Rebalance, skipping unhealthy upstreams (if they're all unhealthy we have to use something)
+	url := this.Fallback.Select(req)
+	for i := 0; i < len(this.slots) && !this.isHealthy(url); i++ {
+		url = this.Fallback.Select(req)
+	}
+	return url
+}
+
+// clientKey returns the value identifying the client
+func (this *StickySelector) clientKey(req *http.Request) string {
+	if this.Cookie != "" {
+		if cookie, err := req.Cookie(this.Cookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+func (this *StickySelector) isHealthy(url string) bool {
+	return this.Healthy == nil || this.Healthy(url)
+}
+
+// ------------------------------------------------------------------------------------------------------------------------
+// struct: HashRing
+// ------------------------------------------------------------------------------------------------------------------------
+
+// HashRing maps a key from the request (the path or a header) to an upstream with consistent hashing
+//
+// Every upstream is placed on the ring many times and a key goes to the next point after its hash. Adding or
+// removing an upstream only moves the keys on either side of its points, the rest keep their upstream
+type HashRing struct {
+
+	// Header is the request header used as the key, empty uses the request path
+	Header string
+
+	points []uint32
+	owners map[uint32]string
+}
+
+// NewHashRing returns a HashRing over upstreams, header can be empty
+func NewHashRing(upstreams []Upstream, header string) *HashRing {
+	ring := &HashRing{ Header: header, owners: make(map[uint32]string) }
+	for _, upstream := range upstreams {
+		weight := upstream.Weight
+		if weight < 1 {
+			weight = 1
+		}
+
+		for i := 0; i < HashRingReplicas * weight; i++ {
+			point := hashKey(upstream.URL + "#" + strconv.Itoa(i))
+			if _, taken := ring.owners[point]; !taken {
+				ring.owners[point] = upstream.URL
+				ring.points = append(ring.points, point)
+			}
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+func (this *HashRing) Select(req *http.Request) string {
+	key := req.URL.Path
+	if this.Header != "" {
+		key = req.Header.Get(this.Header)
+	}
+	return this.Get(key)
+}
+
+// Get returns the upstream key maps to
+func (this *HashRing) Get(key string) string {
+	if len(this.points) == 0 {
+		return ""
+	}
+
+	hash := hashKey(key)
+	i := sort.Search(len(this.points), func(i int) bool { return this.points[i] >= hash })
+	if i == len(this.points) {
+		i = 0
+	}
+	return this.owners[this.points[i]]
+}
+
+// hashKey returns the 32 bit FNV-1a hash of key
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}